@@ -6,6 +6,7 @@ import (
 	"up-down/config"
 	"up-down/database"
 	"up-down/models"
+	"up-down/repositories"
 )
 
 func main() {
@@ -24,11 +25,20 @@ func main() {
 	fmt.Printf("✓ Подключено к БД: %s\n", cfg.Database2.DBName)
 
 	// Автоматическая миграция
-	err = db.AutoMigrate(&models.UserFile{})
+	err = db.AutoMigrate(&models.UserFileStatus{}, &models.UserFileItem{}, &models.DownloadJob{})
 	if err != nil {
 		log.Fatalf("Ошибка миграции: %v", err)
 	}
 
+	// Статусы из прежней таблицы user_files переносим по категориям
+	migrated, err := repositories.NewUserFileRepository(db).MigrateLegacy()
+	if err != nil {
+		log.Fatalf("Ошибка переноса статусов из user_files: %v", err)
+	}
+	if migrated > 0 {
+		fmt.Printf("✓ Перенесено %d статусов из user_files\n", migrated)
+	}
+
 	fmt.Println("✓ Миграция успешно применена!")
-	fmt.Println("✓ Таблица user_files создана через GORM")
+	fmt.Println("✓ Таблицы user_file_statuses, user_file_items, download_jobs созданы через GORM")
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"up-down/config"
+	"up-down/database"
+	"up-down/repositories"
+	"up-down/services"
+	"up-down/storage"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "исправить найденные несоответствия")
+	asJSON := flag.Bool("json", false, "вывести отчёт в формате JSON")
+	flag.Parse()
+
+	// Загрузка конфигурации
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Ошибка загрузки конфигурации: %v", err)
+	}
+
+	// Подключение к первой БД (источник данных)
+	db, err := database.New(&cfg.Database)
+	if err != nil {
+		log.Fatalf("Ошибка подключения к базе данных: %v", err)
+	}
+	defer db.Close()
+
+	// Подключение ко второй БД через GORM (статусы скачивания)
+	db2, err := database.NewGorm(&cfg.Database2)
+	if err != nil {
+		log.Fatalf("Ошибка подключения ко второй базе данных: %v", err)
+	}
+
+	userRepo, err := repositories.NewUserRepository(db, &cfg.Source)
+	if err != nil {
+		log.Fatalf("Ошибка настройки таблицы пользователей: %v", err)
+	}
+
+	// Хранилище файлов (local или s3)
+	store, err := storage.New(cfg)
+	if err != nil {
+		log.Fatalf("Ошибка подключения к хранилищу: %v", err)
+	}
+
+	// Раскладка файлов по шаблонам DIR_LAYOUT и FILE_NAME_TEMPLATE
+	layout, err := services.NewLayout(cfg)
+	if err != nil {
+		log.Fatalf("Ошибка настройки раскладки файлов: %v", err)
+	}
+
+	verifier := services.NewVerifier(cfg, userRepo, repositories.NewUserFileRepository(db2), store, layout)
+
+	report, err := verifier.Run(context.Background(), *fix)
+	if err != nil {
+		log.Fatalf("Ошибка проверки: %v", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+
+	for _, issue := range report.Issues {
+		status := ""
+		if issue.Fixed {
+			status = " [исправлено]"
+		}
+		fmt.Printf("%-18s user_id=%-10d %s %s%s\n", issue.Type, issue.UserID, issue.Path, issue.Detail, status)
+	}
+
+	fmt.Printf("\n✓ Проверено директорий: %d, пользователей: %d\n", report.CheckedDirs, report.CheckedUsers)
+	if len(report.Issues) == 0 {
+		fmt.Println("✓ Несоответствий не найдено")
+		return
+	}
+	for issueType, count := range report.Counts {
+		fmt.Printf("  %s: %d\n", issueType, count)
+	}
+	if !*fix {
+		fmt.Println("\nДля исправления запустите с флагом -fix")
+	}
+}
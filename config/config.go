@@ -3,7 +3,10 @@ package config
 import (
 	"fmt"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,6 +16,8 @@ type Config struct {
 	Database2 DatabaseConfig
 	Server    ServerConfig
 	Download  DownloadConfig
+	Storage   StorageConfig
+	Source    SourceConfig
 }
 
 type DatabaseConfig struct {
@@ -32,6 +37,103 @@ type DownloadConfig struct {
 	Dir       string
 	BatchSize int
 	Workers   int
+
+	// Сколько файлов одной группы (Uploadcare, JSON список) одного пользователя скачивается одновременно
+	FileConcurrency int
+
+	// Ограничение скорости запросов к каждому хосту (token bucket, общий для всех воркеров):
+	// запросов в секунду (0 - без ограничения), пачка без ожидания, нижняя граница при 429/503
+	// и число успешных запросов подряд для повышения скорости
+	Rate         float64
+	Burst        int
+	RateMin      float64
+	RateRecovery int
+
+	// Общее ограничение пропускной способности (байт в секунду, 0 - без ограничения)
+	// и расписание окон с другим ограничением или паузой в часовом поясе ScheduleLocation
+	Bandwidth        int64
+	Schedule         []BandwidthWindow
+	ScheduleLocation *time.Location
+
+	// Повторы при временных ошибках (таймауты, 5xx, 429, обрывы соединения)
+	Retries        int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// Корень для ссылок file:// (пусто - такие ссылки запрещены)
+	FileRoot string
+
+	// Защита диска: наибольший размер файла и суммарный размер файлов пользователя (байт, 0 - без ограничения)
+	// и разрешённые MIME типы (application/pdf, image/*; пусто - любые)
+	MaxFileSize         int64
+	MaxUserSize         int64
+	AllowedContentTypes []string
+
+	// Дедупликация: содержимое хранится один раз в .objects/ab/cdef... (по sha256),
+	// в директориях пользователей - жёсткие ссылки на него. Только для локального хранилища.
+	Dedup bool
+
+	// REST API Uploadcare для разбора групп (пустой PublicKey - группы разбираются по ~N из ссылки)
+	Uploadcare UploadcareConfig
+
+	// Шаблоны раскладки файлов: директория пользователя и имя файла без расширения
+	DirLayout        string
+	FileNameTemplate string
+
+	// Данные пользователя: форматы (json, yaml, txt), поля и общий CSV индекс (пусто - не вести)
+	MetadataFormats string
+	MetadataFields  string
+	MetadataIndex   string
+}
+
+// UploadcareConfig доступ к REST API Uploadcare. APIURL можно заменить на локальную заглушку.
+type UploadcareConfig struct {
+	APIURL    string
+	PublicKey string
+	SecretKey string
+
+	// Хосты CDN, ссылки на которые разбираются как Uploadcare (остальные скачиваются как есть)
+	CDNHosts []string
+}
+
+// StorageConfig хранилище скачанных файлов: local (DOWNLOAD_DIR) или s3
+type StorageConfig struct {
+	Type string
+
+	// Настройки S3-совместимого хранилища
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+}
+
+// SourceConfig таблица пользователей в основной БД и соответствие её колонок.
+// Все запросы к пользователям строятся по этим настройкам.
+type SourceConfig struct {
+	Table         string // таблица или представление, можно со схемой: public.users
+	IDColumn      string
+	GroupColumn   string // группа пользователя (citizenship_id): первый уровень раскладки по умолчанию
+	CreatedColumn string // дата создания для {created_date} и т.п. (пусто - нет)
+
+	// Категории файлов (колонки со ссылками) и колонки с данными пользователя (phone:phone)
+	Categories  []FileCategory
+	MetaColumns []ColumnMapping
+}
+
+// FileCategory категория файлов: колонка со ссылками, поддиректория пользователя и префикс имени файла
+type FileCategory struct {
+	Name   string // имя категории в статусах и журнале: document
+	Column string // колонка со ссылками: document_files
+	Dir    string // поддиректория: documents
+	Prefix string // префикс имени файла ({prefix} в FILE_NAME_TEMPLATE): document
+}
+
+// ColumnMapping имя поля и колонка таблицы, из которой оно читается
+type ColumnMapping struct {
+	Name   string
+	Column string
 }
 
 func Load() (*Config, error) {
@@ -63,6 +165,113 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("неверный формат WORKERS: %w", err)
 	}
 
+	fileConcurrency, err := strconv.Atoi(getEnv("DOWNLOAD_FILE_CONCURRENCY", "3"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_FILE_CONCURRENCY: %w", err)
+	}
+	if fileConcurrency < 1 {
+		fileConcurrency = 1
+	}
+
+	rate, err := strconv.ParseFloat(getEnv("DOWNLOAD_RATE", "2"), 64)
+	if err != nil || rate < 0 {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_RATE: %q", getEnv("DOWNLOAD_RATE", "2"))
+	}
+
+	burst, err := strconv.Atoi(getEnv("DOWNLOAD_BURST", "4"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_BURST: %w", err)
+	}
+
+	rateMin, err := strconv.ParseFloat(getEnv("DOWNLOAD_RATE_MIN", "0.1"), 64)
+	if err != nil || rateMin < 0 {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_RATE_MIN: %q", getEnv("DOWNLOAD_RATE_MIN", "0.1"))
+	}
+
+	rateRecovery, err := strconv.Atoi(getEnv("DOWNLOAD_RATE_RECOVERY", "20"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_RATE_RECOVERY: %w", err)
+	}
+
+	retries, err := strconv.Atoi(getEnv("DOWNLOAD_RETRIES", "3"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_RETRIES: %w", err)
+	}
+
+	retryBase, err := time.ParseDuration(getEnv("DOWNLOAD_RETRY_BASE_DELAY", "1s"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_RETRY_BASE_DELAY: %w", err)
+	}
+
+	retryMax, err := time.ParseDuration(getEnv("DOWNLOAD_RETRY_MAX_DELAY", "30s"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_RETRY_MAX_DELAY: %w", err)
+	}
+
+	bandwidth, err := ParseBandwidth(getEnv("DOWNLOAD_BANDWIDTH", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_BANDWIDTH: %w", err)
+	}
+
+	schedule, err := parseSchedule(getEnv("DOWNLOAD_SCHEDULE", ""))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_SCHEDULE: %w", err)
+	}
+
+	maxFileSize, err := ParseSize(getEnv("DOWNLOAD_MAX_FILE_SIZE", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_MAX_FILE_SIZE: %w", err)
+	}
+
+	maxUserSize, err := ParseSize(getEnv("DOWNLOAD_MAX_USER_SIZE", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_MAX_USER_SIZE: %w", err)
+	}
+
+	allowedContentTypes, err := parseContentTypes(getEnv("DOWNLOAD_ALLOWED_CONTENT_TYPES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_ALLOWED_CONTENT_TYPES: %w", err)
+	}
+
+	dedup, err := strconv.ParseBool(getEnv("DOWNLOAD_DEDUP", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_DEDUP: %w", err)
+	}
+
+	scheduleLocation, err := time.LoadLocation(getEnv("DOWNLOAD_SCHEDULE_TZ", "Local"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат DOWNLOAD_SCHEDULE_TZ: %w", err)
+	}
+
+	categories, err := parseCategories(getEnv("SOURCE_FILE_COLUMNS", "document:document_files:documents,address:address_files"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат SOURCE_FILE_COLUMNS: %w", err)
+	}
+	if len(categories) == 0 {
+		return nil, fmt.Errorf("SOURCE_FILE_COLUMNS не может быть пустым")
+	}
+
+	metaColumns, err := parseColumnMappings(getEnv("SOURCE_META_COLUMNS", "phone,email,first_name,last_name,patronymic,document_number"))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат SOURCE_META_COLUMNS: %w", err)
+	}
+
+	// Пустое значение SOURCE_CREATED_COLUMN отключает поля {created_*}
+	createdColumn, ok := os.LookupEnv("SOURCE_CREATED_COLUMN")
+	if !ok {
+		createdColumn = "created_at"
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if rateMin > rate {
+		rateMin = rate
+	}
+
 	config := &Config{
 		Database: DatabaseConfig{
 			Host:     getEnv("DB_HOST", "localhost"),
@@ -87,6 +296,59 @@ func Load() (*Config, error) {
 			Dir:       getEnv("DOWNLOAD_DIR", "./downloads"),
 			BatchSize: batchSize,
 			Workers:   workers,
+
+			FileConcurrency: fileConcurrency,
+
+			Rate:         rate,
+			Burst:        burst,
+			RateMin:      rateMin,
+			RateRecovery: rateRecovery,
+
+			Bandwidth:        bandwidth,
+			Schedule:         schedule,
+			ScheduleLocation: scheduleLocation,
+
+			Retries:        retries,
+			RetryBaseDelay: retryBase,
+			RetryMaxDelay:  retryMax,
+
+			FileRoot: getEnv("DOWNLOAD_FILE_ROOT", ""),
+			Dedup:    dedup,
+
+			MaxFileSize:         maxFileSize,
+			MaxUserSize:         maxUserSize,
+			AllowedContentTypes: allowedContentTypes,
+
+			Uploadcare: UploadcareConfig{
+				APIURL:    strings.TrimRight(getEnv("UPLOADCARE_API_URL", "https://api.uploadcare.com"), "/"),
+				PublicKey: getEnv("UPLOADCARE_PUBLIC_KEY", ""),
+				SecretKey: getEnv("UPLOADCARE_SECRET_KEY", ""),
+				CDNHosts:  parseList(getEnv("UPLOADCARE_CDN_HOSTS", "ucarecdn.com")),
+			},
+
+			DirLayout:        getEnv("DIR_LAYOUT", "{group}/user_{id}"),
+			FileNameTemplate: getEnv("FILE_NAME_TEMPLATE", "{prefix}_{n}"),
+
+			MetadataFormats: getEnv("METADATA_FORMATS", "json"),
+			MetadataFields:  getEnv("METADATA_FIELDS", "phone,email,first_name,last_name,patronymic,document_number"),
+			MetadataIndex:   getEnv("METADATA_INDEX", "index.csv"),
+		},
+		Storage: StorageConfig{
+			Type:      getEnv("STORAGE_TYPE", "local"),
+			Endpoint:  getEnv("S3_ENDPOINT", ""),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			Bucket:    getEnv("S3_BUCKET", ""),
+			AccessKey: getEnv("S3_ACCESS_KEY", ""),
+			SecretKey: getEnv("S3_SECRET_KEY", ""),
+			Prefix:    getEnv("S3_PREFIX", ""),
+		},
+		Source: SourceConfig{
+			Table:         getEnv("SOURCE_TABLE", "users"),
+			IDColumn:      getEnv("SOURCE_ID_COLUMN", "id"),
+			GroupColumn:   getEnv("SOURCE_GROUP_COLUMN", "citizenship_id"),
+			CreatedColumn: createdColumn,
+			Categories:    categories,
+			MetaColumns:   metaColumns,
 		},
 	}
 
@@ -100,6 +362,95 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// parseList разбирает список через запятую: пробелы по краям и пустые элементы отбрасываются
+func parseList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// categoryNameRe допустимое имя категории, поддиректории и префикса
+var categoryNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseCategories разбирает список "name:column:dir:prefix,...". dir и prefix необязательны
+// и по умолчанию совпадают с именем категории.
+func parseCategories(value string) ([]FileCategory, error) {
+	categories := make([]FileCategory, 0)
+	seen := make(map[string]bool)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, fmt.Errorf("ожидается имя:колонка[:директория[:префикс]]: %q", item)
+		}
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+
+		category := FileCategory{Name: parts[0], Column: parts[1], Dir: parts[0], Prefix: parts[0]}
+		if len(parts) > 2 && parts[2] != "" {
+			category.Dir = parts[2]
+		}
+		if len(parts) > 3 && parts[3] != "" {
+			category.Prefix = parts[3]
+		}
+
+		for _, name := range []string{category.Name, category.Dir, category.Prefix} {
+			if !categoryNameRe.MatchString(name) {
+				return nil, fmt.Errorf("недопустимое имя %q в %q: разрешены буквы, цифры, _ и -", name, item)
+			}
+		}
+		if category.Column == "" {
+			return nil, fmt.Errorf("пустая колонка: %q", item)
+		}
+		if seen[category.Name] {
+			return nil, fmt.Errorf("категория %s указана дважды", category.Name)
+		}
+		seen[category.Name] = true
+
+		categories = append(categories, category)
+	}
+	return categories, nil
+}
+
+// parseColumnMappings разбирает список "name:column,name2:column2"; без двоеточия имя совпадает с колонкой
+func parseColumnMappings(value string) ([]ColumnMapping, error) {
+	mappings := make([]ColumnMapping, 0)
+	seen := make(map[string]bool)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, column, found := strings.Cut(item, ":")
+		if !found {
+			column = name
+		}
+		name, column = strings.TrimSpace(name), strings.TrimSpace(column)
+		if name == "" || column == "" {
+			return nil, fmt.Errorf("пустое имя или колонка: %q", item)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("имя %s указано дважды", name)
+		}
+		seen[name] = true
+
+		mappings = append(mappings, ColumnMapping{Name: name, Column: column})
+	}
+	return mappings, nil
+}
+
 func (c *DatabaseConfig) ConnectionString() string {
 	return fmt.Sprintf(
 		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
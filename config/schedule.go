@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BandwidthWindow окно расписания скорости: с Start до End (минуты от начала суток, End может быть
+// меньше Start - окно через полночь). Limit в байтах в секунду, 0 - без ограничения.
+type BandwidthWindow struct {
+	Start int
+	End   int
+	Limit int64
+	Pause bool // в окне скачивание приостанавливается
+}
+
+// Contains проверяет, попадает ли время суток (в минутах) в окно. Окно с Start == End - круглые сутки.
+func (w BandwidthWindow) Contains(minute int) bool {
+	switch {
+	case w.Start == w.End:
+		return true
+	case w.Start < w.End:
+		return minute >= w.Start && minute < w.End
+	default:
+		return minute >= w.Start || minute < w.End
+	}
+}
+
+// String окно в формате расписания: 09:00-18:00=2MB
+func (w BandwidthWindow) String() string {
+	limit := FormatBandwidth(w.Limit)
+	if w.Pause {
+		limit = "pause"
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d=%s", w.Start/60, w.Start%60, w.End/60, w.End%60, limit)
+}
+
+// parseSchedule разбирает DOWNLOAD_SCHEDULE: окна "ЧЧ:ММ-ЧЧ:ММ=скорость" через запятую,
+// скорость - размер в секунду (2MB, 512KB), unlimited или pause. Побеждает первое подходящее окно.
+func parseSchedule(value string) ([]BandwidthWindow, error) {
+	windows := make([]BandwidthWindow, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		span, limit, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("окно %q: ожидается ЧЧ:ММ-ЧЧ:ММ=скорость", item)
+		}
+		from, to, ok := strings.Cut(strings.TrimSpace(span), "-")
+		if !ok {
+			return nil, fmt.Errorf("окно %q: ожидается ЧЧ:ММ-ЧЧ:ММ=скорость", item)
+		}
+
+		var window BandwidthWindow
+		var err error
+		if window.Start, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("окно %q: %w", item, err)
+		}
+		if window.End, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("окно %q: %w", item, err)
+		}
+
+		limit = strings.TrimSpace(limit)
+		if strings.EqualFold(limit, "pause") {
+			window.Pause = true
+		} else if window.Limit, err = ParseBandwidth(limit); err != nil {
+			return nil, fmt.Errorf("окно %q: %w", item, err)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// parseClock разбирает время суток ЧЧ:ММ в минуты
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("неверное время %q", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// ParseBandwidth разбирает скорость в байтах в секунду: 2MB, 512KB, 1.5MB/s, 1000 (байт), 0 или unlimited - без ограничения
+func ParseBandwidth(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(value, "/S")
+
+	limit, err := ParseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("неверная скорость %q", value)
+	}
+	return limit, nil
+}
+
+// FormatBandwidth скорость для логов и API: 2.0MB, 512.0KB, unlimited
+func FormatBandwidth(limit int64) string {
+	return FormatSize(limit)
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []BandwidthWindow
+	}{
+		{"", []BandwidthWindow{}},
+		{"09:00-18:00=2MB", []BandwidthWindow{{Start: 9 * 60, End: 18 * 60, Limit: 2 << 20}}},
+		{
+			" 23:30-07:00=unlimited , 09:00-18:00=512KB/s,12:00-13:00=pause",
+			[]BandwidthWindow{
+				{Start: 23*60 + 30, End: 7 * 60},
+				{Start: 9 * 60, End: 18 * 60, Limit: 512 << 10},
+				{Start: 12 * 60, End: 13 * 60, Pause: true},
+			},
+		},
+		{"00:00-00:00=1.5MB", []BandwidthWindow{{Limit: 3 << 19}}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSchedule(tt.value)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSchedule(%q) = %+v, ожидалось %+v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"09:00-18:00", "09:00=2MB", "25:00-18:00=2MB", "09:00-18:60=2MB", "09:00-18:00=fast", "09:00-18:00=-1MB"} {
+		if _, err := parseSchedule(value); err == nil {
+			t.Errorf("parseSchedule(%q): ожидалась ошибка", value)
+		}
+	}
+}
+
+func TestBandwidthWindowContains(t *testing.T) {
+	night := BandwidthWindow{Start: 23 * 60, End: 7 * 60}
+	day := BandwidthWindow{Start: 9 * 60, End: 18 * 60}
+	always := BandwidthWindow{Start: 12 * 60, End: 12 * 60}
+
+	tests := []struct {
+		window BandwidthWindow
+		minute int
+		want   bool
+	}{
+		{night, 22*60 + 59, false},
+		{night, 23 * 60, true},
+		{night, 23*60 + 59, true},
+		{night, 0, true},
+		{night, 6*60 + 59, true},
+		{night, 7 * 60, false},
+		{day, 9*60 - 1, false},
+		{day, 9 * 60, true},
+		{day, 18*60 - 1, true},
+		{day, 18 * 60, false},
+		{always, 0, true},
+		{always, 24*60 - 1, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.window.Contains(tt.minute); got != tt.want {
+			t.Errorf("%s.Contains(%02d:%02d) = %v, ожидалось %v", tt.window, tt.minute/60, tt.minute%60, got, tt.want)
+		}
+	}
+}
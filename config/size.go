@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits множители единиц размера (двоичные: 1KB = 1024 байт)
+var sizeUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize разбирает размер в байтах: 20MB, 512KB, 1.5GB, 1000 (байт), 0 или unlimited - без ограничения
+func ParseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" || value == "0" || value == "UNLIMITED" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.multiplier
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("неверный размер %q", value)
+	}
+	return int64(number * multiplier), nil
+}
+
+// FormatSize размер для логов и API: 2.0MB, 512.0KB, unlimited
+func FormatSize(size int64) string {
+	if size <= 0 {
+		return "unlimited"
+	}
+	for _, unit := range sizeUnits {
+		if float64(size) >= unit.multiplier && unit.multiplier > 1 {
+			return fmt.Sprintf("%.1f%s", float64(size)/unit.multiplier, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// parseContentTypes разбирает список MIME типов через запятую: application/pdf,image/*
+func parseContentTypes(value string) ([]string, error) {
+	types := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		major, minor, ok := strings.Cut(item, "/")
+		if !ok || major == "" || minor == "" {
+			return nil, fmt.Errorf("неверный MIME тип %q", item)
+		}
+		types = append(types, item)
+	}
+	return types, nil
+}
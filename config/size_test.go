@@ -0,0 +1,76 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"", 0},
+		{"unlimited", 0},
+		{"1000", 1000},
+		{"512kb", 512 << 10},
+		{"20 MB", 20 << 20},
+		{"1.5GB", 3 << 29},
+		{"10B", 10},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSize(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, ожидалось %d", tt.value, got, err, tt.want)
+		}
+	}
+	for _, value := range []string{"MB", "-1KB", "2TB", "abc"} {
+		if _, err := ParseSize(value); err == nil {
+			t.Errorf("ParseSize(%q): ожидалась ошибка", value)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "unlimited"},
+		{-1, "unlimited"},
+		{512, "512B"},
+		{1024, "1.0KB"},
+		{20 << 20, "20.0MB"},
+		{3 << 29, "1.5GB"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatSize(tt.size); got != tt.want {
+			t.Errorf("FormatSize(%d) = %s, ожидалось %s", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestParseContentTypes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", []string{}},
+		{"application/pdf", []string{"application/pdf"}},
+		{" Image/* , application/PDF,,*/*", []string{"image/*", "application/pdf", "*/*"}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseContentTypes(tt.value)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseContentTypes(%q) = %v, %v, ожидалось %v", tt.value, got, err, tt.want)
+		}
+	}
+	for _, value := range []string{"pdf", "image/", "/png", "application/pdf,jpeg"} {
+		if _, err := parseContentTypes(value); err == nil {
+			t.Errorf("parseContentTypes(%q): ожидалась ошибка", value)
+		}
+	}
+}
@@ -1,44 +1,65 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"log"
 	"math"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"up-down/config"
-	"up-down/database"
 	"up-down/models"
 	"up-down/repositories"
 	"up-down/services"
+	"up-down/storage"
 )
 
 type WebHandler struct {
+	userRepo        *repositories.UserRepository
 	userFileRepo    *repositories.UserFileRepository
-	db              *database.DB
+	fileItemRepo    *repositories.UserFileItemRepository
 	cfg             *config.Config
 	templates       *template.Template
 	downloadManager *services.DownloadManager
+	verifier        *services.Verifier
+	store           storage.Storage
+	layout          *services.Layout
+	metadata        *services.MetadataWriter
 }
 
-func NewWebHandler(userFileRepo *repositories.UserFileRepository, db *database.DB, cfg *config.Config, downloadManager *services.DownloadManager) *WebHandler {
+func NewWebHandler(userRepo *repositories.UserRepository, userFileRepo *repositories.UserFileRepository, fileItemRepo *repositories.UserFileItemRepository, cfg *config.Config, downloadManager *services.DownloadManager, verifier *services.Verifier, store storage.Storage, layout *services.Layout, metadata *services.MetadataWriter) *WebHandler {
 	tmpl := template.Must(template.ParseFiles("templates/index.html"))
 	return &WebHandler{
+		userRepo:        userRepo,
 		userFileRepo:    userFileRepo,
-		db:              db,
+		fileItemRepo:    fileItemRepo,
 		cfg:             cfg,
 		templates:       tmpl,
 		downloadManager: downloadManager,
+		verifier:        verifier,
+		store:           store,
+		layout:          layout,
+		metadata:        metadata,
 	}
 }
 
 // IndexHandler отображает главную страницу
 func (h *WebHandler) IndexHandler(w http.ResponseWriter, r *http.Request) {
-	if err := h.templates.Execute(w, nil); err != nil {
+	names := make([]string, 0, len(h.layout.Categories()))
+	for _, category := range h.layout.Categories() {
+		names = append(names, category.Name)
+	}
+
+	// Колонки таблицы строятся по категориям из настроек
+	data := map[string]interface{}{
+		"GroupColumn":   h.cfg.Source.GroupColumn,
+		"Categories":    h.layout.Categories(),
+		"CategoryNames": names,
+	}
+	if err := h.templates.Execute(w, data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -72,63 +93,61 @@ func (h *WebHandler) GetUsersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Подсчитываем общее количество пользователей с файлами в основной БД
-	var total int64
-	err := h.db.QueryRow(`
-		SELECT COUNT(*)
-		FROM users
-		WHERE (document_files IS NOT NULL AND document_files != '')
-		   OR (address_files IS NOT NULL AND address_files != '')
-	`).Scan(&total)
+	total, err := h.userRepo.CountWithFiles(r.Context(), repositories.UserFilter{})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Получаем пользователей из основной БД с пагинацией
-	offset := (page - 1) * perPage
-	query := fmt.Sprintf(`
-		SELECT id, citizenship_id, document_files, address_files
-		FROM users
-		WHERE (document_files IS NOT NULL AND document_files != '')
-		   OR (address_files IS NOT NULL AND address_files != '')
-		ORDER BY id %s
-		LIMIT $1 OFFSET $2
-	`, sortOrder)
-
-	rows, err := h.db.Query(query, perPage, offset)
+	// Получаем пользователей из основной БД с пагинацией.
+	// Если передан cursor (id последней строки предыдущей страницы), используем keyset-пагинацию,
+	// которая не замедляется на дальних страницах. Иначе - классический OFFSET по номеру страницы.
+	var users []*models.User
+	if cursorStr := r.URL.Query().Get("cursor"); cursorStr != "" {
+		cursor, err := strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		users, err = h.userRepo.ListWithFilesAfter(r.Context(), repositories.UserFilter{}, cursor, sortOrder == "DESC", perPage)
+	} else {
+		users, err = h.userRepo.ListWithFilesPage(r.Context(), (page-1)*perPage, sortOrder == "DESC", perPage)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	views := make([]models.UserFileView, 0)
-	for rows.Next() {
-		var userID int64
-		var citizenshipID sql.NullString
-		var documentFiles sql.NullString
-		var addressFiles sql.NullString
 
-		if err := rows.Scan(&userID, &citizenshipID, &documentFiles, &addressFiles); err != nil {
-			continue
-		}
+	// Статусы категорий всей страницы одним запросом
+	ids := make([]int64, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	statuses, err := h.userFileRepo.GetByUserIDs(ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	failures, err := h.userFileRepo.GetFailuresByUserIDs(ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	views := make([]models.UserFileView, 0, len(users))
+	for _, user := range users {
 		view := models.UserFileView{
-			UserID:        userID,
-			CitizenshipID: citizenshipID.String,
-			DocumentFiles: documentFiles.String,
-			AddressFiles:  addressFiles.String,
-			Document:      false,
-			Address:       false,
+			UserID: user.ID,
+			Group:  user.Group.String,
+			Files:  user.Files,
+			Status: services.CategoryStatuses(h.layout.Categories(), statuses[user.ID]),
 		}
-
-		// Проверяем статус в user_files
-		userFile, err := h.userFileRepo.GetByUserID(userID)
-		if err == nil && userFile != nil {
-			view.Document = userFile.Document
-			view.Address = userFile.Address
+		for category, failure := range failures[user.ID] {
+			if view.Errors == nil {
+				view.Errors = make(map[string]models.CategoryError)
+			}
+			view.Errors[category] = models.CategoryError{Class: failure.ErrorClass, Error: failure.LastError, Permanent: failure.Permanent}
 		}
-
 		views = append(views, view)
 	}
 
@@ -143,10 +162,74 @@ func (h *WebHandler) GetUsersHandler(w http.ResponseWriter, r *http.Request) {
 		SortOrder:  sortOrder,
 	}
 
+	// Курсор для следующей страницы
+	if len(views) == perPage {
+		response.NextCursor = views[len(views)-1].UserID
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// GetUserFileItemsHandler возвращает журнал файлов пользователя (по одной записи на файл)
+func (h *WebHandler) GetUserFileItemsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	items, err := h.fileItemRepo.GetByUserID(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID,
+		"files":   items,
+	})
+}
+
+// VerifyUserFilesHandler сверяет файлы пользователя на диске с manifest.json
+func (h *WebHandler) VerifyUserFilesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userRepo.GetByID(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if !user.HasGroup() {
+		http.Error(w, "citizenship_id not found", http.StatusNotFound)
+		return
+	}
+
+	userKey := h.layout.UserKey(user)
+	mismatches, err := services.VerifyManifest(r.Context(), h.store, userKey)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("Манифест не найден: %v", err),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":    userID,
+		"path":       h.store.Location(userKey),
+		"ok":         len(mismatches) == 0,
+		"mismatches": mismatches,
+	})
+}
+
 // DownloadHandler обрабатывает запрос на скачивание файлов пользователя
 func (h *WebHandler) DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	userIDStr := r.URL.Query().Get("user_id")
@@ -161,17 +244,15 @@ func (h *WebHandler) DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Получаем данные о файлах пользователя
-	var citizenshipID sql.NullString
-	query := `SELECT citizenship_id FROM users WHERE id = $1`
-	err = h.db.QueryRow(query, userID).Scan(&citizenshipID)
+	// Получаем данные пользователя
+	user, err := h.userRepo.GetByID(r.Context(), userID)
 	if err != nil {
 		http.Error(w, "user not found", http.StatusNotFound)
 		return
 	}
 
 	// Формируем путь к файлам
-	if !citizenshipID.Valid || citizenshipID.String == "" {
+	if !user.HasGroup() {
 		http.Error(w, "citizenship_id not found", http.StatusNotFound)
 		return
 	}
@@ -179,8 +260,8 @@ func (h *WebHandler) DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	// Возвращаем JSON с информацией о пути к файлам
 	response := map[string]string{
 		"user_id":        userIDStr,
-		"citizenship_id": citizenshipID.String,
-		"path":           h.cfg.Download.Dir + "/" + citizenshipID.String + "/user_" + userIDStr,
+		"citizenship_id": user.Group.String,
+		"path":           h.store.Location(h.layout.UserKey(user)),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -207,18 +288,7 @@ func (h *WebHandler) DownloadUserFilesHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// Получаем данные пользователя
-	var citizenshipID sql.NullString
-	var documentFiles sql.NullString
-	var addressFiles sql.NullString
-	var phone sql.NullString
-	var email sql.NullString
-	var firstName sql.NullString
-	var lastName sql.NullString
-	var patronymic sql.NullString
-	var documentNumber sql.NullString
-
-	query := `SELECT citizenship_id, document_files, address_files, phone, email, first_name, last_name, patronymic, document_number FROM users WHERE id = $1`
-	err = h.db.QueryRow(query, userID).Scan(&citizenshipID, &documentFiles, &addressFiles, &phone, &email, &firstName, &lastName, &patronymic, &documentNumber)
+	user, err := h.userRepo.GetByID(r.Context(), userID)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
@@ -229,7 +299,7 @@ func (h *WebHandler) DownloadUserFilesHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// Проверяем citizenship_id
-	if !citizenshipID.Valid || citizenshipID.String == "" {
+	if !user.HasGroup() {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -238,16 +308,21 @@ func (h *WebHandler) DownloadUserFilesHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// Формируем путь
-	userDir := fmt.Sprintf("%s/%s/user_%d", h.cfg.Download.Dir, citizenshipID.String, userID)
+	// Префикс пользователя в хранилище
+	userKey := h.layout.UserKey(user)
+	// Общий с массовым скачиванием загрузчик: ограничения скорости и пропускной способности действуют на оба
+	downloader := h.downloadManager.Downloader()
 
 	downloadedFiles := make([]string, 0)
 	errors := make([]string, 0)
-	documentSuccess := false
-	addressSuccess := false
+	success := make(map[string]bool)
 
 	// Проверяем, есть ли вообще файлы для скачивания
-	if (!documentFiles.Valid || documentFiles.String == "") && (!addressFiles.Valid || addressFiles.String == "") {
+	hasFiles := false
+	for _, category := range h.layout.Categories() {
+		hasFiles = hasFiles || user.HasFiles(category.Name)
+	}
+	if !hasFiles {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -256,83 +331,105 @@ func (h *WebHandler) DownloadUserFilesHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// Скачиваем document_files
-	if documentFiles.Valid && documentFiles.String != "" {
-		docDir := userDir + "/documents"
-		files, err := services.NewDownloader(h.cfg.Download.Dir).DownloadUploadcareFiles(documentFiles.String, docDir, "document")
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("Document files: %v", err))
-		} else {
-			downloadedFiles = append(downloadedFiles, files...)
-			documentSuccess = true
-		}
+	// Статусы категорий, скачанных ранее, сохраняются: запись только статусов этого запуска
+	// отметила бы их нескачанными
+	status, err := h.userFileRepo.GetByUserID(userID)
+	if err != nil {
+		log.Printf("Ошибка чтения статуса пользователя %d: %v", userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Скачиваем address_files
-	if addressFiles.Valid && addressFiles.String != "" {
-		addrDir := userDir + "/address"
-		files, err := services.NewDownloader(h.cfg.Download.Dir).DownloadUploadcareFiles(addressFiles.String, addrDir, "address")
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("Address files: %v", err))
-		} else {
-			downloadedFiles = append(downloadedFiles, files...)
-			addressSuccess = true
-		}
+	// Ошибки записи статусов: без них ответ сообщил бы об успехе, хотя ничего не сохранено
+	repoErrors := make([]string, 0)
+	repoError := func(action string, err error) {
+		log.Printf("Ошибка %s пользователя %d: %v", action, userID, err)
+		repoErrors = append(repoErrors, fmt.Sprintf("%s: %v", action, err))
 	}
 
-	// Сохраняем статус в БД
-	if documentSuccess || addressSuccess {
-		h.userFileRepo.Upsert(userID, documentSuccess, addressSuccess)
-
-		// Создаём файл info.txt с информацией о пользователе
-		phoneStr := "N/A"
-		if phone.Valid && phone.String != "" {
-			phoneStr = phone.String
+	// Скачиваем файлы каждой категории. Ограничение размера файлов пользователя общее для всех категорий:
+	// уже скачанные файлы находятся в хранилище и учитываются при скачивании.
+	budget := downloader.NewUserBudget()
+	for _, category := range h.layout.Categories() {
+		if !user.HasFiles(category.Name) {
+			continue
 		}
 
-		emailStr := "N/A"
-		if email.Valid && email.String != "" {
-			emailStr = email.String
+		files, err := downloader.DownloadFiles(r.Context(), user, user.Files[category.Name], category.Name, budget)
+		for _, file := range files {
+			downloadedFiles = append(downloadedFiles, file.Path)
 		}
-
-		firstNameStr := "N/A"
-		if firstName.Valid && firstName.String != "" {
-			firstNameStr = firstName.String
+		if err != nil {
+			// Ошибки группы показываем по каждому файлу
+			if failures := services.GroupFailures(err); len(failures) > 0 {
+				for _, failure := range failures {
+					errors = append(errors, fmt.Sprintf("%s files [%d]: %v", category.Name, failure.Index, failure.Err))
+				}
+			} else {
+				errors = append(errors, fmt.Sprintf("%s files: %v", category.Name, err))
+			}
+			if err := h.userFileRepo.RecordFailure(userID, category.Name, services.ErrorClass(err), err.Error(), services.IsPermanent(err)); err != nil {
+				repoError("записи ошибки "+category.Name, err)
+			}
+			continue
 		}
-
-		lastNameStr := "N/A"
-		if lastName.Valid && lastName.String != "" {
-			lastNameStr = lastName.String
+		success[category.Name] = true
+		status[category.Name] = true
+		if err := h.userFileRepo.RecordSuccess(userID, category.Name); err != nil {
+			repoError("записи статуса "+category.Name, err)
 		}
+	}
+	statuses := services.CategoryStatuses(h.layout.Categories(), status)
 
-		patronymicStr := "N/A"
-		if patronymic.Valid && patronymic.String != "" {
-			patronymicStr = patronymic.String
+	// Сохраняем статус в БД
+	if len(success) > 0 {
+		if err := h.userFileRepo.Upsert(userID, statuses); err != nil {
+			repoError("записи статусов", err)
 		}
 
-		documentNumberStr := "N/A"
-		if documentNumber.Valid && documentNumber.String != "" {
-			documentNumberStr = documentNumber.String
+		// Создаём manifest.json с контрольными суммами файлов
+		items, err := h.fileItemRepo.GetByUserID(userID)
+		if err == nil {
+			err = services.WriteManifest(r.Context(), h.store, userKey, userID, items)
+		}
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("Manifest: %v", err))
 		}
 
-		infoContent := fmt.Sprintf("phone: %s\nemail: %s\nfirst_name: %s\nlast_name: %s\npatronymic: %s\ndocument_number: %s\n",
-			phoneStr, emailStr, firstNameStr, lastNameStr, patronymicStr, documentNumberStr)
-		infoFilePath := userDir + "/info.txt"
-
-		if err := os.WriteFile(infoFilePath, []byte(infoContent), 0644); err != nil {
-			errors = append(errors, fmt.Sprintf("Info file: %v", err))
+		// Создаём файлы с данными пользователя и сразу дописываем строку CSV индекса сегментом;
+		// в основной индекс она попадёт при слиянии в конце следующего задания
+		if err == nil {
+			err = h.metadata.Write(r.Context(), user, userKey, statuses, items)
+			if err == nil {
+				err = h.metadata.FlushIndex(r.Context())
+			}
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("Metadata: %v", err))
+			}
 		}
 	}
 
+	if len(repoErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":          false,
+			"user_id":          userID,
+			"files_downloaded": len(downloadedFiles),
+			"error":            fmt.Sprintf("Ошибка записи статуса в БД: %s", strings.Join(repoErrors, "; ")),
+			"errors":           append(errors, repoErrors...),
+		})
+		return
+	}
+
 	// Формируем ответ
 	response := map[string]interface{}{
 		"success":          len(downloadedFiles) > 0,
 		"user_id":          userID,
-		"citizenship_id":   citizenshipID.String,
-		"path":             userDir,
+		"citizenship_id":   user.Group.String,
+		"path":             h.store.Location(userKey),
 		"files_downloaded": len(downloadedFiles),
-		"document_success": documentSuccess,
-		"address_success":  addressSuccess,
+		"categories":       statuses,
 	}
 
 	if len(errors) > 0 {
@@ -353,7 +450,17 @@ func (h *WebHandler) StartDownloadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err := h.downloadManager.Start()
+	spec, err := decodeJobSpec(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": fmt.Sprintf("неверные параметры запуска: %v", err),
+		})
+		return
+	}
+
+	err = h.downloadManager.Start(spec)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -369,6 +476,76 @@ func (h *WebHandler) StartDownloadHandler(w http.ResponseWriter, r *http.Request
 	})
 }
 
+// decodeJobSpec читает фильтры запуска из JSON в теле запроса; пустое тело - все пользователи
+func decodeJobSpec(r *http.Request) (services.JobSpec, error) {
+	var spec services.JobSpec
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil && err != io.EOF {
+		return spec, err
+	}
+	return spec, nil
+}
+
+// PlanHandler строит план задания без скачивания (POST, фильтры JSON в теле, ?head=true для размеров файлов)
+// или возвращает последний план (GET)
+func (h *WebHandler) PlanHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		report, running := h.downloadManager.LastPlan()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"running": running,
+			"report":  report,
+		})
+
+	case http.MethodPost:
+		spec, err := decodeJobSpec(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("неверные параметры запуска: %v", err),
+			})
+			return
+		}
+
+		head := r.URL.Query().Get("head") == "true"
+		if err := h.downloadManager.StartPlan(spec, head); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "started",
+			"head":   head,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// StopPlanHandler прерывает построение плана
+func (h *WebHandler) StopPlanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.downloadManager.StopPlan()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "stopped",
+	})
+}
+
 // StopDownloadHandler останавливает процесс скачивания
 func (h *WebHandler) StopDownloadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -384,21 +561,228 @@ func (h *WebHandler) StopDownloadHandler(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// PauseDownloadHandler приостанавливает процесс скачивания
+func (h *WebHandler) PauseDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.downloadManager.Pause(); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "paused",
+	})
+}
+
+// ResumeDownloadHandler продолжает приостановленное скачивание
+func (h *WebHandler) ResumeDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.downloadManager.Resume(); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "running",
+	})
+}
+
+// GetJobsHandler возвращает последние задания скачивания
+func (h *WebHandler) GetJobsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	jobs, err := h.downloadManager.RecentJobs(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]map[string]interface{}, 0, len(jobs))
+	for i := range jobs {
+		response = append(response, map[string]interface{}{
+			"job":       jobs[i],
+			"resumable": jobs[i].Resumable(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetFailuresHandler возвращает нескачанные категории пользователей с причиной последней ошибки.
+// Фильтры: ?class=http_404,timeout, ?category=document, ?permanent=false (без постоянных ошибок).
+func (h *WebHandler) GetFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	page := 1
+	perPage := 50
+	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
+		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+	if perPageStr := r.URL.Query().Get("per_page"); perPageStr != "" {
+		if pp, err := strconv.Atoi(perPageStr); err == nil && pp > 0 && pp <= 500 {
+			perPage = pp
+		}
+	}
+
+	filter := repositories.FailureFilter{
+		Category:         r.URL.Query().Get("category"),
+		IncludePermanent: r.URL.Query().Get("permanent") != "false",
+	}
+	if classes := r.URL.Query().Get("class"); classes != "" {
+		for _, class := range strings.Split(classes, ",") {
+			class = strings.TrimSpace(class)
+			if !services.IsErrorClass(class) {
+				http.Error(w, fmt.Sprintf("Неизвестный класс ошибки: %s", class), http.StatusBadRequest)
+				return
+			}
+			filter.Classes = append(filter.Classes, class)
+		}
+	}
+
+	failures, total, err := h.userFileRepo.GetFailuresPaginated(filter, page, perPage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	classes, err := h.userFileRepo.CountFailuresByClass(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data":        failures,
+		"total":       total,
+		"page":        page,
+		"per_page":    perPage,
+		"total_pages": int(math.Ceil(float64(total) / float64(perPage))),
+		"classes":     classes,
+	})
+}
+
+// ResumeJobHandler продолжает прерванное задание с контрольной точки
+func (h *WebHandler) ResumeJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobID, err := strconv.ParseUint(r.URL.Query().Get("job_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid job_id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.downloadManager.ResumeJob(uint(jobID)); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "started",
+		"job_id": jobID,
+	})
+}
+
+// VerifyHandler запускает сверку диска с базой данных (POST, ?fix=true для исправления)
+// или возвращает отчёт последней сверки (GET)
+func (h *WebHandler) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		report, running := h.verifier.LastReport()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"running": running,
+			"report":  report,
+		})
+
+	case http.MethodPost:
+		fix := r.URL.Query().Get("fix") == "true"
+
+		// Исправление удаляет .tmp файлы, которые нужны идущему скачиванию для докачки
+		status, _, _ := h.downloadManager.GetStatus()
+		if fix && (status == services.StatusRunning || status == services.StatusPaused) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Нельзя исправлять файлы во время скачивания",
+			})
+			return
+		}
+
+		if err := h.verifier.Start(fix); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "started",
+			"fix":    fix,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // GetProgressHandler возвращает текущий прогресс скачивания
 func (h *WebHandler) GetProgressHandler(w http.ResponseWriter, r *http.Request) {
 	status, stats, duration := h.downloadManager.GetStatus()
+	bandwidth, pausedBySchedule := h.downloadManager.Bandwidth()
 
 	response := map[string]interface{}{
-		"status":           string(status),
-		"total_users":      stats.TotalUsers,
-		"processed_users":  stats.ProcessedUsers,
-		"successful_users": stats.SuccessfulUsers,
-		"failed_users":     stats.FailedUsers,
-		"total_files":      stats.TotalFiles,
-		"successful_files": stats.SuccessfulFiles,
-		"failed_files":     stats.FailedFiles,
-		"skipped_users":    stats.SkippedUsers,
-		"duration_seconds": duration.Seconds(),
+		"status":             string(status),
+		"total_users":        stats.TotalUsers,
+		"processed_users":    stats.ProcessedUsers,
+		"successful_users":   stats.SuccessfulUsers,
+		"failed_users":       stats.FailedUsers,
+		"total_files":        stats.TotalFiles,
+		"successful_files":   stats.SuccessfulFiles,
+		"failed_files":       stats.FailedFiles,
+		"skipped_users":      stats.SkippedUsers,
+		"dedup_files":        stats.DedupFiles,
+		"dedup_bytes":        stats.DedupBytes,
+		"last_user_id":       stats.LastUserID,
+		"job_id":             h.downloadManager.CurrentJobID(),
+		"duration_seconds":   duration.Seconds(),
+		"rate_limits":        h.downloadManager.HostRates(),
+		"bandwidth":          bandwidth,
+		"paused_by_schedule": pausedBySchedule,
 	}
 
 	if stats.TotalUsers > 0 {
@@ -420,60 +804,66 @@ func (h *WebHandler) GetDownloadStatsHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Получаем всех пользователей с файлами из первой БД
-	rows, err := h.db.Query(`
-		SELECT id,
-		       (document_files IS NOT NULL AND document_files != '') as has_doc,
-		       (address_files IS NOT NULL AND address_files != '') as has_addr
-		FROM users
-		WHERE (document_files IS NOT NULL AND document_files != '')
-		   OR (address_files IS NOT NULL AND address_files != '')
-	`)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
 	var totalUsersWithFiles int64
 	var fullyDownloaded int64
 	var partiallyDownloaded int64
 	var notDownloaded int64
 
-	// Проходим по каждому пользователю и проверяем его статус
-	for rows.Next() {
-		var userID int64
-		var hasDoc, hasAddr bool
-
-		if err := rows.Scan(&userID, &hasDoc, &hasAddr); err != nil {
-			continue
-		}
+	// Статистика по каждой категории: у скольких пользователей есть ссылки и у скольких скачаны
+	categories := h.layout.Categories()
+	withFiles := make(map[string]int64, len(categories))
+	downloaded := make(map[string]int64, len(categories))
 
+	// Проходим по всем пользователям с файлами из первой БД и проверяем их статус
+	err = h.userRepo.EachWithFiles(r.Context(), repositories.UserFilter{}, func(userID int64, present map[string]bool) {
 		totalUsersWithFiles++
-
-		// Ищем статус в map (уже загружен из БД)
-		userFile, exists := userFilesMap[userID]
-
-		if !exists {
-			// Нет записи в user_files - файлы не скачаны
-			notDownloaded++
-			continue
+		status := userFilesMap[userID]
+
+		// Проверяем, все ли требуемые категории скачаны
+		required, done := 0, 0
+		for _, category := range categories {
+			if !present[category.Name] {
+				continue
+			}
+			required++
+			withFiles[category.Name]++
+			if status[category.Name] {
+				done++
+				downloaded[category.Name]++
+			}
 		}
 
-		// Проверяем, все ли требуемые файлы скачаны
-		docOk := !hasDoc || userFile.Document
-		addrOk := !hasAddr || userFile.Address
-
-		if docOk && addrOk {
+		switch {
+		case done == required:
 			// Все требуемые файлы скачаны
 			fullyDownloaded++
-		} else if userFile.Document || userFile.Address {
-			// Хотя бы один тип файлов скачан, но не все
+		case done > 0:
+			// Хотя бы одна категория скачана, но не все
 			partiallyDownloaded++
-		} else {
-			// Запись есть, но файлы не скачаны
+		default:
+			// Нет записи в user_file_statuses или файлы не скачаны
 			notDownloaded++
 		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Повторы содержимого: при DOWNLOAD_DEDUP столько места сэкономлено, без неё - можно сэкономить
+	duplicates, err := h.fileItemRepo.GetDuplicateStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	categoryStats := make([]map[string]interface{}, 0, len(categories))
+	for _, category := range categories {
+		categoryStats = append(categoryStats, map[string]interface{}{
+			"name":       category.Name,
+			"with_files": withFiles[category.Name],
+			"downloaded": downloaded[category.Name],
+		})
 	}
 
 	response := map[string]interface{}{
@@ -482,6 +872,9 @@ func (h *WebHandler) GetDownloadStatsHandler(w http.ResponseWriter, r *http.Requ
 		"partially_downloaded": partiallyDownloaded,
 		"not_downloaded":       notDownloaded,
 		"remaining":            totalUsersWithFiles - fullyDownloaded,
+		"categories":           categoryStats,
+		"duplicates":           duplicates,
+		"dedup":                h.downloadManager.Downloader().Dedup != nil,
 		"progress_percent":     0.0,
 	}
 
@@ -10,6 +10,7 @@ import (
 	"up-down/models"
 	"up-down/repositories"
 	"up-down/services"
+	"up-down/storage"
 )
 
 func main() {
@@ -33,28 +34,79 @@ func main() {
 	}
 
 	// Автоматическая миграция
-	if err := db2.AutoMigrate(&models.UserFile{}); err != nil {
+	if err := db2.AutoMigrate(&models.UserFileStatus{}, &models.UserFileItem{}, &models.DownloadJob{}); err != nil {
 		log.Fatalf("Ошибка миграции: %v", err)
 	}
 
-	// Создаём репозиторий
+	// Создаём репозитории
+	userRepo, err := repositories.NewUserRepository(db, &cfg.Source)
+	if err != nil {
+		log.Fatalf("Ошибка настройки таблицы пользователей: %v", err)
+	}
 	userFileRepo := repositories.NewUserFileRepository(db2)
+	fileItemRepo := repositories.NewUserFileItemRepository(db2)
+
+	// Статусы из прежней таблицы user_files (document/address) переносим в user_file_statuses
+	if migrated, err := userFileRepo.MigrateLegacy(); err != nil {
+		log.Fatalf("Ошибка переноса статусов из user_files: %v", err)
+	} else if migrated > 0 {
+		log.Printf("📋 Перенесено %d статусов из user_files в user_file_statuses", migrated)
+	}
+	jobRepo := repositories.NewDownloadJobRepository(db2)
+
+	// Хранилище файлов (local или s3)
+	store, err := storage.New(cfg)
+	if err != nil {
+		log.Fatalf("Ошибка подключения к хранилищу: %v", err)
+	}
+	log.Printf("📦 Хранилище файлов: %s", store.Location(""))
+
+	// Раскладка файлов по шаблонам DIR_LAYOUT и FILE_NAME_TEMPLATE
+	layout, err := services.NewLayout(cfg)
+	if err != nil {
+		log.Fatalf("Ошибка настройки раскладки файлов: %v", err)
+	}
+
+	// Файлы с данными пользователя (METADATA_FORMATS, METADATA_FIELDS) и CSV индекс
+	metadata, err := services.NewMetadataWriter(cfg, store)
+	if err != nil {
+		log.Fatalf("Ошибка настройки данных пользователя: %v", err)
+	}
 
 	// Создаём менеджер скачивания
-	downloadManager := services.NewDownloadManager(cfg, db, userFileRepo)
+	downloadManager := services.NewDownloadManager(cfg, userRepo, userFileRepo, fileItemRepo, jobRepo, store, layout, metadata)
+
+	// Задания, оставшиеся в статусе running/paused, прерваны перезапуском
+	interruptedJob, err := downloadManager.RecoverInterruptedJobs()
+	if err != nil {
+		log.Printf("Ошибка проверки прерванных заданий: %v", err)
+	}
+
+	// Создаём сверку хранилища с базой данных
+	verifier := services.NewVerifier(cfg, userRepo, userFileRepo, store, layout)
 
 	// Создаём handler
-	webHandler := handlers.NewWebHandler(userFileRepo, db, cfg, downloadManager)
+	webHandler := handlers.NewWebHandler(userRepo, userFileRepo, fileItemRepo, cfg, downloadManager, verifier, store, layout, metadata)
 
 	// Настройка маршрутов
 	http.HandleFunc("/", webHandler.IndexHandler)
 	http.HandleFunc("/api/users", webHandler.GetUsersHandler)
+	http.HandleFunc("GET /api/users/{id}/files", webHandler.GetUserFileItemsHandler)
+	http.HandleFunc("GET /api/users/{id}/verify", webHandler.VerifyUserFilesHandler)
 	http.HandleFunc("/api/download", webHandler.DownloadHandler)
 	http.HandleFunc("/api/download/user", webHandler.DownloadUserFilesHandler)
 	http.HandleFunc("/api/download/start", webHandler.StartDownloadHandler)
 	http.HandleFunc("/api/download/stop", webHandler.StopDownloadHandler)
+	http.HandleFunc("/api/download/pause", webHandler.PauseDownloadHandler)
+	http.HandleFunc("/api/download/resume", webHandler.ResumeDownloadHandler)
+	http.HandleFunc("/api/download/jobs", webHandler.GetJobsHandler)
+	http.HandleFunc("/api/download/jobs/resume", webHandler.ResumeJobHandler)
+	http.HandleFunc("/api/download/plan", webHandler.PlanHandler)
+	http.HandleFunc("/api/download/plan/stop", webHandler.StopPlanHandler)
+	http.HandleFunc("/api/download/failures", webHandler.GetFailuresHandler)
 	http.HandleFunc("/api/download/progress", webHandler.GetProgressHandler)
 	http.HandleFunc("/api/download/stats", webHandler.GetDownloadStatsHandler)
+	http.HandleFunc("/api/verify", webHandler.VerifyHandler)
 
 	// Статические файлы
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
@@ -69,6 +121,11 @@ func main() {
 	fmt.Printf("✓ Веб-сервер запущен на: http://localhost%s\n\n", addr)
 	fmt.Println("📊 Откройте браузер и перейдите по адресу выше")
 	fmt.Println("🚀 Нажмите 'Запустить скачивание' в веб-интерфейсе")
+	if interruptedJob != nil {
+		fmt.Printf("\n⚠️  Найдено прерванное задание #%d (обработано %d пользователей, контрольная точка user_id %d)\n",
+			interruptedJob.ID, interruptedJob.ProcessedUsers, interruptedJob.LastUserID)
+		fmt.Printf("   Продолжить: кнопка в веб-интерфейсе или POST /api/download/jobs/resume?job_id=%d\n", interruptedJob.ID)
+	}
 	fmt.Println("\nНажмите Ctrl+C для остановки сервера")
 
 	if err := http.ListenAndServe(addr, nil); err != nil {
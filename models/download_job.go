@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// Статусы задания скачивания
+const (
+	JobStatusRunning     = "running"
+	JobStatusPaused      = "paused"
+	JobStatusCompleted   = "completed"
+	JobStatusFailed      = "failed"
+	JobStatusStopped     = "stopped"
+	JobStatusInterrupted = "interrupted" // процесс завершился, не дождавшись окончания задания
+)
+
+// DownloadJob задание скачивания с контрольной точкой для продолжения после перезапуска
+type DownloadJob struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt  time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+	Status     string     `gorm:"size:20;index;not null" json:"status"`
+	Config     string     `gorm:"type:text" json:"config"`       // JSON с настройками запуска
+	LastUserID int64      `gorm:"default:0" json:"last_user_id"` // все пользователи с id <= LastUserID обработаны
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Error      string     `gorm:"type:text" json:"error"`
+
+	TotalUsers      int64 `json:"total_users"`
+	ProcessedUsers  int64 `json:"processed_users"`
+	SuccessfulUsers int64 `json:"successful_users"`
+	FailedUsers     int64 `json:"failed_users"`
+	SkippedUsers    int64 `json:"skipped_users"`
+	TotalFiles      int64 `json:"total_files"`
+	SuccessfulFiles int64 `json:"successful_files"`
+	FailedFiles     int64 `json:"failed_files"`
+	DedupFiles      int64 `json:"dedup_files"` // записано ссылкой на уже скачанное содержимое
+	DedupBytes      int64 `json:"dedup_bytes"` // сэкономлено места дедупликацией
+}
+
+func (DownloadJob) TableName() string {
+	return "download_jobs"
+}
+
+// Resumable сообщает, можно ли продолжить задание с контрольной точки
+func (j *DownloadJob) Resumable() bool {
+	return j.Status == JobStatusInterrupted || j.Status == JobStatusStopped
+}
@@ -2,15 +2,21 @@ package models
 
 import "database/sql"
 
+// User пользователь из основной БД. Колонки задаются настройками источника (SOURCE_*).
 type User struct {
-	ID             int64
-	CitizenshipID  sql.NullString
-	DocumentFiles  sql.NullString
-	AddressFiles   sql.NullString
-	Phone          sql.NullString
-	Email          sql.NullString
-	FirstName      sql.NullString
-	LastName       sql.NullString
-	Patronymic     sql.NullString
-	DocumentNumber sql.NullString
+	ID        int64
+	Group     sql.NullString    // колонка группы (citizenship_id)
+	Files     map[string]string // ссылки на файлы по именам колонок файлов (document, address, ...)
+	Meta      map[string]string // данные пользователя по именам колонок (phone, email, ...); NULL - пустая строка
+	CreatedAt sql.NullTime
+}
+
+// HasFiles проверяет, есть ли у пользователя ссылки в колонке файлов name
+func (u *User) HasFiles(name string) bool {
+	return u.Files[name] != ""
+}
+
+// HasGroup проверяет, заполнена ли группа пользователя
+func (u *User) HasGroup() bool {
+	return u.Group.Valid && u.Group.String != ""
 }
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// UserFileItem запись о скачивании одного файла (одного элемента группы Uploadcare)
+type UserFileItem struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+	UserID       int64      `gorm:"uniqueIndex:idx_user_file_items_file;not null" json:"user_id"`
+	Category     string     `gorm:"uniqueIndex:idx_user_file_items_file;size:50;not null" json:"category"` // document, address
+	GroupIndex   int        `gorm:"uniqueIndex:idx_user_file_items_file;not null" json:"group_index"`
+	URL          string     `gorm:"type:text" json:"url"`
+	OriginalName string     `gorm:"type:text" json:"original_name"` // исходное имя файла по данным источника
+	LocalPath    string     `gorm:"type:text" json:"local_path"`    // путь на диске или s3://bucket/key
+	StorageKey   string     `gorm:"type:text" json:"storage_key"`   // ключ в хранилище: {citizenship_id}/user_{id}/...
+	Size         int64      `gorm:"default:0" json:"size"`
+	ContentType  string     `gorm:"size:255" json:"content_type"`
+	SHA256       string     `gorm:"size:64" json:"sha256"`
+	Attempts     int        `gorm:"default:0" json:"attempts"`
+	LastError    string     `gorm:"type:text" json:"last_error"`
+	ErrorClass   string     `gorm:"size:50" json:"error_class"`     // http_404, timeout, ...
+	Permanent    bool       `gorm:"default:false" json:"permanent"` // постоянная ошибка: не повторять автоматически
+	DownloadedAt *time.Time `json:"downloaded_at"`
+}
+
+func (UserFileItem) TableName() string {
+	return "user_file_items"
+}
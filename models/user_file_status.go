@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// UserFileStatus статус скачивания одной категории файлов пользователя
+// и причина последней неудачной попытки
+type UserFileStatus struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt  time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+	UserID     int64      `gorm:"uniqueIndex:idx_user_file_statuses_category;not null" json:"user_id"`
+	Category   string     `gorm:"uniqueIndex:idx_user_file_statuses_category;size:50;not null" json:"category"` // document, address, passport, ...
+	Downloaded bool       `gorm:"default:false" json:"downloaded"`
+	Attempts   int        `gorm:"default:0" json:"attempts"` // попыток скачать категорию (успешных и нет)
+	LastError  string     `gorm:"type:text" json:"last_error"`
+	ErrorClass string     `gorm:"size:50;index" json:"error_class"` // http_404, timeout, ... (пусто - ошибки нет)
+	Permanent  bool       `gorm:"default:false" json:"permanent"`   // постоянная ошибка: не повторять автоматически
+	FailedAt   *time.Time `json:"failed_at"`
+}
+
+func (UserFileStatus) TableName() string {
+	return "user_file_statuses"
+}
@@ -2,12 +2,20 @@ package models
 
 // UserFileView представление для отображения в веб-интерфейсе
 type UserFileView struct {
-	UserID        int64  `json:"user_id"`
-	CitizenshipID string `json:"citizenship_id"`
-	Document      bool   `json:"document"`
-	Address       bool   `json:"address"`
-	DocumentFiles string `json:"document_files"` // ссылка из основной БД
-	AddressFiles  string `json:"address_files"`  // ссылка из основной БД
+	UserID int64             `json:"user_id"`
+	Group  string            `json:"group"`  // колонка группы (citizenship_id)
+	Files  map[string]string `json:"files"`  // ссылки из основной БД по категориям
+	Status map[string]bool   `json:"status"` // скачана ли категория
+
+	// Причина последней неудачи по нескачанным категориям (too_large, content_type, ...)
+	Errors map[string]CategoryError `json:"errors,omitempty"`
+}
+
+// CategoryError класс и текст последней ошибки скачивания категории
+type CategoryError struct {
+	Class     string `json:"class"`
+	Error     string `json:"error"`
+	Permanent bool   `json:"permanent"`
 }
 
 // PaginatedResponse ответ с пагинацией
@@ -18,4 +26,5 @@ type PaginatedResponse struct {
 	PerPage    int            `json:"per_page"`
 	TotalPages int            `json:"total_pages"`
 	SortOrder  string         `json:"sort_order"`
+	NextCursor int64          `json:"next_cursor,omitempty"` // id последней строки для keyset-пагинации
 }
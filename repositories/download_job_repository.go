@@ -0,0 +1,60 @@
+package repositories
+
+import (
+	"up-down/models"
+
+	"gorm.io/gorm"
+)
+
+type DownloadJobRepository struct {
+	db *gorm.DB
+}
+
+func NewDownloadJobRepository(db *gorm.DB) *DownloadJobRepository {
+	return &DownloadJobRepository{db: db}
+}
+
+// Create создаёт запись о задании
+func (r *DownloadJobRepository) Create(job *models.DownloadJob) error {
+	return r.db.Create(job).Error
+}
+
+// Save сохраняет состояние задания (статус, контрольную точку и счётчики)
+func (r *DownloadJobRepository) Save(job *models.DownloadJob) error {
+	return r.db.Save(job).Error
+}
+
+// GetByID получает задание по id
+func (r *DownloadJobRepository) GetByID(id uint) (*models.DownloadJob, error) {
+	var job models.DownloadJob
+	err := r.db.First(&job, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetRecent получает последние задания
+func (r *DownloadJobRepository) GetRecent(limit int) ([]models.DownloadJob, error) {
+	var jobs []models.DownloadJob
+	err := r.db.Order("id desc").Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+// MarkInterrupted помечает задания, оставшиеся в статусе running/paused после перезапуска процесса
+func (r *DownloadJobRepository) MarkInterrupted() (int64, error) {
+	result := r.db.Model(&models.DownloadJob{}).
+		Where("status IN ?", []string{models.JobStatusRunning, models.JobStatusPaused}).
+		Update("status", models.JobStatusInterrupted)
+	return result.RowsAffected, result.Error
+}
+
+// GetLastInterrupted получает последнее прерванное задание
+func (r *DownloadJobRepository) GetLastInterrupted() (*models.DownloadJob, error) {
+	var job models.DownloadJob
+	err := r.db.Where("status = ?", models.JobStatusInterrupted).Order("id desc").First(&job).Error
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
@@ -0,0 +1,99 @@
+package repositories
+
+import (
+	"up-down/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type UserFileItemRepository struct {
+	db *gorm.DB
+}
+
+func NewUserFileItemRepository(db *gorm.DB) *UserFileItemRepository {
+	return &UserFileItemRepository{db: db}
+}
+
+// fileConflict уникальный ключ файла: пользователь, категория и индекс в группе
+var fileConflict = []clause.Column{{Name: "user_id"}, {Name: "category"}, {Name: "group_index"}}
+
+// RecordSuccess записывает успешное скачивание файла и увеличивает счётчик попыток
+func (r *UserFileItemRepository) RecordSuccess(item *models.UserFileItem) error {
+	item.Attempts = 1
+	return r.db.Clauses(clause.OnConflict{
+		Columns: fileConflict,
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"url":           item.URL,
+			"original_name": item.OriginalName,
+			"local_path":    item.LocalPath,
+			"storage_key":   item.StorageKey,
+			"size":          item.Size,
+			"content_type":  item.ContentType,
+			"sha256":        item.SHA256,
+			"last_error":    "",
+			"error_class":   "",
+			"permanent":     false,
+			"downloaded_at": item.DownloadedAt,
+			"attempts":      gorm.Expr("user_file_items.attempts + 1"),
+			"updated_at":    gorm.Expr("NOW()"),
+		}),
+	}).Create(item).Error
+}
+
+// RecordFailure записывает неудачную попытку скачивания файла, не затирая данные прошлой успешной загрузки
+func (r *UserFileItemRepository) RecordFailure(item *models.UserFileItem) error {
+	item.Attempts = 1
+	return r.db.Clauses(clause.OnConflict{
+		Columns: fileConflict,
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"url":         item.URL,
+			"last_error":  item.LastError,
+			"error_class": item.ErrorClass,
+			"permanent":   item.Permanent,
+			"attempts":    gorm.Expr("user_file_items.attempts + 1"),
+			"updated_at":  gorm.Expr("NOW()"),
+		}),
+	}).Create(item).Error
+}
+
+// HasPermanentFailure проверяет, есть ли у пользователя в категории файл с постоянной ошибкой.
+// Ошибки классов exceptClasses не учитываются.
+func (r *UserFileItemRepository) HasPermanentFailure(userID int64, category string, exceptClasses ...string) (bool, error) {
+	var count int64
+	query := r.db.Model(&models.UserFileItem{}).
+		Where("user_id = ? AND category = ? AND permanent = ?", userID, category, true)
+	if len(exceptClasses) > 0 {
+		query = query.Where("error_class NOT IN ?", exceptClasses)
+	}
+	err := query.Count(&count).Error
+	return count > 0, err
+}
+
+// DuplicateStats повторы содержимого среди скачанных файлов (одинаковый sha256)
+type DuplicateStats struct {
+	Files int64 `json:"files"` // файлов, содержимое которых уже встречалось
+	Bytes int64 `json:"bytes"` // их суммарный размер: место, которое экономит дедупликация
+}
+
+// GetDuplicateStats считает повторы содержимого по журналу: для каждого sha256 все файлы, кроме первого
+func (r *UserFileItemRepository) GetDuplicateStats() (DuplicateStats, error) {
+	var stats DuplicateStats
+	err := r.db.Raw(`
+		SELECT COALESCE(SUM(copies - 1), 0) AS files, COALESCE(SUM((copies - 1) * size), 0) AS bytes
+		FROM (
+			SELECT sha256, MAX(size) AS size, COUNT(*) AS copies
+			FROM user_file_items
+			WHERE downloaded_at IS NOT NULL AND sha256 <> ''
+			GROUP BY sha256
+			HAVING COUNT(*) > 1
+		) duplicates`).Scan(&stats).Error
+	return stats, err
+}
+
+// GetByUserID получает все файлы пользователя
+func (r *UserFileItemRepository) GetByUserID(userID int64) ([]models.UserFileItem, error) {
+	var items []models.UserFileItem
+	err := r.db.Where("user_id = ?", userID).Order("category, group_index").Find(&items).Error
+	return items, err
+}
@@ -1,12 +1,15 @@
 package repositories
 
 import (
+	"fmt"
+	"time"
 	"up-down/models"
 
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+// UserFileRepository статусы скачивания категорий файлов пользователей (user_file_statuses)
 type UserFileRepository struct {
 	db *gorm.DB
 }
@@ -15,72 +18,253 @@ func NewUserFileRepository(db *gorm.DB) *UserFileRepository {
 	return &UserFileRepository{db: db}
 }
 
-// Upsert создаёт или обновляет запись о файлах пользователя
-func (r *UserFileRepository) Upsert(userID int64, document, address bool) error {
-	userFile := models.UserFile{
-		UserID:   userID,
-		Document: document,
-		Address:  address,
+// statusConflict уникальный ключ статуса: пользователь и категория
+var statusConflict = []clause.Column{{Name: "user_id"}, {Name: "category"}}
+
+// Upsert создаёт или обновляет статусы категорий пользователя.
+// Для скачанных категорий причина прошлой ошибки сбрасывается.
+func (r *UserFileRepository) Upsert(userID int64, statuses map[string]bool) error {
+	if len(statuses) == 0 {
+		return nil
+	}
+
+	rows := make([]models.UserFileStatus, 0, len(statuses))
+	for category, downloaded := range statuses {
+		rows = append(rows, models.UserFileStatus{
+			UserID:     userID,
+			Category:   category,
+			Downloaded: downloaded,
+		})
 	}
 
 	return r.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "user_id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"document", "address", "updated_at"}),
-	}).Create(&userFile).Error
+		Columns: statusConflict,
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"downloaded":  gorm.Expr("excluded.downloaded"),
+			"last_error":  gorm.Expr("CASE WHEN excluded.downloaded THEN '' ELSE user_file_statuses.last_error END"),
+			"error_class": gorm.Expr("CASE WHEN excluded.downloaded THEN '' ELSE user_file_statuses.error_class END"),
+			"permanent":   gorm.Expr("CASE WHEN excluded.downloaded THEN false ELSE user_file_statuses.permanent END"),
+			"updated_at":  gorm.Expr("NOW()"),
+		}),
+	}).Create(&rows).Error
 }
 
-// GetByUserID получает информацию о файлах пользователя
-func (r *UserFileRepository) GetByUserID(userID int64) (*models.UserFile, error) {
-	var userFile models.UserFile
-	err := r.db.Where("user_id = ?", userID).First(&userFile).Error
+// RecordSuccess отмечает категорию пользователя скачанной, сбрасывает ошибку и увеличивает счётчик попыток
+func (r *UserFileRepository) RecordSuccess(userID int64, category string) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns: statusConflict,
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"downloaded":  true,
+			"last_error":  "",
+			"error_class": "",
+			"permanent":   false,
+			"attempts":    gorm.Expr("user_file_statuses.attempts + 1"),
+			"updated_at":  gorm.Expr("NOW()"),
+		}),
+	}).Create(&models.UserFileStatus{
+		UserID:     userID,
+		Category:   category,
+		Downloaded: true,
+		Attempts:   1,
+	}).Error
+}
+
+// RecordFailure записывает причину неудачной попытки скачать категорию, не затирая прошлый успех
+func (r *UserFileRepository) RecordFailure(userID int64, category, errorClass, lastError string, permanent bool) error {
+	now := time.Now()
+	return r.db.Clauses(clause.OnConflict{
+		Columns: statusConflict,
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"last_error":  lastError,
+			"error_class": errorClass,
+			"permanent":   permanent,
+			"failed_at":   now,
+			"attempts":    gorm.Expr("user_file_statuses.attempts + 1"),
+			"updated_at":  gorm.Expr("NOW()"),
+		}),
+	}).Create(&models.UserFileStatus{
+		UserID:     userID,
+		Category:   category,
+		Attempts:   1,
+		LastError:  lastError,
+		ErrorClass: errorClass,
+		Permanent:  permanent,
+		FailedAt:   &now,
+	}).Error
+}
+
+// FailureFilter отбор нескачанных категорий с записанной ошибкой
+type FailureFilter struct {
+	Classes          []string // классы ошибок (пусто - любые)
+	Category         string   // категория (пусто - любая)
+	IncludePermanent bool     // учитывать постоянные ошибки
+}
+
+func (r *UserFileRepository) failures(filter FailureFilter) *gorm.DB {
+	query := r.db.Model(&models.UserFileStatus{}).Where("downloaded = ? AND error_class != ''", false)
+	if len(filter.Classes) > 0 {
+		query = query.Where("error_class IN ?", filter.Classes)
+	}
+	if filter.Category != "" {
+		query = query.Where("category = ?", filter.Category)
+	}
+	if !filter.IncludePermanent {
+		query = query.Where("permanent = ?", false)
+	}
+	return query
+}
+
+// GetFailedUserIDs возвращает id пользователей с нескачанными категориями по фильтру ошибок
+func (r *UserFileRepository) GetFailedUserIDs(filter FailureFilter) ([]int64, error) {
+	ids := make([]int64, 0)
+	err := r.failures(filter).Distinct().Order("user_id").Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// GetFailure возвращает запись о последней ошибке категории пользователя (nil, если ошибки нет)
+func (r *UserFileRepository) GetFailure(userID int64, category string) (*models.UserFileStatus, error) {
+	var rows []models.UserFileStatus
+	err := r.failures(FailureFilter{Category: category, IncludePermanent: true}).
+		Where("user_id = ?", userID).Limit(1).Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return &rows[0], nil
+}
+
+// GetFailuresPaginated возвращает страницу ошибок (новые сверху) и общее количество
+func (r *UserFileRepository) GetFailuresPaginated(filter FailureFilter, page, perPage int) ([]models.UserFileStatus, int64, error) {
+	var total int64
+	if err := r.failures(filter).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	rows := make([]models.UserFileStatus, 0)
+	err := r.failures(filter).
+		Order("failed_at DESC NULLS LAST, user_id").
+		Limit(perPage).Offset((page - 1) * perPage).
+		Find(&rows).Error
+	return rows, total, err
+}
+
+// CountFailuresByClass считает нескачанные категории с ошибкой по классам
+func (r *UserFileRepository) CountFailuresByClass(filter FailureFilter) (map[string]int64, error) {
+	var rows []struct {
+		ErrorClass string
+		Count      int64
+	}
+	filter.Classes = nil
+	err := r.failures(filter).Select("error_class, COUNT(*) AS count").Group("error_class").Scan(&rows).Error
 	if err != nil {
 		return nil, err
 	}
-	return &userFile, nil
+
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.ErrorClass] = row.Count
+	}
+	return counts, nil
 }
 
-// GetAll получает все записи
-func (r *UserFileRepository) GetAll() ([]models.UserFile, error) {
-	var userFiles []models.UserFile
-	err := r.db.Find(&userFiles).Error
-	return userFiles, err
+// GetByUserID получает статусы категорий пользователя (пустой map, если записей нет)
+func (r *UserFileRepository) GetByUserID(userID int64) (map[string]bool, error) {
+	var rows []models.UserFileStatus
+	if err := r.db.Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		statuses[row.Category] = row.Downloaded
+	}
+	return statuses, nil
 }
 
-// GetStats получает статистику
-func (r *UserFileRepository) GetStats() (total, withDocument, withAddress, withBoth int64, err error) {
-	r.db.Model(&models.UserFile{}).Count(&total)
-	r.db.Model(&models.UserFile{}).Where("document = ?", true).Count(&withDocument)
-	r.db.Model(&models.UserFile{}).Where("address = ?", true).Count(&withAddress)
-	r.db.Model(&models.UserFile{}).Where("document = ? AND address = ?", true, true).Count(&withBoth)
-	return
+// GetByUserIDs получает статусы категорий нескольких пользователей
+func (r *UserFileRepository) GetByUserIDs(userIDs []int64) (map[int64]map[string]bool, error) {
+	var rows []models.UserFileStatus
+	if err := r.db.Where("user_id IN ?", userIDs).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return groupStatuses(rows), nil
 }
 
-// GetAllAsMap получает все записи в виде map[user_id]*UserFile
-func (r *UserFileRepository) GetAllAsMap() (map[int64]*models.UserFile, error) {
-	var userFiles []models.UserFile
-	err := r.db.Find(&userFiles).Error
+// GetFailuresByUserIDs получает ошибки нескачанных категорий пользователей: map[user_id]map[category]статус
+func (r *UserFileRepository) GetFailuresByUserIDs(userIDs []int64) (map[int64]map[string]models.UserFileStatus, error) {
+	var rows []models.UserFileStatus
+	err := r.db.Where("user_id IN ? AND downloaded = ? AND error_class <> ''", userIDs, false).Find(&rows).Error
 	if err != nil {
 		return nil, err
 	}
 
-	result := make(map[int64]*models.UserFile, len(userFiles))
-	for i := range userFiles {
-		result[userFiles[i].UserID] = &userFiles[i]
+	result := make(map[int64]map[string]models.UserFileStatus)
+	for _, row := range rows {
+		if result[row.UserID] == nil {
+			result[row.UserID] = make(map[string]models.UserFileStatus)
+		}
+		result[row.UserID][row.Category] = row
 	}
 	return result, nil
 }
 
-// GetPaginated получает записи с пагинацией
-func (r *UserFileRepository) GetPaginated(page, perPage int) ([]models.UserFile, int64, error) {
-	var userFiles []models.UserFile
-	var total int64
+// GetUserIDsAfter возвращает id пользователей, у которых есть статусы, по keyset-курсору: user_id > afterID по возрастанию
+func (r *UserFileRepository) GetUserIDsAfter(afterID int64, limit int) ([]int64, error) {
+	var ids []int64
+	err := r.db.Model(&models.UserFileStatus{}).
+		Distinct("user_id").
+		Where("user_id > ?", afterID).
+		Order("user_id").
+		Limit(limit).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// GetAllAsMap получает все статусы в виде map[user_id]map[category]downloaded
+func (r *UserFileRepository) GetAllAsMap() (map[int64]map[string]bool, error) {
+	var rows []models.UserFileStatus
+	if err := r.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return groupStatuses(rows), nil
+}
+
+func groupStatuses(rows []models.UserFileStatus) map[int64]map[string]bool {
+	result := make(map[int64]map[string]bool)
+	for _, row := range rows {
+		if result[row.UserID] == nil {
+			result[row.UserID] = make(map[string]bool)
+		}
+		result[row.UserID][row.Category] = row.Downloaded
+	}
+	return result
+}
 
-	// Подсчитываем общее количество
-	r.db.Model(&models.UserFile{}).Count(&total)
+// MigrateLegacy переносит статусы из прежней таблицы user_files (колонки document и address)
+// в user_file_statuses. Выполняется, только пока user_file_statuses пуста; user_files не удаляется.
+func (r *UserFileRepository) MigrateLegacy() (int64, error) {
+	if !r.db.Migrator().HasTable("user_files") {
+		return 0, nil
+	}
 
-	// Получаем записи с пагинацией
-	offset := (page - 1) * perPage
-	err := r.db.Order("id desc").Offset(offset).Limit(perPage).Find(&userFiles).Error
+	var existing int64
+	if err := r.db.Model(&models.UserFileStatus{}).Count(&existing).Error; err != nil {
+		return 0, err
+	}
+	if existing > 0 {
+		return 0, nil
+	}
 
-	return userFiles, total, err
+	var migrated int64
+	for _, column := range []string{"document", "address"} {
+		result := r.db.Exec(fmt.Sprintf(`
+			INSERT INTO user_file_statuses (user_id, category, downloaded, created_at, updated_at)
+			SELECT user_id, '%s', %s, created_at, updated_at FROM user_files
+			ON CONFLICT (user_id, category) DO NOTHING
+		`, column, column))
+		if result.Error != nil {
+			return migrated, fmt.Errorf("ошибка переноса user_files.%s: %w", column, result.Error)
+		}
+		migrated += result.RowsAffected
+	}
+	return migrated, nil
 }
@@ -0,0 +1,310 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"up-down/config"
+	"up-down/database"
+	"up-down/models"
+
+	"github.com/lib/pq"
+)
+
+// identifierRe допустимое имя таблицы или колонки (без кавычек)
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// UserRepository чтение пользователей из основной БД (источник данных).
+// Таблица и колонки задаются настройками SOURCE_*, запросы строятся по ним.
+type UserRepository struct {
+	db     *database.DB
+	source *config.SourceConfig
+
+	table     string   // имя таблицы в кавычках
+	id        string   // колонка id в кавычках
+	columns   string   // список колонок для SELECT (порядок как в Scan)
+	hasFiles  string   // условие "есть хотя бы одна ссылка на файлы"
+	fileExprs []string // условия наличия ссылок по каждой колонке файлов
+}
+
+func NewUserRepository(db *database.DB, source *config.SourceConfig) (*UserRepository, error) {
+	table, err := quoteTable(source.Table)
+	if err != nil {
+		return nil, fmt.Errorf("неверное имя SOURCE_TABLE: %w", err)
+	}
+
+	quote := func(name, column string) (string, error) {
+		if !identifierRe.MatchString(column) {
+			return "", fmt.Errorf("неверное имя колонки %s: %q", name, column)
+		}
+		return pq.QuoteIdentifier(column), nil
+	}
+
+	id, err := quote("SOURCE_ID_COLUMN", source.IDColumn)
+	if err != nil {
+		return nil, err
+	}
+	group, err := quote("SOURCE_GROUP_COLUMN", source.GroupColumn)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []string{id, group}
+	if source.CreatedColumn != "" {
+		created, err := quote("SOURCE_CREATED_COLUMN", source.CreatedColumn)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, created)
+	}
+
+	// Условие наличия файлов: (col IS NOT NULL AND col != '') OR ...
+	fileExprs := make([]string, 0, len(source.Categories))
+	for _, category := range source.Categories {
+		column, err := quote("SOURCE_FILE_COLUMNS", category.Column)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+		fileExprs = append(fileExprs, fmt.Sprintf("(%s IS NOT NULL AND %s != '')", column, column))
+	}
+	for _, mapping := range source.MetaColumns {
+		column, err := quote("SOURCE_META_COLUMNS", mapping.Column)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return &UserRepository{
+		db:        db,
+		source:    source,
+		table:     table,
+		id:        id,
+		columns:   strings.Join(columns, ", "),
+		hasFiles:  "(" + strings.Join(fileExprs, " OR ") + ")",
+		fileExprs: fileExprs,
+	}, nil
+}
+
+// quoteTable проверяет и экранирует имя таблицы (возможно со схемой)
+func quoteTable(table string) (string, error) {
+	parts := strings.Split(table, ".")
+	if len(parts) > 2 {
+		return "", fmt.Errorf("%q", table)
+	}
+	for i, part := range parts {
+		if !identifierRe.MatchString(part) {
+			return "", fmt.Errorf("%q", table)
+		}
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// rowScanner общий интерфейс *sql.Row и *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scan читает строку, выбранную с r.columns
+func (r *UserRepository) scan(row rowScanner) (*models.User, error) {
+	user := models.User{
+		Files: make(map[string]string, len(r.source.Categories)),
+		Meta:  make(map[string]string, len(r.source.MetaColumns)),
+	}
+
+	files := make([]sql.NullString, len(r.source.Categories))
+	meta := make([]sql.NullString, len(r.source.MetaColumns))
+
+	dest := []interface{}{&user.ID, &user.Group}
+	if r.source.CreatedColumn != "" {
+		dest = append(dest, &user.CreatedAt)
+	}
+	for i := range files {
+		dest = append(dest, &files[i])
+	}
+	for i := range meta {
+		dest = append(dest, &meta[i])
+	}
+
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	for i, category := range r.source.Categories {
+		user.Files[category.Name] = files[i].String
+	}
+	for i, mapping := range r.source.MetaColumns {
+		user.Meta[mapping.Name] = meta[i].String
+	}
+	return &user, nil
+}
+
+// queryUsers выполняет запрос и читает всех пользователей из результата
+func (r *UserRepository) queryUsers(ctx context.Context, query string, args ...interface{}) ([]*models.User, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка запроса пользователей: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]*models.User, 0)
+	for rows.Next() {
+		user, err := r.scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения пользователя: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения пользователей: %w", err)
+	}
+	return users, nil
+}
+
+// GetByID получает пользователя по id
+func (r *UserRepository) GetByID(ctx context.Context, id int64) (*models.User, error) {
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s = $1`, r.columns, r.table, r.id)
+	return r.scan(r.db.QueryRowContext(ctx, query, id))
+}
+
+// GetByIDs получает пользователей по списку id (отсутствующие в таблице пропускаются)
+func (r *UserRepository) GetByIDs(ctx context.Context, ids []int64) (map[int64]*models.User, error) {
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s = ANY($1)`, r.columns, r.table, r.id)
+	list, err := r.queryUsers(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[int64]*models.User, len(list))
+	for _, user := range list {
+		users[user.ID] = user
+	}
+	return users, nil
+}
+
+// UserFilter ограничивает выборку пользователей для запуска скачивания.
+// Пустой фильтр не ограничивает ничего.
+type UserFilter struct {
+	Groups       []string   // значения колонки группы (citizenship_id)
+	IDFrom       int64      // id >= IDFrom (0 - без ограничения)
+	IDTo         int64      // id <= IDTo (0 - без ограничения)
+	IDs          []int64    // явный список id: nil - без ограничения, пустой - ни одного пользователя
+	CreatedAfter *time.Time // колонка created > CreatedAfter (нужен SOURCE_CREATED_COLUMN)
+}
+
+// where строит условие выборки пользователей с файлами по фильтру.
+// Параметры нумеруются с $1, возвращается номер следующего параметра.
+func (r *UserRepository) where(filter UserFilter) (string, []interface{}, int, error) {
+	conditions := []string{r.hasFiles}
+	args := make([]interface{}, 0)
+	next := func(arg interface{}) string {
+		args = append(args, arg)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(filter.Groups) > 0 {
+		// Группа сравнивается как текст: колонка может быть числовой
+		group := pq.QuoteIdentifier(r.source.GroupColumn)
+		conditions = append(conditions, fmt.Sprintf("%s::text = ANY(%s)", group, next(pq.Array(filter.Groups))))
+	}
+	if filter.IDFrom > 0 {
+		conditions = append(conditions, fmt.Sprintf("%s >= %s", r.id, next(filter.IDFrom)))
+	}
+	if filter.IDTo > 0 {
+		conditions = append(conditions, fmt.Sprintf("%s <= %s", r.id, next(filter.IDTo)))
+	}
+	if filter.IDs != nil {
+		conditions = append(conditions, fmt.Sprintf("%s = ANY(%s)", r.id, next(pq.Array(filter.IDs))))
+	}
+	if filter.CreatedAfter != nil {
+		if r.source.CreatedColumn == "" {
+			return "", nil, 0, fmt.Errorf("фильтр по дате создания требует SOURCE_CREATED_COLUMN")
+		}
+		created := pq.QuoteIdentifier(r.source.CreatedColumn)
+		conditions = append(conditions, fmt.Sprintf("%s > %s", created, next(*filter.CreatedAfter)))
+	}
+
+	return strings.Join(conditions, " AND "), args, len(args) + 1, nil
+}
+
+// CountWithFiles считает пользователей по фильтру, у которых есть хотя бы одна ссылка на файлы
+func (r *UserRepository) CountWithFiles(ctx context.Context, filter UserFilter) (int64, error) {
+	where, args, _, err := r.where(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, r.table, where)
+	err = r.db.QueryRowContext(ctx, query, args...).Scan(&total)
+	return total, err
+}
+
+// ListWithFilesAfter возвращает пользователей с файлами по фильтру и keyset-курсору:
+// id > afterID по возрастанию или id < afterID по убыванию
+func (r *UserRepository) ListWithFilesAfter(ctx context.Context, filter UserFilter, afterID int64, desc bool, limit int) ([]*models.User, error) {
+	where, args, n, err := r.where(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	cmp, order := ">", "ASC"
+	if desc {
+		cmp, order = "<", "DESC"
+	}
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s AND %s %s $%d ORDER BY %s %s LIMIT $%d`,
+		r.columns, r.table, where, r.id, cmp, n, r.id, order, n+1)
+	return r.queryUsers(ctx, query, append(args, afterID, limit)...)
+}
+
+// ListWithFilesPage возвращает страницу пользователей с файлами по OFFSET
+func (r *UserRepository) ListWithFilesPage(ctx context.Context, offset int, desc bool, limit int) ([]*models.User, error) {
+	order := "ASC"
+	if desc {
+		order = "DESC"
+	}
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE %s ORDER BY %s %s LIMIT $1 OFFSET $2`,
+		r.columns, r.table, r.hasFiles, r.id, order)
+	return r.queryUsers(ctx, query, limit, offset)
+}
+
+// EachWithFiles обходит пользователей с файлами по фильтру, передавая, в каких колонках файлов есть ссылки.
+// Строки читаются потоком, без загрузки всей таблицы в память.
+func (r *UserRepository) EachWithFiles(ctx context.Context, filter UserFilter, fn func(userID int64, present map[string]bool)) error {
+	where, args, _, err := r.where(filter)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`SELECT %s, %s FROM %s WHERE %s`, r.id, strings.Join(r.fileExprs, ", "), r.table, where)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("ошибка запроса пользователей: %w", err)
+	}
+	defer rows.Close()
+
+	flags := make([]bool, len(r.source.Categories))
+	dest := make([]interface{}, 0, len(flags)+1)
+	var userID int64
+	dest = append(dest, &userID)
+	for i := range flags {
+		dest = append(dest, &flags[i])
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("ошибка чтения пользователя: %w", err)
+		}
+		present := make(map[string]bool, len(flags))
+		for i, category := range r.source.Categories {
+			present[category.Name] = flags[i]
+		}
+		fn(userID, present)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"up-down/config"
+	"up-down/models"
+)
+
+// bandwidthChunk наибольшая порция данных, читаемая за один раз при ограничении скорости
+const bandwidthChunk = 32 * 1024
+
+// BandwidthLimiter общее ограничение пропускной способности всех скачиваний (token bucket по байтам).
+// Ограничение меняется на ходу по расписанию; на паузе чтение данных останавливается.
+type BandwidthLimiter struct {
+	mutex     sync.Mutex
+	limit     int64 // байт в секунду, 0 - без ограничения
+	paused    bool
+	tokens    float64
+	updatedAt time.Time
+	changed   chan struct{} // закрывается при смене ограничения, чтобы разбудить ожидающих
+}
+
+func NewBandwidthLimiter(limit int64) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		limit:     limit,
+		updatedAt: time.Now(),
+		changed:   make(chan struct{}),
+	}
+}
+
+// Set меняет ограничение (0 - без ограничения) и паузу
+func (b *BandwidthLimiter) Set(limit int64, paused bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.limit == limit && b.paused == paused {
+		return
+	}
+	b.limit = limit
+	b.paused = paused
+	b.tokens = 0
+	b.updatedAt = time.Now()
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Limit возвращает текущее ограничение и признак паузы
+func (b *BandwidthLimiter) Limit() (int64, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.limit, b.paused
+}
+
+// wait ждёт, пока ограничение разрешит передать n байт
+func (b *BandwidthLimiter) wait(ctx context.Context, n int) error {
+	for {
+		b.mutex.Lock()
+		if b.limit <= 0 && !b.paused {
+			b.mutex.Unlock()
+			return nil
+		}
+
+		changed := b.changed
+		var wait time.Duration
+		if !b.paused {
+			// Пачка - не больше одной секунды трафика
+			now := time.Now()
+			b.tokens += now.Sub(b.updatedAt).Seconds() * float64(b.limit)
+			if b.tokens > float64(b.limit) {
+				b.tokens = float64(b.limit)
+			}
+			b.updatedAt = now
+
+			// Порция больше секундного лимита проходит в долг, иначе она никогда не пройдёт
+			if b.tokens >= float64(n) || b.tokens >= float64(b.limit) {
+				b.tokens -= float64(n)
+				b.mutex.Unlock()
+				return nil
+			}
+			wait = time.Duration((float64(n) - b.tokens) / float64(b.limit) * float64(time.Second))
+		}
+		b.mutex.Unlock()
+
+		// На паузе ждём только смены ограничения
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			err := ctx.Err()
+			if timer != nil {
+				timer.Stop()
+			}
+			return err
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Reader оборачивает тело ответа: чтение идёт порциями с учётом общего ограничения скорости
+func (b *BandwidthLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: b}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *BandwidthLimiter
+}
+
+// Read учитывает фактически прочитанные байты: сеть обычно отдаёт меньше, чем размер буфера,
+// и предоплата всего буфера занижала бы скорость
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if waitErr := lr.limiter.wait(lr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// BandwidthState текущее ограничение скорости по расписанию (для /api/download/progress)
+type BandwidthState struct {
+	Limit  int64  `json:"limit"`  // байт в секунду, 0 - без ограничения
+	Label  string `json:"label"`  // 2.0MB, unlimited
+	Window string `json:"window"` // окно расписания или пусто (DOWNLOAD_BANDWIDTH)
+	Paused bool   `json:"paused"` // пауза по расписанию
+}
+
+// currentWindow находит окно расписания для момента now (nil - действует DOWNLOAD_BANDWIDTH)
+func currentWindow(cfg *config.DownloadConfig, now time.Time) *config.BandwidthWindow {
+	location := cfg.ScheduleLocation
+	if location == nil {
+		location = time.Local
+	}
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+
+	for i := range cfg.Schedule {
+		if cfg.Schedule[i].Contains(minute) {
+			return &cfg.Schedule[i]
+		}
+	}
+	return nil
+}
+
+// bandwidthState состояние ограничения для момента now
+func bandwidthState(cfg *config.DownloadConfig, now time.Time) BandwidthState {
+	window := currentWindow(cfg, now)
+	if window == nil {
+		return BandwidthState{Limit: cfg.Bandwidth, Label: config.FormatBandwidth(cfg.Bandwidth)}
+	}
+
+	state := BandwidthState{Limit: window.Limit, Label: config.FormatBandwidth(window.Limit), Window: window.String(), Paused: window.Pause}
+	if window.Pause {
+		state.Limit = 0
+		state.Label = "pause"
+	}
+	return state
+}
+
+// scheduleInterval период проверки расписания пропускной способности
+const scheduleInterval = 30 * time.Second
+
+// scheduleLoop применяет расписание пропускной способности, пока задание выполняется
+func (dm *DownloadManager) scheduleLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	dm.applySchedule(time.Now())
+	for {
+		select {
+		case <-stop:
+			// Пауза по расписанию относится только к заданию
+			dm.mutex.RLock()
+			limit := dm.bandwidth.Limit
+			dm.mutex.RUnlock()
+			dm.downloader.Bandwidth.Set(limit, false)
+			return
+		case now := <-ticker.C:
+			dm.applySchedule(now)
+		}
+	}
+}
+
+// applySchedule выставляет ограничение скорости текущего окна расписания. В окне pause задание
+// приостанавливается (новые пользователи не берутся, передача данных останавливается), а после
+// окна продолжается. Паузу, поставленную вручную, расписание не снимает.
+func (dm *DownloadManager) applySchedule(now time.Time) {
+	state := bandwidthState(&dm.cfg.Download, now)
+
+	dm.mutex.Lock()
+	previous := dm.bandwidth
+	dm.bandwidth = state
+	if state.Window != dm.scheduleOverride {
+		dm.scheduleOverride = ""
+	}
+
+	pause := state.Paused && dm.status == StatusRunning && dm.scheduleOverride == ""
+	resume := !state.Paused && dm.status == StatusPaused && dm.schedulePaused
+	switch {
+	case pause:
+		dm.pauseLocked()
+		dm.schedulePaused = true
+	case resume:
+		dm.finishPauseLocked()
+		dm.status = StatusRunning
+		dm.schedulePaused = false
+	}
+	paused := dm.schedulePaused
+	dm.mutex.Unlock()
+
+	dm.downloader.Bandwidth.Set(state.Limit, paused)
+
+	if previous != state {
+		if state.Window != "" {
+			log.Printf("🕒 Окно расписания %s: ограничение %s", state.Window, state.Label)
+		} else {
+			log.Printf("🕒 Вне окон расписания: ограничение %s", state.Label)
+		}
+	}
+	switch {
+	case pause:
+		dm.saveCheckpoint(models.JobStatusPaused, "")
+		log.Printf("🌙 Скачивание приостановлено по расписанию (%s)", state.Window)
+	case resume:
+		dm.saveCheckpoint(models.JobStatusRunning, "")
+		log.Printf("☀️  Скачивание продолжено по расписанию")
+	}
+}
+
+// Bandwidth возвращает текущее ограничение пропускной способности и признак паузы по расписанию
+func (dm *DownloadManager) Bandwidth() (BandwidthState, bool) {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+	return dm.bandwidth, dm.schedulePaused
+}
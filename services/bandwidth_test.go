@@ -0,0 +1,115 @@
+package services
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+	"up-down/config"
+)
+
+// trickleReader отдаёт данные маленькими порциями, как сетевое соединение
+type trickleReader struct {
+	remaining int
+	chunk     int
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	n := min(len(p), r.chunk, r.remaining)
+	r.remaining -= n
+	return n, nil
+}
+
+func TestBandwidthLimiterThroughput(t *testing.T) {
+	const limit = 256 * 1024
+	const total = limit / 2
+
+	tests := []struct {
+		name  string
+		chunk int
+	}{
+		{"порции меньше буфера", 1500},
+		{"порции по буферу", bandwidthChunk},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewBandwidthLimiter(limit)
+			reader := limiter.Reader(context.Background(), &trickleReader{remaining: total, chunk: tt.chunk})
+
+			started := time.Now()
+			n, err := io.CopyBuffer(io.Discard, reader, make([]byte, bandwidthChunk))
+			elapsed := time.Since(started)
+			if err != nil || n != total {
+				t.Fatalf("прочитано %d байт, ошибка %v", n, err)
+			}
+
+			// Ожидается total/limit = 0.5 с; скорость не должна быть ни выше, ни заметно ниже ограничения
+			rate := float64(total) / elapsed.Seconds()
+			if rate > limit*1.1 || rate < limit*0.7 {
+				t.Errorf("скорость %.0f байт/с за %v, ограничение %d байт/с", rate, elapsed, limit)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimiterPause(t *testing.T) {
+	limiter := NewBandwidthLimiter(0)
+	limiter.Set(0, true)
+	reader := limiter.Reader(context.Background(), &trickleReader{remaining: 1024, chunk: 1024})
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("чтение не остановилось на паузе")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	limiter.Set(0, false)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("чтение не продолжилось после снятия паузы")
+	}
+}
+
+func TestBandwidthState(t *testing.T) {
+	cfg := &config.DownloadConfig{
+		Bandwidth: 1 << 20,
+		Schedule: []config.BandwidthWindow{
+			{Start: 23 * 60, End: 7 * 60, Limit: 0},
+			{Start: 12 * 60, End: 13 * 60, Pause: true},
+		},
+		ScheduleLocation: time.FixedZone("MSK", 3*60*60),
+	}
+
+	tests := []struct {
+		utc  string
+		want BandwidthState
+	}{
+		// 23:30 по Москве - окно через полночь
+		{"2024-05-01T20:30:00Z", BandwidthState{Limit: 0, Label: "unlimited", Window: "23:00-07:00=unlimited"}},
+		// 03:59 по Москве следующего дня - то же окно
+		{"2024-05-02T00:59:00Z", BandwidthState{Limit: 0, Label: "unlimited", Window: "23:00-07:00=unlimited"}},
+		{"2024-05-02T04:00:00Z", BandwidthState{Limit: 1 << 20, Label: "1.0MB"}},
+		{"2024-05-02T09:15:00Z", BandwidthState{Limit: 0, Label: "pause", Window: "12:00-13:00=pause", Paused: true}},
+	}
+
+	for _, tt := range tests {
+		now, err := time.Parse(time.RFC3339, tt.utc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bandwidthState(cfg, now); got != tt.want {
+			t.Errorf("bandwidthState(%s) = %+v, ожидалось %+v", tt.utc, got, tt.want)
+		}
+	}
+}
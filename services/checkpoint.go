@@ -0,0 +1,56 @@
+package services
+
+import "sync"
+
+// checkpointTracker вычисляет безопасную контрольную точку при параллельной обработке.
+// Пользователи читаются по возрастанию id, но воркеры завершают их в произвольном порядке,
+// поэтому контрольная точка - это id, до которого (включительно) обработаны все пользователи.
+type checkpointTracker struct {
+	mutex       sync.Mutex
+	inFlight    map[int64]struct{}
+	lastFetched int64
+}
+
+func newCheckpointTracker(startAfterID int64) *checkpointTracker {
+	return &checkpointTracker{
+		inFlight:    make(map[int64]struct{}),
+		lastFetched: startAfterID,
+	}
+}
+
+// fetched отмечает пользователя, переданного воркерам
+func (t *checkpointTracker) fetched(userID int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.inFlight[userID] = struct{}{}
+	if userID > t.lastFetched {
+		t.lastFetched = userID
+	}
+}
+
+// done отмечает пользователя, обработка которого завершена
+func (t *checkpointTracker) done(userID int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.inFlight, userID)
+}
+
+// watermark возвращает id, до которого все пользователи обработаны
+func (t *checkpointTracker) watermark() int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.inFlight) == 0 {
+		return t.lastFetched
+	}
+
+	var minID int64
+	first := true
+	for id := range t.inFlight {
+		if first || id < minID {
+			minID = id
+			first = false
+		}
+	}
+	return minID - 1
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckpointTrackerWatermark(t *testing.T) {
+	// Пользователи читаются по возрастанию id с пропусками, воркеры завершают их в другом порядке
+	type step struct {
+		fetched []int64
+		done    []int64
+		want    int64
+	}
+	steps := []step{
+		{want: 10},
+		{fetched: []int64{12, 15, 20}, want: 11},
+		{done: []int64{15}, want: 11},
+		{done: []int64{20}, want: 11},
+		{done: []int64{12}, want: 20},
+		{fetched: []int64{21, 30}, done: []int64{30}, want: 20},
+		{fetched: []int64{31}, want: 20},
+		{done: []int64{21}, want: 30},
+		{done: []int64{31}, want: 31},
+	}
+
+	tracker := newCheckpointTracker(10)
+	for i, s := range steps {
+		for _, id := range s.fetched {
+			tracker.fetched(id)
+		}
+		for _, id := range s.done {
+			tracker.done(id)
+		}
+		if got := tracker.watermark(); got != s.want {
+			t.Errorf("шаг %d: watermark = %d, ожидалось %d", i, got, s.want)
+		}
+	}
+}
+
+func TestCheckpointTrackerConcurrent(t *testing.T) {
+	const users = 500
+	const workers = 8
+
+	tracker := newCheckpointTracker(0)
+	var mutex sync.Mutex
+	processed := make(map[int64]bool)
+
+	// Контрольная точка не должна обгонять необработанного пользователя
+	check := func() {
+		watermark := tracker.watermark()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for id := int64(1); id <= watermark; id++ {
+			if id%3 != 0 && !processed[id] {
+				t.Errorf("watermark %d, но пользователь %d ещё не обработан", watermark, id)
+				return
+			}
+		}
+	}
+
+	queue := make(chan int64, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			for id := range queue {
+				time.Sleep(time.Duration(random.Intn(200)) * time.Microsecond)
+
+				mutex.Lock()
+				processed[id] = true
+				mutex.Unlock()
+				tracker.done(id)
+				check()
+			}
+		}(int64(w))
+	}
+
+	// id, кратные 3, отсутствуют в таблице
+	var lastID int64
+	for id := int64(1); id <= users; id++ {
+		if id%3 == 0 {
+			continue
+		}
+		tracker.fetched(id)
+		queue <- id
+		lastID = id
+	}
+	close(queue)
+	wg.Wait()
+
+	if got := tracker.watermark(); got != lastID {
+		t.Errorf("после обработки всех пользователей watermark = %d, ожидалось %d", got, lastID)
+	}
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"up-down/storage"
+)
+
+// ObjectsPrefix служебная директория хранилища с содержимым файлов по sha256: .objects/ab/cdef...
+const ObjectsPrefix = ".objects"
+
+// objectKey ключ содержимого файла с sha256 sum
+func objectKey(sum string) string {
+	return path.Join(ObjectsPrefix, sum[:2], sum[2:])
+}
+
+// DedupStore хранит содержимое файлов один раз (content-addressed) и ссылается на него
+// из директорий пользователей жёсткими ссылками
+type DedupStore struct {
+	store storage.Storage
+
+	// Проверка и запись объекта выполняются под одной блокировкой, чтобы одинаковые файлы,
+	// скачанные параллельно, не записались дважды. Операции - переименования и ссылки на диске.
+	mutex sync.Mutex
+}
+
+func NewDedupStore(store storage.Storage) *DedupStore {
+	return &DedupStore{store: store}
+}
+
+// PutFile переносит скачанный файл в хранилище. Если файл с таким же sha256 и размером уже есть,
+// временный файл удаляется, а obj.Key становится ссылкой на существующее содержимое (deduplicated = true).
+func (s *DedupStore) PutFile(ctx context.Context, obj storage.Object, localPath string) (deduplicated bool, err error) {
+	if len(obj.SHA256) < 3 {
+		return false, fmt.Errorf("нет sha256 для файла %s", obj.Key)
+	}
+	key := objectKey(obj.SHA256)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing, err := s.store.Stat(ctx, key)
+	switch {
+	case err == nil && existing.Size == obj.Size:
+		os.Remove(localPath)
+		deduplicated = true
+	case err == nil || errors.Is(err, storage.ErrNotExist):
+		// Объекта нет (или он повреждён и не совпадает по размеру) - записываем содержимое заново
+		object := obj
+		object.Key = key
+		if err := storage.PutFile(ctx, s.store, object, localPath); err != nil {
+			return false, err
+		}
+	default:
+		return false, err
+	}
+
+	if err := storage.Link(ctx, s.store, key, obj.Key); err != nil {
+		return false, err
+	}
+	return deduplicated, nil
+}
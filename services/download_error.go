@@ -0,0 +1,227 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Классы ошибок скачивания
+const (
+	ErrorClassHTTP404     = "http_404"
+	ErrorClassHTTP410     = "http_410"
+	ErrorClassHTTP429     = "http_429"
+	ErrorClassHTTP4xx     = "http_4xx"
+	ErrorClassHTTP5xx     = "http_5xx"
+	ErrorClassTimeout     = "timeout"
+	ErrorClassConnection  = "connection"
+	ErrorClassBadURL      = "bad_url"
+	ErrorClassMissing     = "missing"      // файл удалён или отсутствует в группе (по данным источника)
+	ErrorClassTooLarge    = "too_large"    // файл больше DOWNLOAD_MAX_FILE_SIZE
+	ErrorClassUserQuota   = "user_quota"   // превышен DOWNLOAD_MAX_USER_SIZE
+	ErrorClassContentType = "content_type" // тип файла не из DOWNLOAD_ALLOWED_CONTENT_TYPES
+	ErrorClassIO          = "io"
+	ErrorClassCanceled    = "canceled"
+	ErrorClassUnknown     = "unknown"
+)
+
+// ErrorClasses все классы ошибок скачивания (для проверки фильтров)
+var ErrorClasses = []string{
+	ErrorClassHTTP404, ErrorClassHTTP410, ErrorClassHTTP429, ErrorClassHTTP4xx, ErrorClassHTTP5xx,
+	ErrorClassTimeout, ErrorClassConnection, ErrorClassBadURL, ErrorClassMissing,
+	ErrorClassTooLarge, ErrorClassUserQuota, ErrorClassContentType, ErrorClassIO, ErrorClassCanceled, ErrorClassUnknown,
+}
+
+// IsErrorClass проверяет, что имя - известный класс ошибки
+func IsErrorClass(name string) bool {
+	for _, class := range ErrorClasses {
+		if class == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadError ошибка скачивания с классификацией: временная (можно повторить) или постоянная
+type DownloadError struct {
+	URL        string
+	StatusCode int
+	Class      string
+	Permanent  bool
+	RetryAfter time.Duration // из заголовка Retry-After для 429/503
+	Err        error
+}
+
+func (e *DownloadError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("ошибка HTTP %d для %s", e.StatusCode, e.URL)
+	}
+	return fmt.Sprintf("ошибка запроса %s: %v", e.URL, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// FileFailure ошибка скачивания одного файла группы
+type FileFailure struct {
+	Index int // индекс в группе (group_index)
+	URL   string
+	Err   error
+}
+
+// GroupError ошибка скачивания части файлов группы: по каждому индексу отдельно.
+// Остальные файлы группы при этом скачаны.
+type GroupError struct {
+	Total    int
+	Failures []FileFailure
+}
+
+func (e *GroupError) Error() string {
+	parts := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		parts = append(parts, fmt.Sprintf("[%d] %v", failure.Index, failure.Err))
+	}
+	return fmt.Sprintf("не скачано %d из %d файлов: %s", len(e.Failures), e.Total, strings.Join(parts, "; "))
+}
+
+// Unwrap отдаёт ошибки файлов: ErrorClass берёт класс первой из них
+func (e *GroupError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		errs = append(errs, failure.Err)
+	}
+	return errs
+}
+
+// GroupFailures ошибки по индексам, если err - ошибка группы файлов
+func GroupFailures(err error) []FileFailure {
+	var ge *GroupError
+	if errors.As(err, &ge) {
+		return ge.Failures
+	}
+	return nil
+}
+
+// FailedFiles количество файлов, не скачанных из-за ошибки (1 для ошибки не по группе)
+func FailedFiles(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ge *GroupError
+	if errors.As(err, &ge) {
+		return len(ge.Failures)
+	}
+	return 1
+}
+
+// IsPermanent сообщает, что повторять скачивание бессмысленно (404, 410, неверный URL).
+// Ошибка группы постоянная, только если постоянны ошибки всех её файлов.
+func IsPermanent(err error) bool {
+	var ge *GroupError
+	if errors.As(err, &ge) {
+		for _, failure := range ge.Failures {
+			if !IsPermanent(failure.Err) {
+				return false
+			}
+		}
+		return len(ge.Failures) > 0
+	}
+
+	var de *DownloadError
+	return errors.As(err, &de) && de.Permanent
+}
+
+// ErrorClass возвращает класс ошибки скачивания
+func ErrorClass(err error) string {
+	var de *DownloadError
+	if errors.As(err, &de) {
+		return de.Class
+	}
+	return ErrorClassUnknown
+}
+
+// httpError классифицирует ответ сервера с неуспешным статусом
+func httpError(rawURL string, resp *http.Response) *DownloadError {
+	de := &DownloadError{URL: rawURL, StatusCode: resp.StatusCode}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		de.Class, de.Permanent = ErrorClassHTTP404, true
+	case resp.StatusCode == http.StatusGone:
+		de.Class, de.Permanent = ErrorClassHTTP410, true
+	case resp.StatusCode == http.StatusTooManyRequests:
+		de.Class = ErrorClassHTTP429
+		de.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	case resp.StatusCode == http.StatusRequestTimeout:
+		de.Class = ErrorClassTimeout
+	case resp.StatusCode >= 500:
+		de.Class = ErrorClassHTTP5xx
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			de.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+	default:
+		de.Class, de.Permanent = ErrorClassHTTP4xx, true
+	}
+
+	return de
+}
+
+// requestError классифицирует сетевую ошибку или ошибку чтения тела ответа
+func requestError(rawURL string, err error) *DownloadError {
+	de := &DownloadError{URL: rawURL, Err: err}
+
+	var netErr net.Error
+	var urlErr *url.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		de.Class = ErrorClassCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		de.Class = ErrorClassTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		de.Class = ErrorClassConnection
+	case errors.As(err, &urlErr) && isMalformedURL(urlErr):
+		de.Class, de.Permanent = ErrorClassBadURL, true
+	case errors.As(err, &netErr):
+		de.Class = ErrorClassConnection
+	default:
+		de.Class = ErrorClassUnknown
+	}
+
+	return de
+}
+
+// isMalformedURL отличает неверный URL от сетевой ошибки
+func isMalformedURL(urlErr *url.Error) bool {
+	var parseErr *url.Error
+	if errors.As(urlErr.Err, &parseErr) {
+		return true
+	}
+	u, err := url.Parse(urlErr.URL)
+	return err != nil || u.Host == "" && u.Scheme != "file"
+}
+
+// parseRetryAfter разбирает Retry-After в секундах или в формате HTTP-даты
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -2,18 +2,20 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
-	"os"
-	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 	"up-down/config"
-	"up-down/database"
 	"up-down/models"
 	"up-down/repositories"
+	"up-down/storage"
+
+	"gorm.io/gorm"
 )
 
 type DownloadStatus string
@@ -35,66 +37,330 @@ type Stats struct {
 	SuccessfulFiles int64
 	FailedFiles     int64
 	SkippedUsers    int64
+	DedupFiles      int64 // файлов, записанных ссылкой на уже скачанное содержимое
+	DedupBytes      int64 // сэкономлено места дедупликацией
+	LastUserID      int64 // Последний id, прочитанный из users (курсор keyset-пагинации)
+}
+
+// checkpointInterval период сохранения контрольной точки задания в БД
+const checkpointInterval = 10 * time.Second
+
+// jobConfig настройки запуска, сохраняемые в download_jobs.config
+type jobConfig struct {
+	Workers   int     `json:"workers"`
+	BatchSize int     `json:"batch_size"`
+	Dir       string  `json:"dir"`
+	Storage   string  `json:"storage"`
+	DirLayout string  `json:"dir_layout"`
+	FileName  string  `json:"file_name_template"`
+	Rate      float64 `json:"rate"`
+	Burst     int     `json:"burst"`
+	Spec      JobSpec `json:"spec"`
 }
 
 type DownloadManager struct {
 	cfg          *config.Config
-	db           *database.DB
+	userRepo     *repositories.UserRepository
 	userFileRepo *repositories.UserFileRepository
+	fileItemRepo *repositories.UserFileItemRepository
+	jobRepo      *repositories.DownloadJobRepository
+	store        storage.Storage
+	layout       *Layout
+	metadata     *MetadataWriter
 	downloader   *Downloader
 
+	// Текущее задание, его фильтры и контрольная точка (под mutex); jobMutex упорядочивает записи задания в БД
+	job        *models.DownloadJob
+	spec       JobSpec
+	checkpoint *checkpointTracker
+	jobMutex   sync.Mutex
+
 	status    DownloadStatus
 	stats     *Stats
 	ctx       context.Context
 	cancel    context.CancelFunc
 	wg        sync.WaitGroup
+	done      chan struct{}
 	mutex     sync.RWMutex
 	startTime time.Time
 	endTime   time.Time
+
+	// План задания (dry-run): последний отчёт и отмена строящегося плана
+	planMutex  sync.RWMutex
+	plan       *PlanReport
+	planCancel context.CancelFunc
+
+	// Пауза: пока resumeCh не nil, воркеры и чтение из БД ждут его закрытия
+	resumeCh    chan struct{}
+	pausedAt    time.Time
+	pausedTotal time.Duration
+
+	// Расписание пропускной способности: текущее окно, пауза по расписанию
+	// и окно, в котором паузу по расписанию отменили вручную (под mutex)
+	bandwidth        BandwidthState
+	schedulePaused   bool
+	scheduleOverride string
 }
 
-func NewDownloadManager(cfg *config.Config, db *database.DB, userFileRepo *repositories.UserFileRepository) *DownloadManager {
+func NewDownloadManager(cfg *config.Config, userRepo *repositories.UserRepository, userFileRepo *repositories.UserFileRepository, fileItemRepo *repositories.UserFileItemRepository, jobRepo *repositories.DownloadJobRepository, store storage.Storage, layout *Layout, metadata *MetadataWriter) *DownloadManager {
 	return &DownloadManager{
 		cfg:          cfg,
-		db:           db,
+		userRepo:     userRepo,
 		userFileRepo: userFileRepo,
-		downloader:   NewDownloader(cfg.Download.Dir),
+		fileItemRepo: fileItemRepo,
+		jobRepo:      jobRepo,
+		store:        store,
+		layout:       layout,
+		metadata:     metadata,
+		downloader:   NewDownloader(&cfg.Download, fileItemRepo, store, layout),
 		status:       StatusIdle,
 		stats:        &Stats{},
+		bandwidth:    bandwidthState(&cfg.Download, time.Now()),
 	}
 }
 
-// Start запускает процесс скачивания
-func (dm *DownloadManager) Start() error {
+// Start запускает новое задание скачивания по фильтрам spec
+func (dm *DownloadManager) Start(spec JobSpec) error {
+	if err := spec.Validate(dm.cfg.Source.CreatedColumn); err != nil {
+		return err
+	}
+
 	dm.mutex.Lock()
-	if dm.status == StatusRunning {
-		dm.mutex.Unlock()
+	defer dm.mutex.Unlock()
+
+	if dm.status == StatusRunning || dm.status == StatusPaused {
 		return fmt.Errorf("скачивание уже запущено")
 	}
 
+	job := &models.DownloadJob{
+		Status:    models.JobStatusRunning,
+		Config:    dm.jobConfigJSON(spec),
+		StartedAt: time.Now(),
+	}
+	if err := dm.jobRepo.Create(job); err != nil {
+		return fmt.Errorf("ошибка создания задания: %w", err)
+	}
+
+	dm.launchLocked(job, spec, &Stats{})
+	log.Printf("🆕 Задание #%d создано: %s", job.ID, spec.String())
+	return nil
+}
+
+// ResumeJob продолжает прерванное или остановленное задание с его контрольной точки
+func (dm *DownloadManager) ResumeJob(jobID uint) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if dm.status == StatusRunning || dm.status == StatusPaused {
+		return fmt.Errorf("скачивание уже запущено")
+	}
+
+	job, err := dm.jobRepo.GetByID(jobID)
+	if err != nil {
+		return fmt.Errorf("задание #%d не найдено: %w", jobID, err)
+	}
+	if !job.Resumable() {
+		return fmt.Errorf("задание #%d в статусе %s нельзя продолжить", job.ID, job.Status)
+	}
+
+	// Фильтры задания сохранены в его настройках
+	var saved jobConfig
+	if job.Config != "" {
+		if err := json.Unmarshal([]byte(job.Config), &saved); err != nil {
+			return fmt.Errorf("ошибка чтения настроек задания #%d: %w", job.ID, err)
+		}
+	}
+
+	// Восстанавливаем счётчики, чтобы прогресс продолжился, а не начался заново
+	stats := &Stats{
+		ProcessedUsers:  job.ProcessedUsers,
+		SuccessfulUsers: job.SuccessfulUsers,
+		FailedUsers:     job.FailedUsers,
+		SkippedUsers:    job.SkippedUsers,
+		TotalFiles:      job.TotalFiles,
+		SuccessfulFiles: job.SuccessfulFiles,
+		FailedFiles:     job.FailedFiles,
+		DedupFiles:      job.DedupFiles,
+		DedupBytes:      job.DedupBytes,
+	}
+
+	job.Status = models.JobStatusRunning
+	job.FinishedAt = nil
+	job.Error = ""
+	if err := dm.jobRepo.Save(job); err != nil {
+		return fmt.Errorf("ошибка обновления задания: %w", err)
+	}
+
+	dm.launchLocked(job, saved.Spec, stats)
+	log.Printf("🔁 Задание #%d продолжено с user_id > %d: %s", job.ID, job.LastUserID, saved.Spec.String())
+	return nil
+}
+
+// RecoverInterruptedJobs помечает задания, не завершившиеся до перезапуска процесса,
+// и возвращает последнее из них (или nil), чтобы предложить его продолжить.
+func (dm *DownloadManager) RecoverInterruptedJobs() (*models.DownloadJob, error) {
+	if _, err := dm.jobRepo.MarkInterrupted(); err != nil {
+		return nil, err
+	}
+
+	// Прерванных заданий нет - не ошибка; недоступность базы не должна выглядеть так же,
+	// иначе задание не будет предложено продолжить
+	job, err := dm.jobRepo.GetLastInterrupted()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// RecentJobs возвращает последние задания
+func (dm *DownloadManager) RecentJobs(limit int) ([]models.DownloadJob, error) {
+	return dm.jobRepo.GetRecent(limit)
+}
+
+// Downloader возвращает загрузчик менеджера (с общими ограничениями скорости)
+func (dm *DownloadManager) Downloader() *Downloader {
+	return dm.downloader
+}
+
+// HostRates возвращает текущую скорость запросов по хостам
+func (dm *DownloadManager) HostRates() []HostRate {
+	return dm.downloader.Limiter.Rates()
+}
+
+// CurrentJobID возвращает id текущего (или последнего) задания
+func (dm *DownloadManager) CurrentJobID() uint {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+
+	if dm.job == nil {
+		return 0
+	}
+	return dm.job.ID
+}
+
+// launchLocked запускает обработку задания. Вызывается под dm.mutex.
+func (dm *DownloadManager) launchLocked(job *models.DownloadJob, spec JobSpec, stats *Stats) {
+	stats.LastUserID = job.LastUserID
+
+	dm.job = job
+	dm.spec = spec
+	dm.checkpoint = newCheckpointTracker(job.LastUserID)
 	dm.status = StatusRunning
-	dm.stats = &Stats{} // Сбрасываем статистику
+	dm.stats = stats
 	dm.ctx, dm.cancel = context.WithCancel(context.Background())
+	dm.done = make(chan struct{})
 	dm.startTime = time.Now()
-	dm.mutex.Unlock()
+	dm.resumeCh = nil
+	dm.pausedTotal = 0
 
 	go dm.run()
-	return nil
+}
+
+// jobConfigJSON сериализует текущие настройки и фильтры запуска
+func (dm *DownloadManager) jobConfigJSON(spec JobSpec) string {
+	data, err := json.Marshal(jobConfig{
+		Workers:   dm.cfg.Download.Workers,
+		BatchSize: dm.cfg.Download.BatchSize,
+		Dir:       dm.cfg.Download.Dir,
+		Storage:   dm.store.Location(""),
+		DirLayout: dm.cfg.Download.DirLayout,
+		FileName:  dm.cfg.Download.FileNameTemplate,
+		Rate:      dm.cfg.Download.Rate,
+		Burst:     dm.cfg.Download.Burst,
+		Spec:      spec,
+	})
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// saveCheckpoint сохраняет статус, контрольную точку и счётчики задания в БД
+func (dm *DownloadManager) saveCheckpoint(status string, errMsg string) {
+	dm.mutex.RLock()
+	job := dm.job
+	stats := dm.stats
+	tracker := dm.checkpoint
+	dm.mutex.RUnlock()
+
+	if job == nil {
+		return
+	}
+
+	dm.jobMutex.Lock()
+	defer dm.jobMutex.Unlock()
+
+	job.Status = status
+	job.Error = errMsg
+	job.LastUserID = tracker.watermark()
+	job.TotalUsers = atomic.LoadInt64(&stats.TotalUsers)
+	job.ProcessedUsers = atomic.LoadInt64(&stats.ProcessedUsers)
+	job.SuccessfulUsers = atomic.LoadInt64(&stats.SuccessfulUsers)
+	job.FailedUsers = atomic.LoadInt64(&stats.FailedUsers)
+	job.SkippedUsers = atomic.LoadInt64(&stats.SkippedUsers)
+	job.TotalFiles = atomic.LoadInt64(&stats.TotalFiles)
+	job.SuccessfulFiles = atomic.LoadInt64(&stats.SuccessfulFiles)
+	job.FailedFiles = atomic.LoadInt64(&stats.FailedFiles)
+	job.DedupFiles = atomic.LoadInt64(&stats.DedupFiles)
+	job.DedupBytes = atomic.LoadInt64(&stats.DedupBytes)
+
+	switch status {
+	case models.JobStatusCompleted, models.JobStatusFailed, models.JobStatusStopped:
+		now := time.Now()
+		job.FinishedAt = &now
+	}
+
+	if err := dm.jobRepo.Save(job); err != nil {
+		log.Printf("Ошибка сохранения контрольной точки задания #%d: %v", job.ID, err)
+	}
+}
+
+// checkpointLoop периодически сохраняет контрольную точку, пока задание выполняется
+func (dm *DownloadManager) checkpointLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			dm.mutex.RLock()
+			status := dm.status
+			dm.mutex.RUnlock()
+
+			jobStatus := models.JobStatusRunning
+			if status == StatusPaused {
+				jobStatus = models.JobStatusPaused
+			}
+			dm.saveCheckpoint(jobStatus, "")
+		}
+	}
 }
 
 // Stop останавливает процесс скачивания
 func (dm *DownloadManager) Stop() {
 	dm.mutex.Lock()
-	if dm.status != StatusRunning {
+	if dm.status != StatusRunning && dm.status != StatusPaused {
 		dm.mutex.Unlock()
 		return
 	}
+	done := dm.done
+	dm.finishPauseLocked()
+	dm.schedulePaused = false
+	limit := dm.bandwidth.Limit
 	dm.mutex.Unlock()
 
+	// Снимаем паузу передачи данных, чтобы прерванные чтения завершились
+	dm.downloader.Bandwidth.Set(limit, false)
+
 	if dm.cancel != nil {
 		dm.cancel()
 	}
-	dm.wg.Wait()
+	<-done
 
 	dm.mutex.Lock()
 	dm.status = StatusIdle
@@ -102,6 +368,82 @@ func (dm *DownloadManager) Stop() {
 	dm.mutex.Unlock()
 }
 
+// Pause приостанавливает скачивание, сохраняя пул воркеров, статистику и позицию чтения.
+// Текущие пользователи дообрабатываются, новые не берутся до Resume.
+func (dm *DownloadManager) Pause() error {
+	dm.mutex.Lock()
+	if dm.status != StatusRunning {
+		dm.mutex.Unlock()
+		return fmt.Errorf("скачивание не запущено")
+	}
+
+	dm.pauseLocked()
+	dm.mutex.Unlock()
+
+	dm.saveCheckpoint(models.JobStatusPaused, "")
+	log.Printf("⏸️  Скачивание приостановлено")
+	return nil
+}
+
+// pauseLocked ставит скачивание на паузу. Вызывается под dm.mutex.
+func (dm *DownloadManager) pauseLocked() {
+	dm.status = StatusPaused
+	dm.resumeCh = make(chan struct{})
+	dm.pausedAt = time.Now()
+}
+
+// Resume продолжает приостановленное скачивание с того же места
+func (dm *DownloadManager) Resume() error {
+	dm.mutex.Lock()
+	if dm.status != StatusPaused {
+		dm.mutex.Unlock()
+		return fmt.Errorf("скачивание не приостановлено")
+	}
+
+	// Ручное продолжение отменяет паузу по расписанию до конца текущего окна
+	if dm.schedulePaused {
+		dm.scheduleOverride = dm.bandwidth.Window
+		dm.schedulePaused = false
+	}
+	dm.finishPauseLocked()
+	dm.status = StatusRunning
+	limit := dm.bandwidth.Limit
+	dm.mutex.Unlock()
+
+	dm.downloader.Bandwidth.Set(limit, false)
+	dm.saveCheckpoint(models.JobStatusRunning, "")
+	log.Printf("▶️  Скачивание возобновлено")
+	return nil
+}
+
+// finishPauseLocked снимает паузу и учитывает её длительность. Вызывается под dm.mutex.
+func (dm *DownloadManager) finishPauseLocked() {
+	if dm.resumeCh == nil {
+		return
+	}
+	close(dm.resumeCh)
+	dm.resumeCh = nil
+	dm.pausedTotal += time.Since(dm.pausedAt)
+}
+
+// waitIfPaused блокируется, пока скачивание на паузе. Возвращает ошибку, если контекст отменён.
+func (dm *DownloadManager) waitIfPaused() error {
+	dm.mutex.RLock()
+	resumeCh := dm.resumeCh
+	dm.mutex.RUnlock()
+
+	if resumeCh == nil {
+		return nil
+	}
+
+	select {
+	case <-dm.ctx.Done():
+		return dm.ctx.Err()
+	case <-resumeCh:
+		return nil
+	}
+}
+
 // GetStatus возвращает текущий статус
 func (dm *DownloadManager) GetStatus() (DownloadStatus, *Stats, time.Duration) {
 	dm.mutex.RLock()
@@ -116,13 +458,20 @@ func (dm *DownloadManager) GetStatus() (DownloadStatus, *Stats, time.Duration) {
 		SuccessfulFiles: atomic.LoadInt64(&dm.stats.SuccessfulFiles),
 		FailedFiles:     atomic.LoadInt64(&dm.stats.FailedFiles),
 		SkippedUsers:    atomic.LoadInt64(&dm.stats.SkippedUsers),
+		DedupFiles:      atomic.LoadInt64(&dm.stats.DedupFiles),
+		DedupBytes:      atomic.LoadInt64(&dm.stats.DedupBytes),
+		LastUserID:      atomic.LoadInt64(&dm.stats.LastUserID),
 	}
 
+	// Время на паузе в длительность не входит
 	var duration time.Duration
-	if dm.status == StatusRunning {
-		duration = time.Since(dm.startTime)
-	} else if !dm.endTime.IsZero() {
-		duration = dm.endTime.Sub(dm.startTime)
+	switch {
+	case dm.status == StatusRunning:
+		duration = time.Since(dm.startTime) - dm.pausedTotal
+	case dm.status == StatusPaused:
+		duration = dm.pausedAt.Sub(dm.startTime) - dm.pausedTotal
+	case !dm.endTime.IsZero():
+		duration = dm.endTime.Sub(dm.startTime) - dm.pausedTotal
 	}
 
 	return dm.status, statsCopy, duration
@@ -130,149 +479,258 @@ func (dm *DownloadManager) GetStatus() (DownloadStatus, *Stats, time.Duration) {
 
 // run выполняет процесс скачивания
 func (dm *DownloadManager) run() {
-	// Подсчитываем общее количество пользователей
-	err := dm.db.QueryRow(`
-		SELECT COUNT(*)
-		FROM users
-		WHERE (document_files IS NOT NULL AND document_files != '')
-		   OR (address_files IS NOT NULL AND address_files != '')
-	`).Scan(&dm.stats.TotalUsers)
+	defer close(dm.done)
+
+	// Фильтр only_failed зависит от журнала, поэтому разрешается при каждом запуске
+	filter, err := dm.resolveFilter(dm.spec)
+	if err == nil {
+		// Подсчитываем общее количество пользователей
+		var totalUsers int64
+		totalUsers, err = dm.countUsers(filter)
+		atomic.StoreInt64(&dm.stats.TotalUsers, totalUsers)
+	}
 	if err != nil {
 		log.Printf("Ошибка подсчёта пользователей: %v", err)
 		dm.mutex.Lock()
 		dm.status = StatusFailed
+		dm.endTime = time.Now()
 		dm.mutex.Unlock()
+		dm.saveCheckpoint(models.JobStatusFailed, err.Error())
 		return
 	}
-
 	// Канал для пользователей
 	usersChan := make(chan *models.User, dm.cfg.Download.BatchSize)
 
-	// Запускаем ОДИН воркер (однопоточный режим)
-	dm.wg.Add(1)
-	go dm.worker(1, usersChan)
+	// Запускаем пул воркеров, которые разбирают общий канал
+	workers := dm.cfg.Download.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	log.Printf("🚀 Запуск скачивания: %d воркеров, до %.2f запросов/с на хост (пачка %d)", workers, dm.cfg.Download.Rate, dm.cfg.Download.Burst)
+	for i := 1; i <= workers; i++ {
+		dm.wg.Add(1)
+		go dm.worker(i, usersChan)
+	}
+
+	// Периодически сохраняем контрольную точку и применяем расписание пропускной способности
+	stopCheckpoints := make(chan struct{})
+	go dm.checkpointLoop(stopCheckpoints)
+	go dm.scheduleLoop(stopCheckpoints)
 
 	// Читаем пользователей из БД
-	err = dm.fetchUsers(usersChan)
-	if err != nil {
-		log.Printf("Ошибка чтения пользователей: %v", err)
+	fetchErr := dm.fetchUsers(usersChan, filter)
+	if fetchErr != nil && dm.ctx.Err() == nil {
+		log.Printf("Ошибка чтения пользователей: %v", fetchErr)
+	} else {
+		fetchErr = nil
 	}
 
 	// Закрываем канал пользователей
 	close(usersChan)
 
-	// Ждём завершения воркера
+	// Ждём завершения всех воркеров
 	dm.wg.Wait()
+	close(stopCheckpoints)
 
+	// Сливаем сегменты CSV индекса в основной индекс (в том числе после остановки задания)
+	if err := dm.metadata.CompactIndex(context.Background()); err != nil {
+		log.Printf("Ошибка записи индекса пользователей: %v", err)
+	}
+
+	jobStatus := models.JobStatusCompleted
+	errMsg := ""
 	dm.mutex.Lock()
-	if dm.ctx.Err() != nil {
+	dm.schedulePaused = false
+	dm.scheduleOverride = ""
+	switch {
+	case dm.ctx.Err() != nil:
 		dm.status = StatusIdle
-	} else {
+		jobStatus = models.JobStatusStopped
+	case fetchErr != nil:
+		dm.status = StatusFailed
+		jobStatus = models.JobStatusFailed
+		errMsg = fetchErr.Error()
+	default:
 		dm.status = StatusCompleted
 	}
 	dm.endTime = time.Now()
 	dm.mutex.Unlock()
+
+	dm.saveCheckpoint(jobStatus, errMsg)
+	log.Printf("🏁 Задание #%d завершено со статусом %s", dm.CurrentJobID(), jobStatus)
 }
 
-func (dm *DownloadManager) fetchUsers(usersChan chan<- *models.User) error {
-	offset := 0
+// fetchUsers читает пользователей пачками по keyset-курсору (id > последнего прочитанного).
+// В отличие от OFFSET, запрос не замедляется с каждой пачкой и не пропускает строки,
+// вставленные во время длинного прогона.
+func (dm *DownloadManager) fetchUsers(usersChan chan<- *models.User, filter repositories.UserFilter) error {
+	afterID := atomic.LoadInt64(&dm.stats.LastUserID)
+
+	// Пользователи, отсеянные only_missing, уточняют общее количество
+	dropped := func(n int) {
+		atomic.AddInt64(&dm.stats.TotalUsers, -int64(n))
+	}
+
+	return dm.streamUsers(dm.ctx, filter, afterID, dm.spec.OnlyMissing, dropped, func(user *models.User) error {
+		if err := dm.waitIfPaused(); err != nil {
+			return err
+		}
+
+		// Отмечаем до отправки: воркер может завершить пользователя раньше, чем мы вернёмся сюда
+		dm.checkpoint.fetched(user.ID)
 
-	for {
 		select {
+		case usersChan <- user:
+			atomic.StoreInt64(&dm.stats.LastUserID, user.ID)
+			return nil
 		case <-dm.ctx.Done():
 			return dm.ctx.Err()
-		default:
 		}
+	})
+}
 
-		query := `
-			SELECT id, citizenship_id, document_files, address_files, phone, email, first_name, last_name, patronymic, document_number
-			FROM users
-			WHERE (document_files IS NOT NULL AND document_files != '')
-			   OR (address_files IS NOT NULL AND address_files != '')
-			ORDER BY id
-			LIMIT $1 OFFSET $2
-		`
+// countUsers общее количество пользователей задания. Для only_missing это верхняя оценка:
+// уже обработанные плюс все оставшиеся после курсора; отсеянные при обходе вычитаются по ходу.
+func (dm *DownloadManager) countUsers(filter repositories.UserFilter) (int64, error) {
+	if !dm.spec.OnlyMissing {
+		return dm.userRepo.CountWithFiles(dm.ctx, filter)
+	}
+
+	if afterID := atomic.LoadInt64(&dm.stats.LastUserID); afterID >= filter.IDFrom {
+		filter.IDFrom = afterID + 1
+	}
+	remaining, err := dm.userRepo.CountWithFiles(dm.ctx, filter)
+	return atomic.LoadInt64(&dm.stats.ProcessedUsers) + remaining, err
+}
 
-		rows, err := dm.db.Query(query, dm.cfg.Download.BatchSize, offset)
+// streamUsers обходит пользователей с файлами по фильтру пачками BATCH_SIZE, начиная с id > afterID.
+// Общий поток для скачивания и для плана задания (dry-run). При onlyMissing пользователи без
+// нескачанных категорий отсеиваются по пачкам, их количество передаётся в dropped (может быть nil).
+func (dm *DownloadManager) streamUsers(ctx context.Context, filter repositories.UserFilter, afterID int64, onlyMissing bool, dropped func(n int), fn func(user *models.User) error) error {
+	for {
+		users, err := dm.userRepo.ListWithFilesAfter(ctx, filter, afterID, false, dm.cfg.Download.BatchSize)
 		if err != nil {
-			return fmt.Errorf("ошибка запроса: %w", err)
+			return err
+		}
+		if len(users) == 0 {
+			return nil
 		}
+		afterID = users[len(users)-1].ID
 
-		count := 0
-		for rows.Next() {
-			user := &models.User{}
-			if err := rows.Scan(&user.ID, &user.CitizenshipID, &user.DocumentFiles, &user.AddressFiles, &user.Phone, &user.Email, &user.FirstName, &user.LastName, &user.Patronymic, &user.DocumentNumber); err != nil {
-				log.Printf("Ошибка сканирования пользователя: %v", err)
-				continue
+		if onlyMissing {
+			missing, err := dm.filterMissing(users)
+			if err != nil {
+				return err
 			}
-
-			select {
-			case usersChan <- user:
-				count++
-			case <-dm.ctx.Done():
-				rows.Close()
-				return dm.ctx.Err()
+			if dropped != nil && len(missing) < len(users) {
+				dropped(len(users) - len(missing))
 			}
+			users = missing
 		}
-		rows.Close()
 
-		if count == 0 {
-			break
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
 		}
-
-		offset += dm.cfg.Download.BatchSize
 	}
-
-	return nil
 }
 
-// createUserInfoFile создает файл info.txt с информацией о пользователе
-func (dm *DownloadManager) createUserInfoFile(userDir string, user *models.User) error {
-	infoFilePath := filepath.Join(userDir, "info.txt")
-
-	phone := "N/A"
-	if user.Phone.Valid && user.Phone.String != "" {
-		phone = user.Phone.String
+// writeUserFiles записывает manifest.json и файлы с данными пользователя по журналу файлов
+func (dm *DownloadManager) writeUserFiles(userKey string, user *models.User, status map[string]bool) error {
+	items, err := dm.fileItemRepo.GetByUserID(user.ID)
+	if err != nil {
+		return err
 	}
 
-	email := "N/A"
-	if user.Email.Valid && user.Email.String != "" {
-		email = user.Email.String
+	if err := WriteManifest(dm.ctx, dm.store, userKey, user.ID, items); err != nil {
+		return err
 	}
+	return dm.metadata.Write(dm.ctx, user, userKey, status, items)
+}
 
-	firstName := "N/A"
-	if user.FirstName.Valid && user.FirstName.String != "" {
-		firstName = user.FirstName.String
+// recordCategoryFailure сохраняет причину ошибки категории пользователя в user_file_statuses
+func (dm *DownloadManager) recordCategoryFailure(userID int64, category string, downloadErr error) {
+	if err := dm.userFileRepo.RecordFailure(userID, category, ErrorClass(downloadErr), downloadErr.Error(), IsPermanent(downloadErr)); err != nil {
+		log.Printf("Ошибка записи причины ошибки пользователя %d: %v", userID, err)
 	}
+}
 
-	lastName := "N/A"
-	if user.LastName.Valid && user.LastName.String != "" {
-		lastName = user.LastName.String
+// CategoryStatuses статусы всех категорий из настроек (отсутствующие в status - false)
+func CategoryStatuses(categories []config.FileCategory, status map[string]bool) map[string]bool {
+	statuses := make(map[string]bool, len(categories))
+	for _, category := range categories {
+		statuses[category.Name] = status[category.Name]
 	}
+	return statuses
+}
 
-	patronymic := "N/A"
-	if user.Patronymic.Valid && user.Patronymic.String != "" {
-		patronymic = user.Patronymic.String
+// anyDownloaded проверяет, скачана ли хотя бы одна категория
+func anyDownloaded(statuses map[string]bool) bool {
+	for _, downloaded := range statuses {
+		if downloaded {
+			return true
+		}
 	}
+	return false
+}
 
-	documentNumber := "N/A"
-	if user.DocumentNumber.Valid && user.DocumentNumber.String != "" {
-		documentNumber = user.DocumentNumber.String
+// formatStatuses статусы категорий для лога: "document: true, address: false"
+func formatStatuses(categories []config.FileCategory, statuses map[string]bool) string {
+	parts := make([]string, 0, len(categories))
+	for _, category := range categories {
+		parts = append(parts, fmt.Sprintf("%s: %v", category.Name, statuses[category.Name]))
 	}
+	return strings.Join(parts, ", ")
+}
+
+// Причины, по которым категория пользователя не скачивается в прогоне
+const (
+	skipDownloaded = "downloaded" // уже скачана ранее
+	skipPermanent  = "permanent"  // постоянная ошибка в прошлых прогонах (404, 410, неверный URL)
+)
 
-	content := fmt.Sprintf("phone: %s\nemail: %s\nfirst_name: %s\nlast_name: %s\npatronymic: %s\ndocument_number: %s\n",
-		phone, email, firstName, lastName, patronymic, documentNumber)
+// pendingCategories возвращает категории пользователя, которые нужно скачать: есть ссылки и ещё не скачаны.
+// Постоянные ошибки не повторяем в каждом прогоне, кроме явно выбранных классов в задании повтора ошибок.
+// Для пропущенных категорий возвращается причина.
+func (dm *DownloadManager) pendingCategories(spec JobSpec, user *models.User, status map[string]bool) ([]config.FileCategory, map[string]string) {
+	pending := make([]config.FileCategory, 0)
+	skipped := make(map[string]string)
 
-	return os.WriteFile(infoFilePath, []byte(content), 0644)
+	for _, category := range dm.layout.Categories() {
+		if !user.HasFiles(category.Name) {
+			continue
+		}
+		if status[category.Name] {
+			skipped[category.Name] = skipDownloaded
+			continue
+		}
+
+		// Нарушения ограничений, записанные постоянными прежними версиями, не мешают повтору
+		permanent, err := dm.fileItemRepo.HasPermanentFailure(user.ID, category.Name, limitClasses...)
+		if err != nil {
+			log.Printf("Ошибка проверки журнала файлов пользователя %d: %v", user.ID, err)
+		}
+		if permanent && !dm.retryPermanent(spec, user.ID, category.Name) {
+			skipped[category.Name] = skipPermanent
+			continue
+		}
+		pending = append(pending, category)
+	}
+	return pending, skipped
 }
 
 func (dm *DownloadManager) worker(id int, usersChan <-chan *models.User) {
 	defer dm.wg.Done()
 
-	// Инициализируем генератор случайных чисел для задержек
-	rand.Seed(time.Now().UnixNano() + int64(id))
+	log.Printf("[Worker %d] запущен", id)
+	defer log.Printf("[Worker %d] остановлен", id)
 
 	for {
+		if err := dm.waitIfPaused(); err != nil {
+			return
+		}
+
 		select {
 		case <-dm.ctx.Done():
 			return
@@ -281,114 +739,135 @@ func (dm *DownloadManager) worker(id int, usersChan <-chan *models.User) {
 				return
 			}
 
-			atomic.AddInt64(&dm.stats.ProcessedUsers, 1)
-
-			// Проверяем citizenship_id
-			if !user.CitizenshipID.Valid || user.CitizenshipID.String == "" {
-				atomic.AddInt64(&dm.stats.SkippedUsers, 1)
-				continue
+			// Пауза могла начаться, пока воркер ждал пользователя
+			if err := dm.waitIfPaused(); err != nil {
+				return
 			}
 
-			// Проверяем статус уже скачанных файлов
-			existingStatus, err := dm.userFileRepo.GetByUserID(user.ID)
-			documentAlreadyDownloaded := false
-			addressAlreadyDownloaded := false
+			// Скорость запросов ограничивается по хостам в Downloader, общим для всех воркеров
+			dm.processUser(id, user)
+			dm.checkpoint.done(user.ID)
+		}
+	}
+}
 
-			if err == nil && existingStatus != nil {
-				documentAlreadyDownloaded = existingStatus.Document
-				addressAlreadyDownloaded = existingStatus.Address
-			}
+// userBudget ограничение DOWNLOAD_MAX_USER_SIZE для пользователя: занято размером файлов, скачанных
+// в прошлых прогонах в категориях, которые сейчас не скачиваются. Файлы скачиваемых категорий
+// учитывает сам загрузчик, находя их в хранилище.
+func (dm *DownloadManager) userBudget(userID int64, pending []config.FileCategory) *UserBudget {
+	budget := dm.downloader.NewUserBudget()
+	if budget == nil {
+		return nil
+	}
 
-			// Если оба типа файлов уже скачаны, пропускаем пользователя
-			needDownloadDocument := user.DocumentFiles.Valid && user.DocumentFiles.String != "" && !documentAlreadyDownloaded
-			needDownloadAddress := user.AddressFiles.Valid && user.AddressFiles.String != "" && !addressAlreadyDownloaded
+	items, err := dm.fileItemRepo.GetByUserID(userID)
+	if err != nil {
+		log.Printf("Ошибка чтения файлов пользователя %d: %v", userID, err)
+		return budget
+	}
 
-			if !needDownloadDocument && !needDownloadAddress {
-				atomic.AddInt64(&dm.stats.SkippedUsers, 1)
-				log.Printf("[Worker %d] ⏭️  user_id: %d - файлы уже скачаны, пропускаем", id, user.ID)
-				continue
-			}
+	downloading := make(map[string]bool, len(pending))
+	for _, category := range pending {
+		downloading[category.Name] = true
+	}
+	for _, item := range items {
+		if item.DownloadedAt != nil && !downloading[item.Category] {
+			budget.Add(item.Size)
+		}
+	}
+	return budget
+}
 
-			// Создаём директорию для пользователя
-			userDir := filepath.Join(dm.downloader.BaseDir, user.CitizenshipID.String, fmt.Sprintf("user_%d", user.ID))
-
-			hasErrors := false
-			documentSuccess := documentAlreadyDownloaded // Сохраняем предыдущий статус
-			addressSuccess := addressAlreadyDownloaded   // Сохраняем предыдущий статус
-
-			// Скачиваем document_files только если еще не скачаны
-			if needDownloadDocument {
-				docDir := filepath.Join(userDir, "documents")
-				files, err := dm.downloader.DownloadUploadcareFiles(user.DocumentFiles.String, docDir, "document")
-				if err != nil {
-					log.Printf("[Worker %d] Ошибка скачивания документов пользователя %d: %v", id, user.ID, err)
-					hasErrors = true
-					atomic.AddInt64(&dm.stats.FailedFiles, 1)
-				} else {
-					atomic.AddInt64(&dm.stats.TotalFiles, int64(len(files)))
-					atomic.AddInt64(&dm.stats.SuccessfulFiles, int64(len(files)))
-					documentSuccess = true
-					log.Printf("[Worker %d] 📄 user_id: %d - скачано %d документов", id, user.ID, len(files))
-				}
-			} else if documentAlreadyDownloaded {
-				log.Printf("[Worker %d] ⏭️  user_id: %d - документы уже скачаны ранее", id, user.ID)
-			}
+// processUser скачивает файлы одного пользователя
+func (dm *DownloadManager) processUser(id int, user *models.User) {
+	atomic.AddInt64(&dm.stats.ProcessedUsers, 1)
 
-			// Скачиваем address_files только если еще не скачаны
-			if needDownloadAddress {
-				addrDir := filepath.Join(userDir, "address")
-				files, err := dm.downloader.DownloadUploadcareFiles(user.AddressFiles.String, addrDir, "address")
-				if err != nil {
-					log.Printf("[Worker %d] Ошибка скачивания адресных файлов пользователя %d: %v", id, user.ID, err)
-					hasErrors = true
-					atomic.AddInt64(&dm.stats.FailedFiles, 1)
-				} else {
-					atomic.AddInt64(&dm.stats.TotalFiles, int64(len(files)))
-					atomic.AddInt64(&dm.stats.SuccessfulFiles, int64(len(files)))
-					addressSuccess = true
-					log.Printf("[Worker %d] 🏠 user_id: %d - скачано %d адресных файлов", id, user.ID, len(files))
-				}
-			} else if addressAlreadyDownloaded {
-				log.Printf("[Worker %d] ⏭️  user_id: %d - адресные файлы уже скачаны ранее", id, user.ID)
-			}
+	// Проверяем citizenship_id
+	if !user.HasGroup() {
+		atomic.AddInt64(&dm.stats.SkippedUsers, 1)
+		return
+	}
 
-			// Записываем статус в базу данных
-			if documentSuccess || addressSuccess {
-				if err := dm.userFileRepo.Upsert(user.ID, documentSuccess, addressSuccess); err != nil {
-					log.Printf("[Worker %d] Ошибка записи статуса для пользователя %d: %v", id, user.ID, err)
-				}
-
-				// Создаём папку пользователя, если её нет
-				if err := os.MkdirAll(userDir, 0755); err != nil {
-					log.Printf("[Worker %d] Ошибка создания директории %s: %v", id, userDir, err)
-				} else {
-					// Создаём файл info.txt с информацией о пользователе
-					if err := dm.createUserInfoFile(userDir, user); err != nil {
-						log.Printf("[Worker %d] Ошибка создания info.txt для пользователя %d: %v", id, user.ID, err)
-					} else {
-						log.Printf("[Worker %d] 📝 user_id: %d - создан файл info.txt", id, user.ID)
-					}
-				}
-			}
+	// Проверяем статус уже скачанных категорий
+	status, err := dm.userFileRepo.GetByUserID(user.ID)
+	if err != nil {
+		log.Printf("[Worker %d] Ошибка чтения статуса пользователя %d: %v", id, user.ID, err)
+		status = make(map[string]bool)
+	}
 
-			if hasErrors {
-				atomic.AddInt64(&dm.stats.FailedUsers, 1)
-				log.Printf("[Worker %d] ❌ user_id: %d - скачивание завершено с ошибками", id, user.ID)
-			} else {
-				atomic.AddInt64(&dm.stats.SuccessfulUsers, 1)
-				log.Printf("[Worker %d] ✅ user_id: %d - обработка завершена успешно (документы: %v, адрес: %v)", id, user.ID, documentSuccess, addressSuccess)
-			}
+	// Категории, которые нужно скачать
+	pending, skipped := dm.pendingCategories(dm.spec, user, status)
+	for _, category := range dm.layout.Categories() {
+		switch skipped[category.Name] {
+		case skipDownloaded:
+			log.Printf("[Worker %d] ⏭️  user_id: %d - файлы %s уже скачаны ранее", id, user.ID, category.Name)
+		case skipPermanent:
+			log.Printf("[Worker %d] 🚫 user_id: %d - %s: постоянная ошибка в прошлых прогонах, пропускаем", id, user.ID, category.Name)
+		}
+	}
 
-			// Задержка 3-13 секунд перед следующим пользователем
-			delaySeconds := 3 + rand.Intn(11) // 3 + [0-10] = 3-13 секунд
-			log.Printf("[Worker %d] ⏸️  Пауза %d секунд перед следующим пользователем", id, delaySeconds)
+	if len(pending) == 0 {
+		atomic.AddInt64(&dm.stats.SkippedUsers, 1)
+		log.Printf("[Worker %d] ⏭️  user_id: %d - файлы уже скачаны, пропускаем", id, user.ID)
+		return
+	}
 
-			select {
-			case <-dm.ctx.Done():
-				return
-			case <-time.After(time.Duration(delaySeconds) * time.Second):
-				// Продолжаем после задержки
+	// Префикс пользователя в хранилище
+	userKey := dm.layout.UserKey(user)
+
+	// Ограничение размера файлов пользователя: файлы категорий, которые уже скачаны, учитываются сразу
+	budget := dm.userBudget(user.ID, pending)
+
+	hasErrors := false
+	for _, category := range pending {
+		files, err := dm.downloader.DownloadFiles(dm.ctx, user, user.Files[category.Name], category.Name, budget)
+
+		// При частичной ошибке группы остальные файлы уже скачаны и учтены в журнале
+		atomic.AddInt64(&dm.stats.TotalFiles, int64(len(files)))
+		atomic.AddInt64(&dm.stats.SuccessfulFiles, int64(len(files)))
+		for _, file := range files {
+			if file.Deduplicated {
+				atomic.AddInt64(&dm.stats.DedupFiles, 1)
+				atomic.AddInt64(&dm.stats.DedupBytes, file.Size)
 			}
 		}
+		if err != nil {
+			log.Printf("[Worker %d] Ошибка скачивания файлов %s пользователя %d: %v", id, category.Name, user.ID, err)
+			hasErrors = true
+			atomic.AddInt64(&dm.stats.FailedFiles, int64(FailedFiles(err)))
+			dm.recordCategoryFailure(user.ID, category.Name, err)
+			continue
+		}
+		if err := dm.userFileRepo.RecordSuccess(user.ID, category.Name); err != nil {
+			log.Printf("[Worker %d] Ошибка записи статуса для пользователя %d: %v", id, user.ID, err)
+		}
+
+		status[category.Name] = true
+		log.Printf("[Worker %d] 📄 user_id: %d - скачано файлов %s: %d", id, user.ID, category.Name, len(files))
+	}
+
+	// Статус записываем по всем категориям (сохраняя предыдущий)
+	statuses := CategoryStatuses(dm.layout.Categories(), status)
+
+	// Записываем статус в базу данных
+	if anyDownloaded(statuses) {
+		if err := dm.userFileRepo.Upsert(user.ID, statuses); err != nil {
+			log.Printf("[Worker %d] Ошибка записи статуса для пользователя %d: %v", id, user.ID, err)
+		}
+
+		// Создаём manifest.json и файлы с данными пользователя (info.json, info.yaml, ...)
+		if err := dm.writeUserFiles(userKey, user, statuses); err != nil {
+			log.Printf("[Worker %d] Ошибка записи данных пользователя %d: %v", id, user.ID, err)
+		} else {
+			log.Printf("[Worker %d] 📝 user_id: %d - записаны manifest.json и данные пользователя", id, user.ID)
+		}
+	}
+
+	if hasErrors {
+		atomic.AddInt64(&dm.stats.FailedUsers, 1)
+		log.Printf("[Worker %d] ❌ user_id: %d - скачивание завершено с ошибками", id, user.ID)
+	} else {
+		atomic.AddInt64(&dm.stats.SuccessfulUsers, 1)
+		log.Printf("[Worker %d] ✅ user_id: %d - обработка завершена успешно (%s)", id, user.ID, formatStatuses(dm.layout.Categories(), statuses))
 	}
 }
@@ -1,173 +1,604 @@
 package services
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"up-down/config"
+	"up-down/models"
+	"up-down/storage"
 )
 
+// maxRetryAfter ограничивает ожидание по заголовку Retry-After
+const maxRetryAfter = 5 * time.Minute
+
+// FileLedger журнал скачанных файлов (по одной записи на файл)
+type FileLedger interface {
+	RecordSuccess(item *models.UserFileItem) error
+	RecordFailure(item *models.UserFileItem) error
+}
+
+// FileInfo результат скачивания одного файла
+type FileInfo struct {
+	Key         string // ключ в хранилище
+	Path        string // расположение для логов и журнала (storage.Location)
+	Size        int64
+	ContentType string
+	SHA256      string
+
+	// Содержимое уже было в хранилище (.objects), файл записан ссылкой без копии
+	Deduplicated bool
+}
+
+// Downloader скачивает файлы во временные файлы в BaseDir и переносит готовые в Storage
 type Downloader struct {
 	BaseDir    string
 	HTTPClient *http.Client
+	Ledger     FileLedger
+	Sources    *SourceRegistry
+	Storage    storage.Storage
+	Layout     *Layout
+	Limiter    *RateLimiter      // ограничение скорости по хостам (nil - без ограничения)
+	Bandwidth  *BandwidthLimiter // общее ограничение пропускной способности (nil - без ограничения)
+	Dedup      *DedupStore       // хранение одинаковых файлов один раз (nil - без дедупликации)
+
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// Сколько файлов одной группы скачивается одновременно
+	FileConcurrency int
+
+	// Защита диска: наибольший размер файла, суммарный размер файлов пользователя (0 - без ограничения)
+	// и разрешённые MIME типы (пусто - любые)
+	MaxFileSize         int64
+	MaxUserSize         int64
+	AllowedContentTypes []string
 }
 
-func NewDownloader(baseDir string) *Downloader {
+func NewDownloader(cfg *config.DownloadConfig, ledger FileLedger, store storage.Storage, layout *Layout) *Downloader {
+	// Ссылки file:// читаются через тот же клиент, что и HTTP
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.FileRoot != "" {
+		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(cfg.FileRoot)))
+	}
+
+	// Общий таймаут запроса не задаём: при ограничении пропускной способности и паузе по расписанию
+	// большой файл скачивается дольше минуты. Ограничено ожидание заголовков ответа.
+	transport.ResponseHeaderTimeout = 60 * time.Second
+
+	limiter := NewRateLimiter(cfg)
+
+	var dedup *DedupStore
+	if cfg.Dedup {
+		if storage.CanLink(store) {
+			dedup = NewDedupStore(store)
+		} else {
+			log.Printf("⚠️  DOWNLOAD_DEDUP: хранилище не поддерживает ссылки на файлы, дедупликация отключена")
+		}
+	}
+
 	return &Downloader{
-		BaseDir: baseDir,
+		BaseDir: cfg.Dir,
 		HTTPClient: &http.Client{
-			Timeout: 60 * time.Second,
+			Transport: transport,
 		},
+		Ledger:         ledger,
+		Storage:        store,
+		Layout:         layout,
+		Limiter:        limiter,
+		Bandwidth:      NewBandwidthLimiter(cfg.Bandwidth),
+		Dedup:          dedup,
+		MaxRetries:     cfg.Retries,
+		RetryBaseDelay: cfg.RetryBaseDelay,
+		RetryMaxDelay:  cfg.RetryMaxDelay,
+
+		FileConcurrency: cfg.FileConcurrency,
+
+		MaxFileSize:         cfg.MaxFileSize,
+		MaxUserSize:         cfg.MaxUserSize,
+		AllowedContentTypes: cfg.AllowedContentTypes,
+
+		Sources: DefaultSourceRegistry(cfg, limiter),
 	}
 }
 
-// ParseUploadcareURL парсит URL типа https://domain.com/uuid~count/ или https://domain.com/uuid/
-func (d *Downloader) ParseUploadcareURL(url string) (baseURL string, uuid string, count int, err error) {
-	// Пытаемся парсить формат с количеством: https://domain.com/uuid~count/
-	reWithCount := regexp.MustCompile(`(https://[^/]+)/([0-9a-f-]+)~(\d+)/?`)
-	matches := reWithCount.FindStringSubmatch(url)
+// NewUserBudget ограничение суммарного размера файлов пользователя по DOWNLOAD_MAX_USER_SIZE (nil - без ограничения).
+// Создаётся на пользователя и передаётся во все DownloadFiles его категорий.
+func (d *Downloader) NewUserBudget() *UserBudget {
+	return NewUserBudget(d.MaxUserSize)
+}
 
-	if len(matches) == 4 {
-		baseURL = matches[1]
-		uuid = matches[2]
-		count, err = strconv.Atoi(matches[3])
-		if err != nil {
-			return "", "", 0, fmt.Errorf("ошибка парсинга количества файлов: %w", err)
+// DownloadFile скачивает один файл, вычисляя sha256 на лету.
+// destKey - ключ в хранилище без расширения: расширение определяется по ответу сервера.
+// Временные ошибки повторяются с экспоненциальной задержкой, постоянные (404, 410, неверный URL)
+// и нарушения ограничений размера и типа - нет. budget - ограничение размера файлов пользователя.
+func (d *Downloader) DownloadFile(ctx context.Context, url, destKey string, budget *UserBudget) (*FileInfo, error) {
+	// Проверяем, существует ли файл (с любым расширением)
+	existing, err := d.findDownloaded(ctx, destKey)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка проверки хранилища: %w", err)
+	}
+	if existing != "" {
+		// Файл уже существует, не скачиваем повторно, но учитываем его размер
+		info, err := d.describeExistingFile(ctx, existing)
+		if err == nil {
+			budget.Add(info.Size)
 		}
-		return baseURL, uuid, count, nil
+		return info, err
 	}
 
-	// Пытаемся парсить формат одиночного файла: https://domain.com/uuid/
-	reSingle := regexp.MustCompile(`(https://[^/]+)/([0-9a-f-]+)/?`)
-	matches = reSingle.FindStringSubmatch(url)
+	// Временный файл скачивания лежит в BaseDir по тому же пути, что и ключ
+	destBase := filepath.Join(d.BaseDir, filepath.FromSlash(destKey))
+	dir := filepath.Dir(destBase)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("ошибка создания директории %s: %w", dir, err)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= d.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := d.retryDelay(attempt, lastErr)
+			log.Printf("🔁 %s: повтор %d/%d через %v (%v)", url, attempt, d.MaxRetries, delay.Round(time.Millisecond), lastErr)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, requestError(url, ctx.Err())
+			case <-timer.C:
+			}
+		}
+
+		info, err := d.fetchFile(ctx, url, destKey, destBase, budget)
+		if err == nil {
+			return info, nil
+		}
+		lastErr = err
 
-	if len(matches) == 3 {
-		baseURL = matches[1]
-		uuid = matches[2]
-		count = 1
-		return baseURL, uuid, count, nil
+		if IsPermanent(err) || isLimitError(err) || ctx.Err() != nil {
+			break
+		}
 	}
 
-	return "", "", 0, fmt.Errorf("неверный формат URL: %s", url)
+	return nil, lastErr
 }
 
-// DownloadFile скачивает один файл
-func (d *Downloader) DownloadFile(url, destPath string) error {
-	// Создаём директорию если не существует
-	dir := filepath.Dir(destPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("ошибка создания директории %s: %w", dir, err)
+// retryDelay вычисляет задержку перед повтором: Retry-After, если сервер его прислал,
+// иначе экспоненциальная задержка со случайным разбросом (половина фиксированная, половина случайная)
+func (d *Downloader) retryDelay(attempt int, lastErr error) time.Duration {
+	var de *DownloadError
+	if errors.As(lastErr, &de) && de.RetryAfter > 0 {
+		if de.RetryAfter > maxRetryAfter {
+			return maxRetryAfter
+		}
+		return de.RetryAfter
 	}
 
-	// Проверяем, существует ли файл
-	if _, err := os.Stat(destPath); err == nil {
-		// Файл уже существует, пропускаем
-		return nil
+	delay := d.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > d.RetryMaxDelay {
+		delay = d.RetryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
 	}
 
-	// Скачиваем файл
-	resp, err := d.HTTPClient.Get(url)
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// fetchFile выполняет одну попытку скачивания.
+// Недокачанный .tmp файл сохраняется и при следующей попытке продолжается запросом Range,
+// если сервер прислал ETag или Last-Modified. If-Range гарантирует, что при изменении файла
+// на сервере придёт полный ответ 200 и скачивание начнётся заново.
+func (d *Downloader) fetchFile(ctx context.Context, url, destKey, destBase string, budget *UserBudget) (info *FileInfo, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return fmt.Errorf("ошибка запроса %s: %w", url, err)
+		return nil, &DownloadError{URL: url, Class: ErrorClassBadURL, Permanent: true, Err: err}
+	}
+
+	tmpPath := destBase + ".tmp"
+	offset, meta := loadPartial(tmpPath, url)
+	if meta != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", meta.validator())
+	}
+
+	resp, err := d.do(req)
+	if err != nil {
+		return nil, requestError(url, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("ошибка HTTP %d для %s", resp.StatusCode, url)
+	hasher := sha256.New()
+	var out *os.File
+
+	// Ограничения размера: байты этой попытки возвращаются в budget, если файл не сохранён
+	guard := &guardedReader{url: url, maxSize: d.MaxFileSize, budget: budget}
+	defer func() {
+		if err != nil {
+			guard.release()
+		}
+	}()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && meta != nil:
+		start, err := parseContentRangeStart(resp.Header.Get("Content-Range"))
+		if err == nil && start != offset {
+			err = fmt.Errorf("Content-Range start %d != offset %d", start, offset)
+		}
+		if err != nil {
+			// Сервер вернул не тот диапазон - начнём заново при следующей попытке
+			removePartial(tmpPath)
+			return nil, &DownloadError{URL: url, Class: ErrorClassIO, Err: err}
+		}
+
+		out, err = os.OpenFile(tmpPath, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка открытия файла %s: %w", tmpPath, err)
+		}
+		defer out.Close()
+
+		// Учитываем уже скачанную часть в хэше
+		if _, err := io.Copy(hasher, io.LimitReader(out, offset)); err != nil {
+			return nil, fmt.Errorf("ошибка чтения файла %s: %w", tmpPath, err)
+		}
+		if _, err := out.Seek(offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("ошибка позиционирования в файле %s: %w", tmpPath, err)
+		}
+		log.Printf("⏩ %s: продолжаем с %d байт", url, offset)
+
+	case resp.StatusCode == http.StatusOK:
+		// Полный ответ: сервер не поддерживает Range или файл изменился
+		if meta != nil {
+			log.Printf("↩️  %s: сервер вернул файл целиком, скачиваем заново", url)
+		}
+		offset = 0
+
+		out, err = os.Create(tmpPath)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания файла %s: %w", tmpPath, err)
+		}
+		defer out.Close()
+
+		if err := savePartial(tmpPath, url, resp); err != nil {
+			log.Printf("Ошибка записи метаданных %s: %v", tmpPath, err)
+		}
+
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// Недокачанная часть не соответствует файлу на сервере - начнём заново
+		removePartial(tmpPath)
+		return nil, &DownloadError{URL: url, StatusCode: resp.StatusCode, Class: ErrorClassIO}
+
+	default:
+		return nil, httpError(url, resp)
+	}
+
+	// Ограничения проверяются по заголовкам до передачи данных: тип (если он указан явно) и размер
+	if mediaType := headerMediaType(resp.Header); mediaType != "" && !contentTypeAllowed(d.AllowedContentTypes, mediaType) {
+		removePartial(tmpPath)
+		return nil, contentTypeError(url, mediaType)
+	}
+	expected := int64(-1)
+	if resp.ContentLength >= 0 {
+		expected = offset + resp.ContentLength
+	}
+	if err := guard.start(offset); err != nil {
+		removePartial(tmpPath)
+		return nil, err
+	}
+	if err := guard.expect(expected); err != nil {
+		removePartial(tmpPath)
+		return nil, err
 	}
 
-	// Создаём временный файл
-	tmpPath := destPath + ".tmp"
-	out, err := os.Create(tmpPath)
+	// Копируем данные, параллельно считая хэш
+	guard.r = d.Bandwidth.Reader(ctx, resp.Body)
+	written, err := io.Copy(io.MultiWriter(out, hasher), guard)
 	if err != nil {
-		return fmt.Errorf("ошибка создания файла %s: %w", tmpPath, err)
+		// Превышение ограничения прерывает передачу: недокачанная часть не нужна
+		var limitErr *DownloadError
+		if errors.As(err, &limitErr) {
+			removePartial(tmpPath)
+			return nil, limitErr
+		}
+
+		// Без валидатора продолжить нельзя - не оставляем мусор
+		if _, resumable := loadPartial(tmpPath, url); resumable == nil {
+			removePartial(tmpPath)
+		}
+		return nil, requestError(url, err)
+	}
+
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("ошибка записи файла %s: %w", tmpPath, err)
 	}
-	defer out.Close()
 
-	// Копируем данные
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("ошибка записи файла %s: %w", tmpPath, err)
+	// Расширение определяем по заголовкам ответа и содержимому, без отдельного HEAD
+	ext := detectExtension(resp.Header, tmpPath)
+
+	// Тип без явного Content-Type проверяем по содержимому
+	if len(d.AllowedContentTypes) > 0 && headerMediaType(resp.Header) == "" {
+		if mediaType := extensionMediaType(ext); !contentTypeAllowed(d.AllowedContentTypes, mediaType) {
+			removePartial(tmpPath)
+			return nil, contentTypeError(url, mediaType)
+		}
 	}
 
-	// Переименовываем временный файл
-	if err := os.Rename(tmpPath, destPath); err != nil {
-		os.Remove(tmpPath)
-		return fmt.Errorf("ошибка переименования файла: %w", err)
+	info = &FileInfo{
+		Key:         destKey + ext,
+		Size:        offset + written,
+		ContentType: resp.Header.Get("Content-Type"),
+		SHA256:      hex.EncodeToString(hasher.Sum(nil)),
 	}
+	info.Path = d.Storage.Location(info.Key)
 
-	return nil
+	// Переносим временный файл в хранилище (при дедупликации - в .objects со ссылкой из директории пользователя)
+	obj := storage.Object{Key: info.Key, Size: info.Size, ContentType: info.ContentType, SHA256: info.SHA256}
+	if d.Dedup != nil {
+		info.Deduplicated, err = d.Dedup.PutFile(ctx, obj, tmpPath)
+	} else {
+		err = storage.PutFile(ctx, d.Storage, obj, tmpPath)
+	}
+	if err != nil {
+		removePartial(tmpPath)
+		return nil, fmt.Errorf("ошибка записи файла в хранилище: %w", err)
+	}
+	os.Remove(partialMetaPath(tmpPath))
+
+	return info, nil
 }
 
-// DownloadUploadcareFiles скачивает файлы из Uploadcare
-func (d *Downloader) DownloadUploadcareFiles(url, destDir, filePrefix string) ([]string, error) {
-	if url == "" || url == " " {
-		return nil, nil
+// do выполняет запрос с учётом ограничения скорости хоста: ждёт токен, а по ответу
+// снижает скорость (429, 503) или учитывает успешный запрос
+func (d *Downloader) do(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	if _, err := d.Limiter.Wait(req.Context(), url); err != nil {
+		return nil, err
 	}
 
-	url = strings.TrimSpace(url)
-	baseURL, uuid, count, err := d.ParseUploadcareURL(url)
+	resp, err := d.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	// Проверяем, это группа файлов или одиночный файл
-	isGroup := strings.Contains(url, "~")
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		d.Limiter.Backoff(url, parseRetryAfter(resp.Header.Get("Retry-After")))
+	case resp.StatusCode < 400:
+		d.Limiter.Success(url)
+	}
+	return resp, nil
+}
 
-	downloadedFiles := make([]string, 0, count)
+// findDownloaded ищет в хранилище уже скачанный файл destKey.<ext>, не считая временных файлов
+func (d *Downloader) findDownloaded(ctx context.Context, destKey string) (string, error) {
+	objects, err := d.Storage.List(ctx, destKey+".")
+	if err != nil {
+		return "", err
+	}
+	for _, obj := range objects {
+		ext := strings.TrimPrefix(obj.Key, destKey)
+		if strings.Contains(ext, "/") || isTempFile(obj.Key) {
+			continue
+		}
+		return obj.Key, nil
+	}
+	return "", nil
+}
 
-	for i := 0; i < count; i++ {
-		var fileURL string
-		if isGroup {
-			// Для группы используем формат nth/i/
-			fileURL = fmt.Sprintf("%s/%s~%d/nth/%d/", baseURL, uuid, count, i)
-		} else {
-			// Для одиночного файла используем прямой UUID
-			fileURL = fmt.Sprintf("%s/%s", baseURL, uuid)
+// isTempFile проверяет, является ли файл временным (недокачанным или недописанным)
+func isTempFile(name string) bool {
+	return strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, ".tmp.meta") || strings.HasSuffix(name, ".part") ||
+		strings.HasSuffix(name, ".link")
+}
+
+// describeExistingFile возвращает размер и sha256 уже скачанного файла.
+// Если хранилище не знает sha256, файл читается целиком.
+func (d *Downloader) describeExistingFile(ctx context.Context, key string) (*FileInfo, error) {
+	obj, err := d.Storage.Stat(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла %s: %w", key, err)
+	}
+
+	info := &FileInfo{
+		Key:         key,
+		Path:        d.Storage.Location(key),
+		Size:        obj.Size,
+		ContentType: obj.ContentType,
+		SHA256:      obj.SHA256,
+	}
+	if info.ContentType == "" {
+		info.ContentType = mime.TypeByExtension(path.Ext(key))
+	}
+
+	if info.SHA256 == "" {
+		size, sum, err := hashObject(ctx, d.Storage, key)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения файла %s: %w", key, err)
 		}
+		info.Size = size
+		info.SHA256 = sum
+	}
+	return info, nil
+}
 
-		// Определяем расширение файла (попробуем скачать и определить)
-		ext := d.getFileExtension(fileURL)
-		fileName := fmt.Sprintf("%s_%d%s", filePrefix, i+1, ext)
-		destPath := filepath.Join(destDir, fileName)
+// DownloadFiles скачивает файлы категории по значению колонки users и записывает каждый файл в журнал.
+// Источник (Uploadcare, HTTP(S), JSON список, file://) выбирается по формату ссылки,
+// ключи файлов строятся по раскладке Layout. Файлы, которые источник отметил удалёнными
+// или отсутствующими, не запрашиваются и записываются в журнал с классом missing; так же сразу
+// отклоняются файлы, размер или тип которых источник сообщил и они нарушают ограничения.
+// budget - ограничение суммарного размера файлов пользователя (nil - без ограничения).
+func (d *Downloader) DownloadFiles(ctx context.Context, user *models.User, raw, category string, budget *UserBudget) ([]*FileInfo, error) {
+	userID := user.ID
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
 
-		if err := d.DownloadFile(fileURL, destPath); err != nil {
-			return downloadedFiles, fmt.Errorf("ошибка скачивания %s: %w", fileURL, err)
+	source, files, err := d.Sources.ResolveFiles(ctx, raw)
+	if err != nil {
+		// Ошибка источника с классом (группа не найдена в API) сохраняется, остальное - неверная ссылка
+		var resolveErr *DownloadError
+		if !errors.As(err, &resolveErr) {
+			resolveErr = &DownloadError{URL: raw, Class: ErrorClassBadURL, Permanent: true, Err: err}
 		}
+		d.recordFailure(userID, category, 0, raw, resolveErr)
+		return nil, resolveErr
+	}
+	if len(files) > 1 {
+		log.Printf("🔗 user_id: %d - %s: %d файлов (%s)", userID, category, len(files), source.Name())
+	}
+
+	// Файлы группы скачиваются параллельно (не больше FileConcurrency на пользователя),
+	// но результаты собираются по индексам, поэтому номера в именах файлов не зависят от порядка завершения
+	concurrency := d.FileConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]*FileInfo, len(files))
+	errs := make([]error, len(files))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, file := range files {
+		if rejectErr := d.rejectRemoteFile(file); rejectErr != nil {
+			d.recordFailure(userID, category, i, file.URL, rejectErr)
+			errs[i] = rejectErr
+			continue
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = requestError(file.URL, ctx.Err())
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, file RemoteFile) {
+			defer wg.Done()
+			defer func() { <-slots }()
 
-		downloadedFiles = append(downloadedFiles, destPath)
+			// Расширение определяется по ответу сервера при скачивании
+			destKey := d.Layout.FileKey(user, category, i+1, file.Name)
+
+			info, err := d.DownloadFile(ctx, file.URL, destKey, budget)
+			if err != nil {
+				d.recordFailure(userID, category, i, file.URL, err)
+				errs[i] = err
+				return
+			}
+			d.recordSuccess(userID, category, i, file, info)
+			results[i] = info
+		}(i, file)
 	}
+	wg.Wait()
 
+	downloadedFiles := make([]*FileInfo, 0, len(files))
+	groupErr := &GroupError{Total: len(files)}
+	for i, info := range results {
+		if errs[i] != nil {
+			groupErr.Failures = append(groupErr.Failures, FileFailure{Index: i, URL: files[i].URL, Err: errs[i]})
+			continue
+		}
+		downloadedFiles = append(downloadedFiles, info)
+	}
+
+	if len(groupErr.Failures) > 0 {
+		return downloadedFiles, groupErr
+	}
 	return downloadedFiles, nil
 }
 
-// getFileExtension пытается определить расширение файла
-func (d *Downloader) getFileExtension(url string) string {
-	resp, err := d.HTTPClient.Head(url)
+// rejectRemoteFile проверяет файл по сведениям источника до запроса: удалённые файлы
+// и нарушающие DOWNLOAD_MAX_FILE_SIZE или DOWNLOAD_ALLOWED_CONTENT_TYPES не скачиваются
+func (d *Downloader) rejectRemoteFile(file RemoteFile) *DownloadError {
+	switch {
+	case file.Missing:
+		return &DownloadError{URL: file.URL, Class: ErrorClassMissing, Permanent: true, Err: errors.New(file.Reason)}
+	case d.MaxFileSize > 0 && file.Size > d.MaxFileSize:
+		return tooLargeError(file.URL, file.Size, d.MaxFileSize)
+	case file.MimeType != "" && !contentTypeAllowed(d.AllowedContentTypes, file.MimeType):
+		return contentTypeError(file.URL, file.MimeType)
+	}
+	return nil
+}
+
+// recordSuccess записывает успешно скачанный файл в журнал
+func (d *Downloader) recordSuccess(userID int64, category string, index int, file RemoteFile, info *FileInfo) {
+	if d.Ledger == nil {
+		return
+	}
+
+	now := time.Now()
+	item := &models.UserFileItem{
+		UserID:       userID,
+		Category:     category,
+		GroupIndex:   index,
+		URL:          file.URL,
+		OriginalName: file.Name,
+		LocalPath:    info.Path,
+		StorageKey:   info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		SHA256:       info.SHA256,
+		DownloadedAt: &now,
+	}
+	if err := d.Ledger.RecordSuccess(item); err != nil {
+		log.Printf("Ошибка записи файла %s в журнал: %v", info.Path, err)
+	}
+}
+
+// recordFailure записывает неудачную попытку скачивания в журнал
+func (d *Downloader) recordFailure(userID int64, category string, index int, url string, downloadErr error) {
+	if d.Ledger == nil {
+		return
+	}
+
+	item := &models.UserFileItem{
+		UserID:     userID,
+		Category:   category,
+		GroupIndex: index,
+		URL:        url,
+		LastError:  downloadErr.Error(),
+		ErrorClass: ErrorClass(downloadErr),
+		Permanent:  IsPermanent(downloadErr),
+	}
+	if err := d.Ledger.RecordFailure(item); err != nil {
+		log.Printf("Ошибка записи ошибки скачивания %s в журнал: %v", url, err)
+	}
+}
+
+// HeadSize запрашивает размер файла запросом HEAD без скачивания.
+// Возвращает -1, если сервер не сообщил Content-Length.
+func (d *Downloader) HeadSize(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err != nil {
-		return ".bin"
+		return 0, &DownloadError{URL: url, Class: ErrorClassBadURL, Permanent: true, Err: err}
 	}
-	defer resp.Body.Close()
 
-	contentType := resp.Header.Get("Content-Type")
+	resp, err := d.do(req)
+	if err != nil {
+		return 0, requestError(url, err)
+	}
+	resp.Body.Close()
 
-	switch {
-	case strings.Contains(contentType, "image/jpeg"):
-		return ".jpg"
-	case strings.Contains(contentType, "image/png"):
-		return ".png"
-	case strings.Contains(contentType, "image/gif"):
-		return ".gif"
-	case strings.Contains(contentType, "application/pdf"):
-		return ".pdf"
-	case strings.Contains(contentType, "image/webp"):
-		return ".webp"
-	default:
-		return ".bin"
+	if resp.StatusCode >= 400 {
+		return 0, httpError(url, resp)
 	}
+	return resp.ContentLength, nil
 }
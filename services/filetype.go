@@ -0,0 +1,174 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultExtension расширение для файлов, тип которых определить не удалось
+const defaultExtension = ".bin"
+
+// contentTypeExtensions расширения для известных MIME-типов
+var contentTypeExtensions = map[string]string{
+	"image/jpeg":                   ".jpg",
+	"image/pjpeg":                  ".jpg",
+	"image/png":                    ".png",
+	"image/gif":                    ".gif",
+	"image/webp":                   ".webp",
+	"image/heic":                   ".heic",
+	"image/heic-sequence":          ".heic",
+	"image/heif":                   ".heif",
+	"image/heif-sequence":          ".heif",
+	"image/avif":                   ".avif",
+	"image/tiff":                   ".tiff",
+	"image/bmp":                    ".bmp",
+	"image/x-ms-bmp":               ".bmp",
+	"image/svg+xml":                ".svg",
+	"application/pdf":              ".pdf",
+	"application/zip":              ".zip",
+	"application/x-zip-compressed": ".zip",
+	"application/msword":           ".doc",
+	"application/vnd.ms-excel":     ".xls",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/rtf": ".rtf",
+	"text/plain":      ".txt",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+}
+
+// safeExtension допустимое расширение из имени файла
+var safeExtension = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// detectExtension определяет расширение скачанного файла без дополнительных запросов:
+// сначала по имени из Content-Disposition, затем по Content-Type, затем по первым байтам файла.
+func detectExtension(header http.Header, path string) string {
+	if ext := extensionFromDisposition(header.Get("Content-Disposition")); ext != "" {
+		return ext
+	}
+
+	if ext := extensionFromContentType(header.Get("Content-Type")); ext != "" {
+		if ext == ".zip" {
+			return zipExtension(path)
+		}
+		return ext
+	}
+
+	return sniffExtension(path)
+}
+
+// extensionFromDisposition берёт расширение из filename в Content-Disposition
+func extensionFromDisposition(value string) string {
+	if value == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ""
+	}
+
+	ext := strings.ToLower(filepath.Ext(params["filename"]))
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	if !safeExtension.MatchString(ext) {
+		return ""
+	}
+	return ext
+}
+
+// extensionFromContentType возвращает расширение для конкретного MIME-типа.
+// Общие типы (application/octet-stream) не дают расширения - их нужно распознать по содержимому.
+func extensionFromContentType(value string) string {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ""
+	}
+	return contentTypeExtensions[strings.ToLower(mediaType)]
+}
+
+// sniffExtension распознаёт тип по сигнатуре в начале файла
+func sniffExtension(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return defaultExtension
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	head = head[:n]
+
+	switch {
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return isoMediaExtension(string(head[8:12]))
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return ".tiff"
+	case bytes.HasPrefix(head, []byte("BM")) && len(head) >= 14:
+		return ".bmp"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return zipExtension(path)
+	case bytes.HasPrefix(head, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")):
+		return ".doc"
+	case bytes.HasPrefix(head, []byte("{\\rtf")):
+		return ".rtf"
+	}
+
+	if ext := extensionFromContentType(http.DetectContentType(head)); ext != "" {
+		return ext
+	}
+	return defaultExtension
+}
+
+// isoMediaExtension различает HEIC/AVIF/MP4 по бренду контейнера ISO BMFF
+func isoMediaExtension(brand string) string {
+	switch brand {
+	case "heic", "heix", "hevc", "hevx", "heim", "heis":
+		return ".heic"
+	case "mif1", "msf1":
+		return ".heif"
+	case "avif", "avis":
+		return ".avif"
+	case "qt  ":
+		return ".mov"
+	default:
+		return ".mp4"
+	}
+}
+
+// zipExtension отличает документы Office Open XML и OpenDocument от обычного ZIP
+func zipExtension(path string) string {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return ".zip"
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		switch {
+		case strings.HasPrefix(f.Name, "word/"):
+			return ".docx"
+		case strings.HasPrefix(f.Name, "xl/"):
+			return ".xlsx"
+		case strings.HasPrefix(f.Name, "ppt/"):
+			return ".pptx"
+		case f.Name == "mimetype":
+			if rc, err := f.Open(); err == nil {
+				data, _ := io.ReadAll(io.LimitReader(rc, 100))
+				rc.Close()
+				if string(data) == "application/vnd.oasis.opendocument.text" {
+					return ".odt"
+				}
+			}
+		}
+	}
+	return ".zip"
+}
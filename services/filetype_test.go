@@ -0,0 +1,113 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// zipContent архив с файлами names (содержимое - имя файла)
+func zipContent(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(name))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// odtContent архив OpenDocument: тип документа записан в файле mimetype
+func odtContent(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create("mimetype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("application/vnd.oasis.opendocument.text"))
+	if _, err := w.Create("content.xml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectExtension(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	ftyp := func(brand string) []byte {
+		return append([]byte("\x00\x00\x00\x18ftyp"+brand), make([]byte, 16)...)
+	}
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		content []byte
+		want    string
+	}{
+		// Заголовки ответа
+		{name: "имя из Content-Disposition", header: map[string]string{"Content-Disposition": `attachment; filename="scan.PDF"`, "Content-Type": "image/png"}, content: png, want: ".pdf"},
+		{name: ".JPEG в Content-Disposition", header: map[string]string{"Content-Disposition": `attachment; filename="photo.JPEG"`}, content: png, want: ".jpg"},
+		{name: "кириллица в имени", header: map[string]string{"Content-Disposition": `attachment; filename*=UTF-8''%D0%BF%D0%B0%D1%81%D0%BF%D0%BE%D1%80%D1%82.docx`}, want: ".docx"},
+		{name: "небезопасное расширение", header: map[string]string{"Content-Disposition": `attachment; filename="report.ph p"`, "Content-Type": "image/png"}, want: ".png"},
+		{name: "слишком длинное расширение", header: map[string]string{"Content-Disposition": `attachment; filename="x.abcdefghijk"`}, content: png, want: ".png"},
+		{name: "без расширения в имени", header: map[string]string{"Content-Disposition": `attachment; filename="README"`}, content: png, want: ".png"},
+		{name: "Content-Type с параметрами", header: map[string]string{"Content-Type": "Image/JPEG; charset=binary"}, want: ".jpg"},
+		{name: "Content-Type zip с документом", header: map[string]string{"Content-Type": "application/zip"}, content: zipContent(t, "[Content_Types].xml", "word/document.xml"), want: ".docx"},
+		{name: "octet-stream определяется по содержимому", header: map[string]string{"Content-Type": "application/octet-stream"}, content: png, want: ".png"},
+
+		// Сигнатуры содержимого
+		{name: "HEIC", content: ftyp("heic"), want: ".heic"},
+		{name: "HEIF", content: ftyp("mif1"), want: ".heif"},
+		{name: "AVIF", content: ftyp("avif"), want: ".avif"},
+		{name: "MOV", content: ftyp("qt  "), want: ".mov"},
+		{name: "MP4", content: ftyp("isom"), want: ".mp4"},
+		{name: "TIFF little-endian", content: []byte("II*\x00\x08\x00\x00\x00"), want: ".tiff"},
+		{name: "TIFF big-endian", content: []byte("MM\x00*\x00\x00\x00\x08"), want: ".tiff"},
+		{name: "BMP", content: append([]byte("BM"), make([]byte, 52)...), want: ".bmp"},
+		{name: "PDF", content: []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"), want: ".pdf"},
+		{name: "PNG", content: png, want: ".png"},
+		{name: "JPEG", content: []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), want: ".jpg"},
+		{name: "DOCX", content: zipContent(t, "[Content_Types].xml", "word/document.xml"), want: ".docx"},
+		{name: "XLSX", content: zipContent(t, "[Content_Types].xml", "xl/workbook.xml"), want: ".xlsx"},
+		{name: "PPTX", content: zipContent(t, "[Content_Types].xml", "ppt/presentation.xml"), want: ".pptx"},
+		{name: "ODT", content: odtContent(t), want: ".odt"},
+		{name: "обычный ZIP", content: zipContent(t, "scan1.jpg", "scan2.jpg"), want: ".zip"},
+		{name: "DOC", content: append([]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), make([]byte, 8)...), want: ".doc"},
+		{name: "RTF", content: []byte(`{\rtf1\ansi Hello}`), want: ".rtf"},
+		{name: "неизвестное содержимое", content: []byte("\x00\x01\x02\x03\x04\x05"), want: defaultExtension},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := filepath.Join(dir, strconv.Itoa(i)+".tmp")
+		if err := os.WriteFile(path, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		header := http.Header{}
+		for name, value := range tt.header {
+			header.Set(name, value)
+		}
+
+		if got := detectExtension(header, path); got != tt.want {
+			t.Errorf("%s: detectExtension = %s, ожидалось %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Файл не прочитан - расширение по умолчанию
+	if got := detectExtension(http.Header{}, filepath.Join(dir, "missing.tmp")); got != defaultExtension {
+		t.Errorf("отсутствующий файл: detectExtension = %s, ожидалось %s", got, defaultExtension)
+	}
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"up-down/models"
+	"up-down/repositories"
+)
+
+// JobSpec фильтры запуска скачивания. Пустой JobSpec - все пользователи с файлами.
+// Фильтры объединяются по И.
+type JobSpec struct {
+	Citizenships []string   `json:"citizenships,omitempty"`  // значения колонки группы (citizenship_id)
+	IDFrom       int64      `json:"id_from,omitempty"`       // id >= id_from
+	IDTo         int64      `json:"id_to,omitempty"`         // id <= id_to
+	IDs          []int64    `json:"ids,omitempty"`           // явный список id
+	CreatedAfter *time.Time `json:"created_after,omitempty"` // RFC3339, нужен SOURCE_CREATED_COLUMN
+	OnlyFailed   bool       `json:"only_failed,omitempty"`   // повтор ошибок: только пользователи с записанной ошибкой скачивания
+	ErrorClasses []string   `json:"error_classes,omitempty"` // классы ошибок для only_failed (http_404, timeout, ...)
+	OnlyMissing  bool       `json:"only_missing,omitempty"`  // только пользователи с нескачанными категориями
+}
+
+// Validate проверяет согласованность фильтров
+func (s *JobSpec) Validate(createdColumn string) error {
+	if s.IDFrom < 0 || s.IDTo < 0 {
+		return fmt.Errorf("id_from и id_to не могут быть отрицательными")
+	}
+	if s.IDFrom > 0 && s.IDTo > 0 && s.IDFrom > s.IDTo {
+		return fmt.Errorf("id_from (%d) больше id_to (%d)", s.IDFrom, s.IDTo)
+	}
+	for _, citizenship := range s.Citizenships {
+		if strings.TrimSpace(citizenship) == "" {
+			return fmt.Errorf("пустое значение в citizenships")
+		}
+	}
+	if len(s.ErrorClasses) > 0 && !s.OnlyFailed {
+		return fmt.Errorf("error_classes используется только с only_failed")
+	}
+	for _, class := range s.ErrorClasses {
+		if !IsErrorClass(class) {
+			return fmt.Errorf("неизвестный класс ошибки: %q", class)
+		}
+	}
+	if s.CreatedAfter != nil && createdColumn == "" {
+		return fmt.Errorf("created_after требует SOURCE_CREATED_COLUMN")
+	}
+	return nil
+}
+
+// IsEmpty проверяет, что фильтры не заданы
+func (s *JobSpec) IsEmpty() bool {
+	return len(s.Citizenships) == 0 && s.IDFrom == 0 && s.IDTo == 0 && len(s.IDs) == 0 &&
+		s.CreatedAfter == nil && !s.OnlyFailed && !s.OnlyMissing
+}
+
+// String описание фильтров для лога
+func (s *JobSpec) String() string {
+	if s.IsEmpty() {
+		return "все пользователи"
+	}
+
+	parts := make([]string, 0)
+	if len(s.Citizenships) > 0 {
+		parts = append(parts, "citizenships="+strings.Join(s.Citizenships, ","))
+	}
+	if s.IDFrom > 0 || s.IDTo > 0 {
+		parts = append(parts, fmt.Sprintf("id=%d..%d", s.IDFrom, s.IDTo))
+	}
+	if len(s.IDs) > 0 {
+		parts = append(parts, fmt.Sprintf("ids=%d шт.", len(s.IDs)))
+	}
+	if s.CreatedAfter != nil {
+		parts = append(parts, "created_after="+s.CreatedAfter.Format(time.RFC3339))
+	}
+	if s.OnlyFailed {
+		if len(s.ErrorClasses) > 0 {
+			parts = append(parts, "only_failed="+strings.Join(s.ErrorClasses, ","))
+		} else {
+			parts = append(parts, "only_failed")
+		}
+	}
+	if s.OnlyMissing {
+		parts = append(parts, "only_missing")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// resolveFilter превращает JobSpec в фильтр запроса пользователей.
+// only_failed зависит от журнала в БД логирования и сводится к явному списку id;
+// only_missing проверяется по пачкам при обходе пользователей (filterMissing).
+func (dm *DownloadManager) resolveFilter(spec JobSpec) (repositories.UserFilter, error) {
+	filter := repositories.UserFilter{
+		Groups:       spec.Citizenships,
+		IDFrom:       spec.IDFrom,
+		IDTo:         spec.IDTo,
+		CreatedAfter: spec.CreatedAfter,
+	}
+	if len(spec.IDs) > 0 {
+		filter.IDs = spec.IDs
+	}
+
+	if spec.OnlyFailed {
+		// Без фильтра по классам постоянные ошибки не повторяются; явно указанные классы повторяются всегда
+		failed, err := dm.userFileRepo.GetFailedUserIDs(repositories.FailureFilter{
+			Classes:          spec.ErrorClasses,
+			IncludePermanent: len(spec.ErrorClasses) > 0,
+		})
+		if err != nil {
+			return filter, fmt.Errorf("ошибка чтения пользователей с ошибками: %w", err)
+		}
+		filter.IDs = intersectIDs(filter.IDs, failed)
+	}
+
+	return filter, nil
+}
+
+// filterMissing оставляет пользователей пачки, у которых есть ссылки в нескачанных категориях (only_missing).
+// Статусы читаются одним запросом на пачку.
+func (dm *DownloadManager) filterMissing(users []*models.User) ([]*models.User, error) {
+	ids := make([]int64, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+
+	statuses, err := dm.userFileRepo.GetByUserIDs(ids)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения статусов: %w", err)
+	}
+
+	missing := make([]*models.User, 0, len(users))
+	for _, user := range users {
+		for _, category := range dm.layout.Categories() {
+			if user.HasFiles(category.Name) && !statuses[user.ID][category.Name] {
+				missing = append(missing, user)
+				break
+			}
+		}
+	}
+	return missing, nil
+}
+
+// retryPermanent проверяет, что постоянную ошибку категории нужно повторить:
+// задание повторяет ошибки (only_failed) и класс ошибки категории указан в error_classes явно
+func (dm *DownloadManager) retryPermanent(spec JobSpec, userID int64, category string) bool {
+	if !spec.OnlyFailed || len(spec.ErrorClasses) == 0 {
+		return false
+	}
+
+	failure, err := dm.userFileRepo.GetFailure(userID, category)
+	if err != nil {
+		log.Printf("Ошибка чтения причины ошибки пользователя %d: %v", userID, err)
+		return false
+	}
+	if failure == nil {
+		return false
+	}
+	for _, class := range spec.ErrorClasses {
+		if class == failure.ErrorClass {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectIDs пересечение списков id; nil в ids означает "без ограничения"
+func intersectIDs(ids []int64, allowed []int64) []int64 {
+	if ids == nil {
+		return allowed
+	}
+
+	set := make(map[int64]bool, len(allowed))
+	for _, id := range allowed {
+		set[id] = true
+	}
+	result := make([]int64, 0)
+	for _, id := range ids {
+		if set[id] {
+			result = append(result, id)
+		}
+	}
+	return result
+}
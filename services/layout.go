@@ -0,0 +1,297 @@
+package services
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"up-down/config"
+	"up-down/models"
+)
+
+// Шаблоны раскладки по умолчанию: {citizenship_id}/user_{id}/{dir категории}/{prefix}_{n}{ext}
+const (
+	DefaultDirLayout        = "{group}/user_{id}"
+	DefaultFileNameTemplate = "{prefix}_{n}"
+)
+
+// maxSegmentLength ограничение длины значения поля в пути (в символах)
+const maxSegmentLength = 64
+
+// unknownValue подставляется вместо пустого поля пользователя
+const unknownValue = "unknown"
+
+var placeholderRe = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// createdFormats поля с датой создания пользователя и их формат
+var createdFormats = map[string]string{
+	"created_date":  "2006-01-02",
+	"created_year":  "2006",
+	"created_month": "01",
+	"created_day":   "02",
+}
+
+// fileFields поля, доступные только в шаблоне имени файла.
+// {original} - исходное имя файла без расширения, если его сообщил источник, иначе {prefix}_{n}.
+var fileFields = map[string]bool{"category": true, "prefix": true, "n": true, "original": true}
+
+// userFields поля пользователя, доступные в шаблонах и в данных пользователя (METADATA_FIELDS):
+// {id}, группа ({group}, {citizenship} и имя колонки группы - {citizenship_id}), колонки SOURCE_META_COLUMNS
+// и {created_date}, {created_year}, {created_month}, {created_day}, если задана SOURCE_CREATED_COLUMN
+type userFields struct {
+	group   string
+	meta    map[string]bool
+	created bool
+}
+
+func newUserFields(source *config.SourceConfig) *userFields {
+	meta := make(map[string]bool, len(source.MetaColumns))
+	for _, mapping := range source.MetaColumns {
+		meta[mapping.Name] = true
+	}
+	return &userFields{
+		group:   source.GroupColumn,
+		meta:    meta,
+		created: source.CreatedColumn != "",
+	}
+}
+
+// has проверяет, есть ли поле с таким именем
+func (f *userFields) has(name string) bool {
+	switch {
+	case name == "id" || name == "group" || name == "citizenship" || name == f.group:
+		return true
+	case f.meta[name]:
+		return true
+	}
+	_, ok := createdFormats[name]
+	return ok && f.created
+}
+
+// value значение поля пользователя (пустая строка, если значения нет)
+func (f *userFields) value(user *models.User, name string) string {
+	switch {
+	case name == "id":
+		return strconv.FormatInt(user.ID, 10)
+	case name == "group" || name == "citizenship" || name == f.group:
+		return user.Group.String
+	case f.meta[name]:
+		return user.Meta[name]
+	}
+	if format, ok := createdFormats[name]; ok && user.CreatedAt.Valid {
+		return user.CreatedAt.Time.Format(format)
+	}
+	return ""
+}
+
+// Layout раскладка файлов в хранилище по шаблонам DIR_LAYOUT и FILE_NAME_TEMPLATE.
+// Шаблоны состоят из текста и полей в фигурных скобках: {citizenship_id}/{last_name}_{first_name}_{id}.
+type Layout struct {
+	fields       *userFields
+	categories   []config.FileCategory
+	byName       map[string]config.FileCategory
+	dirTemplate  string
+	fileTemplate string
+	depth        int
+	dirRe        *regexp.Regexp
+}
+
+func NewLayout(cfg *config.Config) (*Layout, error) {
+	fields := newUserFields(&cfg.Source)
+
+	dirTemplate := strings.Trim(cfg.Download.DirLayout, "/")
+	if dirTemplate == "" {
+		dirTemplate = DefaultDirLayout
+	}
+	fileTemplate := cfg.Download.FileNameTemplate
+	if fileTemplate == "" {
+		fileTemplate = DefaultFileNameTemplate
+	}
+
+	// Проверяем шаблон директории
+	if !strings.Contains(dirTemplate, "{id}") {
+		return nil, fmt.Errorf("DIR_LAYOUT должен содержать {id}: %s", dirTemplate)
+	}
+	for _, segment := range strings.Split(dirTemplate, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("недопустимый сегмент в DIR_LAYOUT: %s", dirTemplate)
+		}
+	}
+	for _, match := range placeholderRe.FindAllStringSubmatch(dirTemplate, -1) {
+		if !fields.has(match[1]) {
+			return nil, fmt.Errorf("неизвестное поле {%s} в DIR_LAYOUT", match[1])
+		}
+	}
+
+	// Проверяем шаблон имени файла
+	if strings.ContainsAny(fileTemplate, `/\`) {
+		return nil, fmt.Errorf("FILE_NAME_TEMPLATE не может содержать разделители пути: %s", fileTemplate)
+	}
+	if !strings.Contains(fileTemplate, "{n}") {
+		return nil, fmt.Errorf("FILE_NAME_TEMPLATE должен содержать {n}: %s", fileTemplate)
+	}
+	for _, match := range placeholderRe.FindAllStringSubmatch(fileTemplate, -1) {
+		if !fields.has(match[1]) && !fileFields[match[1]] {
+			return nil, fmt.Errorf("неизвестное поле {%s} в FILE_NAME_TEMPLATE", match[1])
+		}
+	}
+
+	byName := make(map[string]config.FileCategory, len(cfg.Source.Categories))
+	for _, category := range cfg.Source.Categories {
+		byName[category.Name] = category
+	}
+
+	return &Layout{
+		fields:       fields,
+		categories:   cfg.Source.Categories,
+		byName:       byName,
+		dirTemplate:  dirTemplate,
+		fileTemplate: fileTemplate,
+		depth:        strings.Count(dirTemplate, "/") + 1,
+		dirRe:        buildDirRegexp(dirTemplate),
+	}, nil
+}
+
+// buildDirRegexp строит регулярное выражение, извлекающее id пользователя из пути
+func buildDirRegexp(dirTemplate string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+
+	idCaptured := false
+	last := 0
+	for _, loc := range placeholderRe.FindAllStringSubmatchIndex(dirTemplate, -1) {
+		b.WriteString(regexp.QuoteMeta(dirTemplate[last:loc[0]]))
+		switch name := dirTemplate[loc[2]:loc[3]]; {
+		case name == "id" && !idCaptured:
+			b.WriteString(`(\d+)`)
+			idCaptured = true
+		case name == "id":
+			b.WriteString(`\d+`)
+		default:
+			b.WriteString(`[^/]+`)
+		}
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(dirTemplate[last:]))
+	b.WriteString("$")
+
+	return regexp.MustCompile(b.String())
+}
+
+// Depth количество уровней директорий в пути пользователя
+func (l *Layout) Depth() int {
+	return l.depth
+}
+
+// UserKey префикс файлов пользователя в хранилище
+func (l *Layout) UserKey(user *models.User) string {
+	return l.expand(l.dirTemplate, user, nil)
+}
+
+// Categories категории файлов в порядке настроек
+func (l *Layout) Categories() []config.FileCategory {
+	return l.categories
+}
+
+// category настройки категории по имени; для неизвестной категории директория и префикс совпадают с именем
+func (l *Layout) category(name string) config.FileCategory {
+	if category, ok := l.byName[name]; ok {
+		return category
+	}
+	return config.FileCategory{Name: name, Dir: sanitizeSegment(name), Prefix: name}
+}
+
+// CategoryKey префикс файлов категории пользователя: {UserKey}/documents
+func (l *Layout) CategoryKey(user *models.User, category string) string {
+	return path.Join(l.UserKey(user), l.category(category).Dir)
+}
+
+// FileKey ключ n-го файла категории без расширения. original - исходное имя файла (пусто - неизвестно).
+func (l *Layout) FileKey(user *models.User, category string, n int, original string) string {
+	prefix := l.category(category).Prefix
+	original = strings.TrimSuffix(path.Base(strings.ReplaceAll(original, `\`, "/")), path.Ext(original))
+	if original == "" || original == "." || original == "/" {
+		original = fmt.Sprintf("%s_%d", prefix, n)
+	}
+
+	name := l.expand(l.fileTemplate, user, map[string]string{
+		"category": category,
+		"prefix":   prefix,
+		"n":        strconv.Itoa(n),
+		"original": original,
+	})
+	return path.Join(l.CategoryKey(user, category), name)
+}
+
+// ParseUserKey находит в ключе объекта (или пути директории) префикс пользователя и его id
+func (l *Layout) ParseUserKey(key string) (userID int64, userKey string, ok bool) {
+	segments := strings.SplitN(key, "/", l.depth+1)
+	if len(segments) < l.depth {
+		return 0, "", false
+	}
+	for _, segment := range segments[:l.depth] {
+		// Служебные директории (.objects и т.п.) не принадлежат пользователям
+		if strings.HasPrefix(segment, ".") {
+			return 0, "", false
+		}
+	}
+
+	userKey = strings.Join(segments[:l.depth], "/")
+	matches := l.dirRe.FindStringSubmatch(userKey)
+	if matches == nil {
+		return 0, "", false
+	}
+	userID, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return userID, userKey, true
+}
+
+// expand подставляет в шаблон очищенные значения полей
+func (l *Layout) expand(template string, user *models.User, extra map[string]string) string {
+	return placeholderRe.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if value, ok := extra[name]; ok {
+			return sanitizeSegment(value)
+		}
+		if l.fields.has(name) {
+			return sanitizeSegment(l.fields.value(user, name))
+		}
+		return placeholder
+	})
+}
+
+// sanitizeSegment делает значение безопасным для использования в пути:
+// убирает разделители путей, управляющие и зарезервированные символы, пробелы,
+// ведущие точки (скрытые файлы, "..") и ограничивает длину
+func sanitizeSegment(value string) string {
+	var b strings.Builder
+	lastUnderscore := false
+	for _, r := range value {
+		if r == utf8.RuneError || unicode.IsControl(r) || unicode.IsSpace(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			r = '_'
+		}
+		if r == '_' {
+			if lastUnderscore {
+				continue
+			}
+			lastUnderscore = true
+		} else {
+			lastUnderscore = false
+		}
+		b.WriteRune(r)
+	}
+
+	result := strings.Trim(b.String(), "._ ")
+	if utf8.RuneCountInString(result) > maxSegmentLength {
+		result = strings.TrimRight(string([]rune(result)[:maxSegmentLength]), "._ ")
+	}
+	if result == "" {
+		return unknownValue
+	}
+	return result
+}
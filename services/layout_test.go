@@ -0,0 +1,194 @@
+package services
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+	"up-down/config"
+	"up-down/models"
+)
+
+func TestSanitizeSegment(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "RU", want: "RU"},
+		{value: "Иванов", want: "Иванов"},
+		{value: "Иван Петрович", want: "Иван_Петрович"},
+		{value: "..", want: "unknown"},
+		{value: "../../etc/passwd", want: "etc_passwd"},
+		{value: `..\..\windows`, want: "windows"},
+		{value: ".hidden", want: "hidden"},
+		{value: "a/b\\c:d*e?f\"g<h>i|j", want: "a_b_c_d_e_f_g_h_i_j"},
+		{value: "a \t\n b", want: "a_b"},
+		{value: "line\x00break\x1f", want: "line_break"},
+		{value: "bad\xffutf8", want: "bad_utf8"},
+		{value: "  __trim__  ", want: "trim"},
+		{value: "", want: "unknown"},
+		{value: "   ", want: "unknown"},
+		{value: strings.Repeat("я", 70), want: strings.Repeat("я", 64)},
+		{value: strings.Repeat("a", 63) + " b", want: strings.Repeat("a", 63)},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeSegment(tt.value); got != tt.want {
+			t.Errorf("sanitizeSegment(%q) = %q, ожидалось %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLayoutKeys(t *testing.T) {
+	categories := []config.FileCategory{{Name: "document", Column: "document", Dir: "documents", Prefix: "document"}}
+	user := &models.User{
+		ID:        42,
+		Group:     sql.NullString{String: "RU", Valid: true},
+		Meta:      map[string]string{"last_name": "../Иванов", "first_name": "Иван"},
+		CreatedAt: sql.NullTime{Time: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC), Valid: true},
+	}
+
+	tests := []struct {
+		name     string
+		download config.DownloadConfig
+		userKey  string
+		fileKey  string // ключ первого файла категории document с исходным именем "Паспорт.pdf"
+	}{
+		{
+			name:    "по умолчанию",
+			userKey: "RU/user_42",
+			fileKey: "RU/user_42/documents/document_1",
+		},
+		{
+			name:     "поля пользователя и дата",
+			download: config.DownloadConfig{DirLayout: "/{created_year}/{citizenship_id}/{last_name}_{first_name}_{id}/", FileNameTemplate: "{n}_{original}"},
+			userKey:  "2024/RU/Иванов_Иван_42",
+			fileKey:  "2024/RU/Иванов_Иван_42/documents/1_Паспорт",
+		},
+	}
+
+	for _, tt := range tests {
+		layout, err := NewLayout(&config.Config{
+			Download: tt.download,
+			Source: config.SourceConfig{
+				GroupColumn:   "citizenship_id",
+				Categories:    categories,
+				MetaColumns:   []config.ColumnMapping{{Name: "last_name", Column: "last_name"}, {Name: "first_name", Column: "first_name"}},
+				CreatedColumn: "created_at",
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: NewLayout: %v", tt.name, err)
+		}
+
+		if key := layout.UserKey(user); key != tt.userKey {
+			t.Errorf("%s: UserKey = %s, ожидалось %s", tt.name, key, tt.userKey)
+		}
+		if key := layout.FileKey(user, "document", 1, "Паспорт.pdf"); key != tt.fileKey {
+			t.Errorf("%s: FileKey = %s, ожидалось %s", tt.name, key, tt.fileKey)
+		}
+
+		// Ключ пользователя разбирается обратно
+		id, userKey, ok := layout.ParseUserKey(tt.fileKey + ".pdf")
+		if !ok || id != user.ID || userKey != tt.userKey {
+			t.Errorf("%s: ParseUserKey = %d, %s, %v, ожидалось %d, %s", tt.name, id, userKey, ok, user.ID, tt.userKey)
+		}
+	}
+}
+
+func TestLayoutFileKeyOriginal(t *testing.T) {
+	layout, err := NewLayout(&config.Config{
+		Download: config.DownloadConfig{FileNameTemplate: "{n}_{original}"},
+		Source:   config.SourceConfig{GroupColumn: "citizenship_id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: 7}
+
+	tests := []struct {
+		original string
+		want     string
+	}{
+		{original: "", want: "unknown/user_7/photo/1_photo_1"},
+		{original: "scan.final.jpg", want: "unknown/user_7/photo/1_scan.final"},
+		{original: "../../etc/passwd", want: "unknown/user_7/photo/1_passwd"},
+		{original: `C:\Users\Документ.docx`, want: "unknown/user_7/photo/1_Документ"},
+		{original: "/", want: "unknown/user_7/photo/1_photo_1"},
+	}
+
+	for _, tt := range tests {
+		// Категория не настроена: директория и префикс совпадают с именем
+		if got := layout.FileKey(user, "photo", 1, tt.original); got != tt.want {
+			t.Errorf("FileKey(%q) = %s, ожидалось %s", tt.original, got, tt.want)
+		}
+	}
+}
+
+func TestLayoutParseUserKey(t *testing.T) {
+	newLayout := func(dirLayout string) *Layout {
+		layout, err := NewLayout(&config.Config{
+			Download: config.DownloadConfig{DirLayout: dirLayout},
+			Source: config.SourceConfig{
+				GroupColumn: "citizenship_id",
+				MetaColumns: []config.ColumnMapping{{Name: "last_name", Column: "last_name"}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return layout
+	}
+	defaultLayout := newLayout("")
+	customLayout := newLayout("{last_name}_{id}/files")
+
+	tests := []struct {
+		name    string
+		layout  *Layout
+		key     string
+		wantID  int64
+		wantKey string
+		wantOK  bool
+	}{
+		{name: "файл пользователя", layout: defaultLayout, key: "RU/user_42/documents/document_1.pdf", wantID: 42, wantKey: "RU/user_42", wantOK: true},
+		{name: "директория пользователя", layout: defaultLayout, key: "RU/user_42", wantID: 42, wantKey: "RU/user_42", wantOK: true},
+		{name: "служебная директория", layout: defaultLayout, key: ".objects/ab/abcdef", wantOK: false},
+		{name: "служебный файл в группе", layout: defaultLayout, key: "RU/.index/part-1.csv", wantOK: false},
+		{name: "мало сегментов", layout: defaultLayout, key: "RU", wantOK: false},
+		{name: "не подходит под шаблон", layout: defaultLayout, key: "RU/admin/file.txt", wantOK: false},
+		{name: "id не число", layout: defaultLayout, key: "RU/user_x/file.txt", wantOK: false},
+		{name: "id вне диапазона", layout: defaultLayout, key: "RU/user_99999999999999999999/file.txt", wantOK: false},
+		{name: "свой шаблон", layout: customLayout, key: "Иванов_7/files/documents/document_1.jpg", wantID: 7, wantKey: "Иванов_7/files", wantOK: true},
+		{name: "свой шаблон, другая директория", layout: customLayout, key: "Иванов_7/other/document_1.jpg", wantOK: false},
+		{name: "свой шаблон, имя с подчёркиванием", layout: customLayout, key: "ван_дер_Берг_15/files", wantID: 15, wantKey: "ван_дер_Берг_15/files", wantOK: true},
+	}
+
+	for _, tt := range tests {
+		id, userKey, ok := tt.layout.ParseUserKey(tt.key)
+		if ok != tt.wantOK || id != tt.wantID || userKey != tt.wantKey {
+			t.Errorf("%s: ParseUserKey(%q) = %d, %q, %v, ожидалось %d, %q, %v",
+				tt.name, tt.key, id, userKey, ok, tt.wantID, tt.wantKey, tt.wantOK)
+		}
+	}
+}
+
+func TestNewLayoutErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		download config.DownloadConfig
+	}{
+		{name: "нет {id}", download: config.DownloadConfig{DirLayout: "{group}/user"}},
+		{name: "сегмент ..", download: config.DownloadConfig{DirLayout: "../{id}"}},
+		{name: "пустой сегмент", download: config.DownloadConfig{DirLayout: "{group}//{id}"}},
+		{name: "неизвестное поле директории", download: config.DownloadConfig{DirLayout: "{phone}/{id}"}},
+		{name: "разделитель в имени файла", download: config.DownloadConfig{FileNameTemplate: "{category}/{n}"}},
+		{name: "нет {n}", download: config.DownloadConfig{FileNameTemplate: "{prefix}"}},
+		{name: "дата без колонки", download: config.DownloadConfig{DirLayout: "{created_year}/{id}"}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewLayout(&config.Config{Download: tt.download, Source: config.SourceConfig{GroupColumn: "citizenship_id"}}); err == nil {
+			t.Errorf("%s: ожидалась ошибка", tt.name)
+		}
+	}
+}
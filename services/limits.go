@@ -0,0 +1,214 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"up-down/config"
+)
+
+// UserBudget ограничение суммарного размера файлов одного пользователя (DOWNLOAD_MAX_USER_SIZE).
+// Общее для всех категорий и параллельно скачиваемых файлов пользователя; nil - без ограничения.
+type UserBudget struct {
+	limit int64
+	used  int64
+}
+
+func NewUserBudget(limit int64) *UserBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &UserBudget{limit: limit}
+}
+
+// Add учитывает уже скачанные файлы пользователя без проверки ограничения
+func (b *UserBudget) Add(n int64) {
+	if b != nil {
+		atomic.AddInt64(&b.used, n)
+	}
+}
+
+// reserve занимает n байт, если они помещаются в ограничение
+func (b *UserBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used+n > b.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+// release возвращает байты файла, который не удалось скачать
+func (b *UserBudget) release(n int64) {
+	if b != nil && n > 0 {
+		atomic.AddInt64(&b.used, -n)
+	}
+}
+
+// remaining сколько байт ещё можно скачать (-1 - без ограничения)
+func (b *UserBudget) remaining() int64 {
+	if b == nil {
+		return -1
+	}
+	return b.limit - atomic.LoadInt64(&b.used)
+}
+
+// limitClasses классы нарушений ограничений. Они зависят от настроек, а не от файла: в попытке
+// скачивания не повторяются, но и постоянными не считаются - после изменения ограничений
+// файлы скачиваются в следующем задании.
+var limitClasses = []string{ErrorClassTooLarge, ErrorClassUserQuota, ErrorClassContentType}
+
+// isLimitError проверяет, что ошибка - нарушение ограничения
+func isLimitError(err error) bool {
+	var de *DownloadError
+	if !errors.As(err, &de) {
+		return false
+	}
+	for _, class := range limitClasses {
+		if de.Class == class {
+			return true
+		}
+	}
+	return false
+}
+
+// tooLargeError файл больше DOWNLOAD_MAX_FILE_SIZE
+func tooLargeError(url string, size, limit int64) *DownloadError {
+	return &DownloadError{URL: url, Class: ErrorClassTooLarge,
+		Err: fmt.Errorf("размер файла %s больше DOWNLOAD_MAX_FILE_SIZE=%s", config.FormatSize(size), config.FormatSize(limit))}
+}
+
+// userQuotaError файл не помещается в DOWNLOAD_MAX_USER_SIZE
+func userQuotaError(url string, limit int64) *DownloadError {
+	return &DownloadError{URL: url, Class: ErrorClassUserQuota,
+		Err: fmt.Errorf("превышен суммарный размер файлов пользователя DOWNLOAD_MAX_USER_SIZE=%s", config.FormatSize(limit))}
+}
+
+// contentTypeError тип файла не разрешён DOWNLOAD_ALLOWED_CONTENT_TYPES
+func contentTypeError(url, mediaType string) *DownloadError {
+	return &DownloadError{URL: url, Class: ErrorClassContentType,
+		Err: fmt.Errorf("тип файла %s не разрешён DOWNLOAD_ALLOWED_CONTENT_TYPES", mediaType)}
+}
+
+// contentTypeAllowed проверяет MIME тип по списку разрешённых: точное совпадение, image/* или */*.
+// Пустой список разрешает любые типы.
+func contentTypeAllowed(allowed []string, mediaType string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaType = strings.ToLower(mediaType)
+	for _, pattern := range allowed {
+		switch {
+		case pattern == "*/*" || pattern == mediaType:
+			return true
+		case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// headerMediaType MIME тип из Content-Type без параметров. Пустая строка, если тип не указан
+// или общий (application/octet-stream) - тогда он определяется по содержимому.
+func headerMediaType(header http.Header) string {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	mediaType = strings.ToLower(mediaType)
+	if mediaType == "application/octet-stream" || mediaType == "binary/octet-stream" {
+		return ""
+	}
+	return mediaType
+}
+
+// extensionMediaType MIME тип по расширению, определённому detectExtension
+func extensionMediaType(ext string) string {
+	if byExt := mime.TypeByExtension(ext); byExt != "" {
+		if mediaType, _, err := mime.ParseMediaType(byExt); err == nil {
+			return mediaType
+		}
+	}
+
+	// Расширения, которых нет в системной таблице (.heic и т.п.)
+	found := ""
+	for mediaType, typeExt := range contentTypeExtensions {
+		if typeExt == ext && (found == "" || mediaType < found) {
+			found = mediaType
+		}
+	}
+	if found == "" {
+		return "application/octet-stream"
+	}
+	return found
+}
+
+// guardedReader прерывает чтение тела ответа, как только файл превысил DOWNLOAD_MAX_FILE_SIZE
+// или перестал помещаться в DOWNLOAD_MAX_USER_SIZE. Прочитанные байты занимаются в budget.
+type guardedReader struct {
+	r       io.Reader
+	url     string
+	maxSize int64
+	budget  *UserBudget
+
+	size     int64 // размер файла с учётом докачанной части
+	reserved int64 // байт, занятых в budget этой попыткой
+}
+
+// start учитывает часть файла, скачанную в прошлых попытках
+func (g *guardedReader) start(offset int64) error {
+	g.size = offset
+	if g.maxSize > 0 && offset > g.maxSize {
+		return tooLargeError(g.url, offset, g.maxSize)
+	}
+	if !g.budget.reserve(offset) {
+		return userQuotaError(g.url, g.budget.limit)
+	}
+	g.reserved = offset
+	return nil
+}
+
+// expect проверяет размер файла из заголовков до начала передачи (-1 - неизвестен)
+func (g *guardedReader) expect(total int64) error {
+	if total < 0 {
+		return nil
+	}
+	if g.maxSize > 0 && total > g.maxSize {
+		return tooLargeError(g.url, total, g.maxSize)
+	}
+	if remaining := g.budget.remaining(); remaining >= 0 && total-g.size > remaining {
+		return userQuotaError(g.url, g.budget.limit)
+	}
+	return nil
+}
+
+func (g *guardedReader) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	if n > 0 {
+		g.size += int64(n)
+		if g.maxSize > 0 && g.size > g.maxSize {
+			return 0, tooLargeError(g.url, g.size, g.maxSize)
+		}
+		if !g.budget.reserve(int64(n)) {
+			return 0, userQuotaError(g.url, g.budget.limit)
+		}
+		g.reserved += int64(n)
+	}
+	return n, err
+}
+
+// release возвращает занятые байты, если файл не сохранён
+func (g *guardedReader) release() {
+	g.budget.release(g.reserved)
+	g.reserved = 0
+}
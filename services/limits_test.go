@@ -0,0 +1,303 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+	"up-down/storage"
+)
+
+func TestContentTypeAllowed(t *testing.T) {
+	tests := []struct {
+		allowed   []string
+		mediaType string
+		want      bool
+	}{
+		{nil, "application/x-msdownload", true},
+		{[]string{"application/pdf"}, "application/pdf", true},
+		{[]string{"application/pdf"}, "Application/PDF", true},
+		{[]string{"application/pdf"}, "application/pdfx", false},
+		{[]string{"image/*"}, "image/heic", true},
+		{[]string{"image/*"}, "image", false},
+		{[]string{"image/*"}, "imagex/png", false},
+		{[]string{"image/*"}, "text/html", false},
+		{[]string{"application/pdf", "image/*"}, "image/png", true},
+		{[]string{"*/*"}, "text/html", true},
+	}
+
+	for _, tt := range tests {
+		if got := contentTypeAllowed(tt.allowed, tt.mediaType); got != tt.want {
+			t.Errorf("contentTypeAllowed(%v, %q) = %v, ожидалось %v", tt.allowed, tt.mediaType, got, tt.want)
+		}
+	}
+}
+
+func TestHeaderMediaType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"", ""},
+		{"Image/JPEG; charset=binary", "image/jpeg"},
+		{"application/octet-stream", ""},
+		{"binary/octet-stream", ""},
+		{"not a type;;", ""},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{"Content-Type": {tt.contentType}}
+		if got := headerMediaType(header); got != tt.want {
+			t.Errorf("headerMediaType(%q) = %q, ожидалось %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestExtensionMediaType(t *testing.T) {
+	tests := []struct {
+		ext  string
+		want string
+	}{
+		{".pdf", "application/pdf"},
+		{".png", "image/png"},
+		{".bin", "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		if got := extensionMediaType(tt.ext); got != tt.want {
+			t.Errorf("extensionMediaType(%s) = %s, ожидалось %s", tt.ext, got, tt.want)
+		}
+	}
+}
+
+func TestUserBudget(t *testing.T) {
+	if budget := NewUserBudget(0); budget != nil {
+		t.Fatalf("NewUserBudget(0) = %+v, ожидалось nil", budget)
+	}
+
+	// nil - без ограничения
+	var unlimited *UserBudget
+	unlimited.Add(100)
+	unlimited.release(100)
+	if !unlimited.reserve(1<<40) || unlimited.remaining() != -1 {
+		t.Error("nil бюджет должен разрешать любой размер")
+	}
+
+	budget := NewUserBudget(100)
+	budget.Add(30)
+	if !budget.reserve(70) {
+		t.Fatal("70 байт должны поместиться в остаток 70")
+	}
+	if budget.reserve(1) {
+		t.Error("бюджет исчерпан, reserve(1) должен вернуть false")
+	}
+	budget.release(50)
+	if remaining := budget.remaining(); remaining != 50 {
+		t.Errorf("остаток %d, ожидалось 50", remaining)
+	}
+
+	// Параллельные файлы пользователя делят один бюджет
+	budget = NewUserBudget(1000)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if budget.reserve(10) {
+					mutex.Lock()
+					reserved += 10
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 1000 || budget.remaining() != 0 {
+		t.Errorf("занято %d, остаток %d, ожидалось 1000 и 0", reserved, budget.remaining())
+	}
+}
+
+func TestGuardedReader(t *testing.T) {
+	const url = "https://example.com/file"
+	content := bytes.Repeat([]byte("x"), 100)
+
+	tests := []struct {
+		name      string
+		maxSize   int64
+		budget    int64 // 0 - без ограничения
+		used      int64 // уже занято в бюджете другими файлами
+		offset    int64 // скачано в прошлых попытках
+		wantClass string
+		wantRead  int64 // байт прочитано до прерывания
+	}{
+		{name: "без ограничений", wantRead: 100},
+		{name: "файл помещается", maxSize: 100, budget: 100, wantRead: 100},
+		{name: "превышен размер файла", maxSize: 50, wantClass: ErrorClassTooLarge, wantRead: 50},
+		{name: "размер с учётом докачанной части", maxSize: 120, offset: 30, wantClass: ErrorClassTooLarge, wantRead: 90},
+		{name: "превышен бюджет пользователя", budget: 150, used: 80, wantClass: ErrorClassUserQuota, wantRead: 70},
+		{name: "бюджет с учётом докачанной части", budget: 120, offset: 30, wantClass: ErrorClassUserQuota, wantRead: 90},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := NewUserBudget(tt.budget)
+			budget.Add(tt.used)
+
+			// Сервер не сообщил размер: ограничение срабатывает во время передачи
+			guard := &guardedReader{r: iotest.OneByteReader(bytes.NewReader(content)), url: url, maxSize: tt.maxSize, budget: budget}
+			if err := guard.start(tt.offset); err != nil {
+				t.Fatalf("start(%d): %v", tt.offset, err)
+			}
+			if err := guard.expect(-1); err != nil {
+				t.Fatalf("expect(-1): %v", err)
+			}
+
+			read, err := io.Copy(io.Discard, guard)
+			if class := ErrorClass(err); (err != nil || tt.wantClass != "") && class != tt.wantClass {
+				t.Errorf("ошибка %v класса %s, ожидался %q", err, class, tt.wantClass)
+			}
+			if err != nil && (IsPermanent(err) || !isLimitError(err)) {
+				t.Errorf("ошибка ограничения %v не должна быть постоянной", err)
+			}
+			if read != tt.wantRead {
+				t.Errorf("прочитано %d байт, ожидалось %d", read, tt.wantRead)
+			}
+
+			// Несохранённый файл возвращает занятые байты в бюджет
+			if budget != nil {
+				guard.release()
+				if remaining := budget.remaining(); remaining != tt.budget-tt.used {
+					t.Errorf("после release остаток %d, ожидалось %d", remaining, tt.budget-tt.used)
+				}
+			}
+		})
+	}
+}
+
+func TestGuardedReaderExpect(t *testing.T) {
+	const url = "https://example.com/file"
+
+	tests := []struct {
+		name      string
+		maxSize   int64
+		budget    int64
+		offset    int64
+		total     int64 // размер файла по Content-Length (-1 - неизвестен)
+		wantClass string
+	}{
+		{name: "размер неизвестен", maxSize: 10, budget: 10, total: -1},
+		{name: "размер равен ограничению", maxSize: 100, total: 100},
+		{name: "размер больше ограничения", maxSize: 100, total: 101, wantClass: ErrorClassTooLarge},
+		{name: "докачанная часть больше ограничения", maxSize: 100, offset: 101, total: 200, wantClass: ErrorClassTooLarge},
+		{name: "остаток помещается в бюджет", budget: 100, offset: 60, total: 100},
+		{name: "остаток не помещается в бюджет", budget: 100, offset: 60, total: 101, wantClass: ErrorClassUserQuota},
+		{name: "докачанная часть больше бюджета", budget: 50, offset: 60, total: 100, wantClass: ErrorClassUserQuota},
+	}
+
+	for _, tt := range tests {
+		guard := &guardedReader{url: url, maxSize: tt.maxSize, budget: NewUserBudget(tt.budget)}
+		err := guard.start(tt.offset)
+		if err == nil {
+			err = guard.expect(tt.total)
+		}
+		if class := ErrorClass(err); (err != nil || tt.wantClass != "") && class != tt.wantClass {
+			t.Errorf("%s: ошибка %v класса %s, ожидался %q", tt.name, err, class, tt.wantClass)
+		}
+	}
+}
+
+// TestDownloadFileLimits ограничения прерывают скачивание и не оставляют временных файлов
+func TestDownloadFileLimits(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), make([]byte, 200)...)
+
+	tests := []struct {
+		name        string
+		contentType string
+		chunked     bool // без Content-Length
+		maxFileSize int64
+		maxUserSize int64
+		allowed     []string
+		wantClass   string
+	}{
+		{name: "без ограничений", contentType: "image/png"},
+		{name: "размер по Content-Length", contentType: "image/png", maxFileSize: 100, wantClass: ErrorClassTooLarge},
+		{name: "размер во время передачи", contentType: "image/png", chunked: true, maxFileSize: 100, wantClass: ErrorClassTooLarge},
+		{name: "бюджет пользователя", contentType: "image/png", chunked: true, maxUserSize: 100, wantClass: ErrorClassUserQuota},
+		{name: "тип из заголовка разрешён", contentType: "image/png", allowed: []string{"image/*"}},
+		{name: "тип из заголовка запрещён", contentType: "text/html", allowed: []string{"image/*", "application/pdf"}, wantClass: ErrorClassContentType},
+		{name: "тип по содержимому разрешён", contentType: "application/octet-stream", allowed: []string{"image/png"}},
+		{name: "тип по содержимому запрещён", contentType: "application/octet-stream", allowed: []string{"application/pdf"}, wantClass: ErrorClassContentType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("ETag", `"v1"`)
+				if tt.chunked {
+					w.Write(png[:16])
+					w.(http.Flusher).Flush()
+					w.Write(png[16:])
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(png))
+			}))
+			defer server.Close()
+
+			baseDir := t.TempDir()
+			d := &Downloader{
+				BaseDir:             baseDir,
+				HTTPClient:          server.Client(),
+				Storage:             storage.NewLocal(t.TempDir()),
+				MaxRetries:          2,
+				MaxFileSize:         tt.maxFileSize,
+				MaxUserSize:         tt.maxUserSize,
+				AllowedContentTypes: tt.allowed,
+			}
+			budget := d.NewUserBudget()
+
+			const destKey = "RU/user_1/photos/photo_1"
+			info, err := d.DownloadFile(context.Background(), server.URL+"/photo", destKey, budget)
+			if tt.wantClass == "" {
+				if err != nil {
+					t.Fatalf("DownloadFile: %v", err)
+				}
+				if info.Size != int64(len(png)) || !strings.HasSuffix(info.Key, ".png") {
+					t.Errorf("файл %s размером %d, ожидался .png размером %d", info.Key, info.Size, len(png))
+				}
+				return
+			}
+
+			// Ограничения зависят от настроек: в попытке не повторяются, но и постоянными не считаются
+			if ErrorClass(err) != tt.wantClass || IsPermanent(err) {
+				t.Fatalf("ошибка %v класса %s (постоянная %v), ожидалась не постоянная %s", err, ErrorClass(err), IsPermanent(err), tt.wantClass)
+			}
+			if n := atomic.LoadInt32(&requests); n != 1 {
+				t.Errorf("запросов %d, ожидался 1: нарушение ограничения не повторяется", n)
+			}
+			if remaining := budget.remaining(); budget != nil && remaining != tt.maxUserSize {
+				t.Errorf("остаток бюджета %d, ожидалось %d: байты не сохранённого файла возвращаются", remaining, tt.maxUserSize)
+			}
+			tmpPath := filepath.Join(baseDir, filepath.FromSlash(destKey)) + ".tmp"
+			for _, path := range []string{tmpPath, partialMetaPath(tmpPath)} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("%s не удалён: %v", path, err)
+				}
+			}
+		})
+	}
+}
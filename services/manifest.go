@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"up-down/models"
+	"up-down/storage"
+)
+
+// ManifestFileName имя манифеста в директории пользователя (рядом с info.json)
+const ManifestFileName = "manifest.json"
+
+// Manifest список скачанных файлов пользователя с контрольными суммами
+type Manifest struct {
+	UserID      int64          `json:"user_id"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Files       []ManifestFile `json:"files"`
+}
+
+// ManifestFile сведения об одном файле манифеста
+type ManifestFile struct {
+	Path         string     `json:"path"` // относительно директории пользователя
+	Category     string     `json:"category"`
+	GroupIndex   int        `json:"group_index"`
+	URL          string     `json:"url"`
+	OriginalName string     `json:"original_name,omitempty"`
+	Size         int64      `json:"size"`
+	SHA256       string     `json:"sha256"`
+	ContentType  string     `json:"content_type"`
+	DownloadedAt *time.Time `json:"downloaded_at"`
+}
+
+// Виды несоответствий при проверке манифеста
+const (
+	MismatchMissing = "missing"
+	MismatchSize    = "size"
+	MismatchSHA256  = "sha256"
+)
+
+// ManifestMismatch файл, который не совпадает с манифестом
+type ManifestMismatch struct {
+	Path     string `json:"path"`
+	Problem  string `json:"problem"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// WriteManifest записывает manifest.json по журналу файлов пользователя.
+// userKey - префикс пользователя в хранилище: {citizenship_id}/user_{id}.
+func WriteManifest(ctx context.Context, store storage.Storage, userKey string, userID int64, items []models.UserFileItem) error {
+	manifest := Manifest{
+		UserID:      userID,
+		GeneratedAt: time.Now(),
+		Files:       manifestFiles(store, userKey, items),
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка сериализации манифеста: %w", err)
+	}
+
+	if err := storage.PutBytes(ctx, store, path.Join(userKey, ManifestFileName), "application/json", data); err != nil {
+		return fmt.Errorf("ошибка записи манифеста: %w", err)
+	}
+	return nil
+}
+
+// manifestFiles скачанные файлы из журнала в формате манифеста
+func manifestFiles(store storage.Storage, userKey string, items []models.UserFileItem) []ManifestFile {
+	files := make([]ManifestFile, 0, len(items))
+	for _, item := range items {
+		if item.DownloadedAt == nil || item.LocalPath == "" {
+			continue
+		}
+
+		files = append(files, ManifestFile{
+			Path:         manifestPath(store, userKey, &item),
+			Category:     item.Category,
+			GroupIndex:   item.GroupIndex,
+			URL:          item.URL,
+			OriginalName: item.OriginalName,
+			Size:         item.Size,
+			SHA256:       item.SHA256,
+			ContentType:  item.ContentType,
+			DownloadedAt: item.DownloadedAt,
+		})
+	}
+	return files
+}
+
+// manifestPath путь файла относительно директории пользователя
+func manifestPath(store storage.Storage, userKey string, item *models.UserFileItem) string {
+	if item.StorageKey != "" {
+		return strings.TrimPrefix(item.StorageKey, userKey+"/")
+	}
+
+	// Записи журнала до появления storage_key хранят только путь на диске
+	relPath, err := filepath.Rel(store.Location(userKey), item.LocalPath)
+	if err != nil {
+		return filepath.ToSlash(item.LocalPath)
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// ReadManifest читает manifest.json пользователя из хранилища
+func ReadManifest(ctx context.Context, store storage.Storage, userKey string) (*Manifest, error) {
+	data, err := storage.ReadAll(ctx, store, path.Join(userKey, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("ошибка чтения манифеста: %w", err)
+	}
+	return &manifest, nil
+}
+
+// VerifyManifest пересчитывает sha256 файлов и возвращает те, что не совпадают с манифестом
+func VerifyManifest(ctx context.Context, store storage.Storage, userKey string) ([]ManifestMismatch, error) {
+	manifest, err := ReadManifest(ctx, store, userKey)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches := make([]ManifestMismatch, 0)
+	for _, file := range manifest.Files {
+		size, sum, err := hashObject(ctx, store, path.Join(userKey, file.Path))
+		if err != nil {
+			mismatches = append(mismatches, ManifestMismatch{Path: file.Path, Problem: MismatchMissing})
+			continue
+		}
+
+		if size != file.Size {
+			mismatches = append(mismatches, ManifestMismatch{
+				Path:     file.Path,
+				Problem:  MismatchSize,
+				Expected: fmt.Sprint(file.Size),
+				Actual:   fmt.Sprint(size),
+			})
+			continue
+		}
+
+		if file.SHA256 != "" && sum != file.SHA256 {
+			mismatches = append(mismatches, ManifestMismatch{
+				Path:     file.Path,
+				Problem:  MismatchSHA256,
+				Expected: file.SHA256,
+				Actual:   sum,
+			})
+		}
+	}
+
+	return mismatches, nil
+}
+
+// hashObject возвращает размер и sha256 объекта хранилища
+func hashObject(ctx context.Context, store storage.Storage, key string) (int64, string, error) {
+	body, err := store.Get(ctx, key)
+	if err != nil {
+		return 0, "", err
+	}
+	defer body.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, body)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,411 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"up-down/config"
+	"up-down/models"
+	"up-down/storage"
+)
+
+// Форматы файла с данными пользователя
+const (
+	MetadataJSON = "json" // info.json
+	MetadataYAML = "yaml" // info.yaml
+	MetadataTXT  = "txt"  // info.txt в прежнем формате "key: value"
+)
+
+// metadataFileNames имена файлов по форматам
+var metadataFileNames = map[string]string{
+	MetadataJSON: "info.json",
+	MetadataYAML: "info.yaml",
+	MetadataTXT:  "info.txt",
+}
+
+// indexFlushThreshold количество накопленных строк индекса, после которого они записываются сегментом
+const indexFlushThreshold = 1000
+
+// IndexSegmentsPrefix служебная директория хранилища с сегментами CSV индекса,
+// которые ещё не слиты в основной индекс: .index/index.csv/{время}-{номер}.csv
+const IndexSegmentsPrefix = ".index"
+
+// UserMetadata данные пользователя, статус скачивания и список файлов
+type UserMetadata struct {
+	UserID      int64              `json:"user_id"`
+	Path        string             `json:"path"`
+	GeneratedAt time.Time          `json:"generated_at"`
+	Fields      map[string]*string `json:"fields"`
+	Status      map[string]bool    `json:"status"`
+	Files       []ManifestFile     `json:"files"`
+}
+
+// MetadataWriter записывает данные пользователя в выбранных форматах (METADATA_FORMATS)
+// с выбранными полями (METADATA_FIELDS) и ведёт общий CSV индекс (METADATA_INDEX).
+// Новые строки индекса дописываются отдельными сегментами, в основной индекс они сливаются
+// один раз в конце задания (CompactIndex).
+type MetadataWriter struct {
+	store      storage.Storage
+	formats    []string
+	fields     []string
+	available  *userFields
+	categories []string
+	indexKey   string
+
+	mutex    sync.Mutex
+	pending  map[int64][]string // строки индекса, ещё не записанные в хранилище
+	segments int                // номер последнего записанного сегмента
+}
+
+func NewMetadataWriter(cfg *config.Config, store storage.Storage) (*MetadataWriter, error) {
+	formats := splitList(cfg.Download.MetadataFormats)
+	for _, format := range formats {
+		if _, ok := metadataFileNames[format]; !ok {
+			return nil, fmt.Errorf("неизвестный формат METADATA_FORMATS: %s", format)
+		}
+	}
+
+	available := newUserFields(&cfg.Source)
+	fields := splitList(cfg.Download.MetadataFields)
+	for _, field := range fields {
+		if !available.has(field) {
+			return nil, fmt.Errorf("неизвестное поле METADATA_FIELDS: %s", field)
+		}
+	}
+
+	categories := make([]string, 0, len(cfg.Source.Categories))
+	for _, category := range cfg.Source.Categories {
+		categories = append(categories, category.Name)
+	}
+
+	return &MetadataWriter{
+		store:      store,
+		formats:    formats,
+		fields:     fields,
+		available:  available,
+		categories: categories,
+		indexKey:   strings.Trim(cfg.Download.MetadataIndex, "/"),
+		pending:    make(map[int64][]string),
+	}, nil
+}
+
+// splitList разбирает список через запятую, пропуская пустые элементы
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Write записывает файлы с данными пользователя и добавляет его в очередь CSV индекса
+func (m *MetadataWriter) Write(ctx context.Context, user *models.User, userKey string, status map[string]bool, items []models.UserFileItem) error {
+	meta := m.build(user, userKey, status, items)
+
+	for _, format := range m.formats {
+		var data []byte
+		var contentType string
+
+		switch format {
+		case MetadataJSON:
+			encoded, err := json.MarshalIndent(meta, "", "  ")
+			if err != nil {
+				return fmt.Errorf("ошибка сериализации данных пользователя: %w", err)
+			}
+			data, contentType = append(encoded, '\n'), "application/json"
+		case MetadataYAML:
+			data, contentType = m.encodeYAML(meta), "application/yaml"
+		case MetadataTXT:
+			data, contentType = m.encodeText(meta), "text/plain; charset=utf-8"
+		}
+
+		key := path.Join(userKey, metadataFileNames[format])
+		if err := storage.PutBytes(ctx, m.store, key, contentType, data); err != nil {
+			return fmt.Errorf("ошибка записи %s: %w", key, err)
+		}
+	}
+
+	if m.indexKey != "" {
+		m.mutex.Lock()
+		m.pending[user.ID] = m.indexRow(meta)
+		full := len(m.pending) >= indexFlushThreshold
+		m.mutex.Unlock()
+
+		if full {
+			return m.FlushIndex(ctx)
+		}
+	}
+	return nil
+}
+
+// build собирает данные пользователя
+func (m *MetadataWriter) build(user *models.User, userKey string, status map[string]bool, items []models.UserFileItem) *UserMetadata {
+	meta := &UserMetadata{
+		UserID:      user.ID,
+		Path:        userKey,
+		GeneratedAt: time.Now(),
+		Fields:      make(map[string]*string, len(m.fields)),
+		Status:      status,
+		Files:       manifestFiles(m.store, userKey, items),
+	}
+
+	for _, field := range m.fields {
+		if value := m.available.value(user, field); value != "" {
+			meta.Fields[field] = &value
+		} else {
+			meta.Fields[field] = nil
+		}
+	}
+
+	return meta
+}
+
+// encodeYAML сериализует данные в YAML. Строки записываются в JSON-кавычках - это валидный YAML.
+func (m *MetadataWriter) encodeYAML(meta *UserMetadata) []byte {
+	var b bytes.Buffer
+	quote := func(value string) string {
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+
+	fmt.Fprintf(&b, "user_id: %d\n", meta.UserID)
+	fmt.Fprintf(&b, "path: %s\n", quote(meta.Path))
+	fmt.Fprintf(&b, "generated_at: %s\n", quote(meta.GeneratedAt.Format(time.RFC3339)))
+
+	b.WriteString("fields:")
+	if len(m.fields) == 0 {
+		b.WriteString(" {}")
+	}
+	b.WriteString("\n")
+	for _, field := range m.fields {
+		if value := meta.Fields[field]; value != nil {
+			fmt.Fprintf(&b, "  %s: %s\n", field, quote(*value))
+		} else {
+			fmt.Fprintf(&b, "  %s: null\n", field)
+		}
+	}
+
+	b.WriteString("status:\n")
+	for _, category := range m.categories {
+		fmt.Fprintf(&b, "  %s: %t\n", category, meta.Status[category])
+	}
+
+	b.WriteString("files:")
+	if len(meta.Files) == 0 {
+		b.WriteString(" []")
+	}
+	b.WriteString("\n")
+	for _, file := range meta.Files {
+		fmt.Fprintf(&b, "  - path: %s\n", quote(file.Path))
+		fmt.Fprintf(&b, "    category: %s\n", quote(file.Category))
+		fmt.Fprintf(&b, "    group_index: %d\n", file.GroupIndex)
+		fmt.Fprintf(&b, "    url: %s\n", quote(file.URL))
+		fmt.Fprintf(&b, "    size: %d\n", file.Size)
+		fmt.Fprintf(&b, "    sha256: %s\n", quote(file.SHA256))
+		fmt.Fprintf(&b, "    content_type: %s\n", quote(file.ContentType))
+		if file.DownloadedAt != nil {
+			fmt.Fprintf(&b, "    downloaded_at: %s\n", quote(file.DownloadedAt.Format(time.RFC3339)))
+		}
+	}
+
+	return b.Bytes()
+}
+
+// encodeText прежний формат info.txt: "key: value" по выбранным полям, пустые значения - N/A
+func (m *MetadataWriter) encodeText(meta *UserMetadata) []byte {
+	var b bytes.Buffer
+	for _, field := range m.fields {
+		value := "N/A"
+		if meta.Fields[field] != nil {
+			value = *meta.Fields[field]
+		}
+		fmt.Fprintf(&b, "%s: %s\n", field, value)
+	}
+	return b.Bytes()
+}
+
+// indexHeader колонки CSV индекса
+func (m *MetadataWriter) indexHeader() []string {
+	header := []string{"user_id", "path"}
+	header = append(header, m.fields...)
+	for _, category := range m.categories {
+		header = append(header, "status_"+category)
+	}
+	return append(header, "files", "updated_at")
+}
+
+// indexRow строка CSV индекса в порядке indexHeader
+func (m *MetadataWriter) indexRow(meta *UserMetadata) []string {
+	row := []string{strconv.FormatInt(meta.UserID, 10), meta.Path}
+	for _, field := range m.fields {
+		if value := meta.Fields[field]; value != nil {
+			row = append(row, *value)
+		} else {
+			row = append(row, "")
+		}
+	}
+	for _, category := range m.categories {
+		row = append(row, strconv.FormatBool(meta.Status[category]))
+	}
+	return append(row, strconv.Itoa(len(meta.Files)), meta.GeneratedAt.Format(time.RFC3339))
+}
+
+// segmentsPrefix префикс сегментов индекса в хранилище
+func (m *MetadataWriter) segmentsPrefix() string {
+	return path.Join(IndexSegmentsPrefix, m.indexKey) + "/"
+}
+
+// FlushIndex записывает накопленные строки новым сегментом индекса.
+// Существующий индекс не читается: размер записи не зависит от числа пользователей.
+func (m *MetadataWriter) FlushIndex(ctx context.Context) error {
+	if m.indexKey == "" {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.flushLocked(ctx)
+}
+
+func (m *MetadataWriter) flushLocked(ctx context.Context) error {
+	if len(m.pending) == 0 {
+		return nil
+	}
+
+	// Имя сегмента задаёт порядок слияния: более поздняя строка пользователя заменяет раннюю
+	m.segments++
+	key := fmt.Sprintf("%s%019d-%06d.csv", m.segmentsPrefix(), time.Now().UnixNano(), m.segments)
+	if err := m.writeIndex(ctx, key, m.pending); err != nil {
+		return err
+	}
+
+	m.pending = make(map[int64][]string)
+	return nil
+}
+
+// CompactIndex сливает сегменты в основной индекс: строки тех же пользователей заменяются,
+// результат записывается целиком, слитые сегменты удаляются. Вызывается в конце задания.
+func (m *MetadataWriter) CompactIndex(ctx context.Context) error {
+	if m.indexKey == "" {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.flushLocked(ctx); err != nil {
+		return err
+	}
+
+	segments, err := m.store.List(ctx, m.segmentsPrefix())
+	if err != nil {
+		return fmt.Errorf("ошибка чтения сегментов индекса: %w", err)
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Key < segments[j].Key })
+
+	header := m.indexHeader()
+	rows := make(map[int64][]string)
+
+	for _, key := range append([]string{m.indexKey}, objectKeys(segments)...) {
+		data, err := storage.ReadAll(ctx, m.store, key)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = readIndex(data, header, rows)
+		}
+		if err != nil {
+			return fmt.Errorf("ошибка чтения индекса %s: %w", key, err)
+		}
+	}
+
+	if err := m.writeIndex(ctx, m.indexKey, rows); err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if err := m.store.Delete(ctx, segment.Key); err != nil {
+			return fmt.Errorf("ошибка удаления сегмента индекса %s: %w", segment.Key, err)
+		}
+	}
+	return nil
+}
+
+// objectKeys ключи объектов
+func objectKeys(objects []storage.Object) []string {
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
+
+// writeIndex записывает строки индекса, отсортированные по id пользователя, под ключом key
+func (m *MetadataWriter) writeIndex(ctx context.Context, key string, rows map[int64][]string) error {
+	ids := make([]int64, 0, len(rows))
+	for id := range rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var b bytes.Buffer
+	writer := csv.NewWriter(&b)
+	writer.Write(m.indexHeader())
+	for _, id := range ids {
+		writer.Write(rows[id])
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("ошибка записи индекса: %w", err)
+	}
+
+	if err := storage.PutBytes(ctx, m.store, key, "text/csv; charset=utf-8", b.Bytes()); err != nil {
+		return fmt.Errorf("ошибка записи индекса %s: %w", key, err)
+	}
+	return nil
+}
+
+// readIndex разбирает индекс или сегмент, перекладывая колонки по именам
+// (набор полей мог измениться с прошлого запуска)
+func readIndex(data []byte, header []string, rows map[int64][]string) error {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	columns := make(map[string]int, len(records[0]))
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+
+	for _, record := range records[1:] {
+		userID, err := strconv.ParseInt(record[columns["user_id"]], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		row := make([]string, len(header))
+		for i, name := range header {
+			if idx, ok := columns[name]; ok && idx < len(record) {
+				row[i] = record[idx]
+			}
+		}
+		rows[userID] = row
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"up-down/config"
+	"up-down/models"
+	"up-down/storage"
+)
+
+func TestMetadataIndexSegments(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal(t.TempDir())
+
+	writer, err := NewMetadataWriter(&config.Config{
+		Download: config.DownloadConfig{MetadataIndex: "index.csv"},
+		Source: config.SourceConfig{
+			GroupColumn: "citizenship_id",
+			Categories:  []config.FileCategory{{Name: "document", Dir: "documents", Prefix: "document"}},
+		},
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Индекс прошлого задания: пользователь 1 остаётся без изменений
+	previous := "user_id,path,status_document,files,updated_at\n1,RU/user_1,true,1,2024-01-01T00:00:00Z\n2,RU/user_2,false,0,2024-01-01T00:00:00Z\n"
+	if err := storage.PutBytes(ctx, store, "index.csv", "text/csv", []byte(previous)); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(id int64, downloaded bool) {
+		t.Helper()
+		user := &models.User{ID: id, Group: sql.NullString{String: "RU", Valid: true}}
+		if err := writer.Write(ctx, user, "RU/user_"+strconv.FormatInt(id, 10), map[string]bool{"document": downloaded}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.FlushIndex(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Скачивание одного пользователя дописывает сегмент и не трогает основной индекс
+	write(2, false)
+	write(3, false)
+	write(2, true)
+
+	segments, err := store.List(ctx, IndexSegmentsPrefix+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("сегментов %d, ожидалось 3", len(segments))
+	}
+	if data, _ := storage.ReadAll(ctx, store, "index.csv"); string(data) != previous {
+		t.Errorf("основной индекс изменён до слияния:\n%s", data)
+	}
+
+	if err := writer.CompactIndex(ctx); err != nil {
+		t.Fatalf("CompactIndex: %v", err)
+	}
+
+	data, err := storage.ReadAll(ctx, store, "index.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(records))
+	for _, record := range records {
+		got = append(got, strings.Join(record[:3], ","))
+	}
+	want := []string{"user_id,path,status_document", "1,RU/user_1,true", "2,RU/user_2,true", "3,RU/user_3,false"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("индекс после слияния:\n%s\nожидалось:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Слитые сегменты удалены
+	if segments, _ := store.List(ctx, IndexSegmentsPrefix+"/"); len(segments) != 0 {
+		t.Errorf("после слияния остались сегменты: %v", segments)
+	}
+	if _, err := os.Stat(filepath.Join(store.Root, "index.csv.part")); !os.IsNotExist(err) {
+		t.Errorf("остался временный файл индекса: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// partialMeta сведения о недокачанном .tmp файле, нужные для продолжения через Range.
+// Хранятся рядом с ним в файле .tmp.meta.
+type partialMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func partialMetaPath(tmpPath string) string {
+	return tmpPath + ".meta"
+}
+
+// loadPartial возвращает размер .tmp файла и его валидатор, если скачивание можно продолжить
+func loadPartial(tmpPath, url string) (int64, *partialMeta) {
+	stat, err := os.Stat(tmpPath)
+	if err != nil || stat.Size() == 0 {
+		return 0, nil
+	}
+
+	data, err := os.ReadFile(partialMetaPath(tmpPath))
+	if err != nil {
+		return 0, nil
+	}
+
+	var meta partialMeta
+	if err := json.Unmarshal(data, &meta); err != nil || meta.URL != url || meta.validator() == "" {
+		return 0, nil
+	}
+
+	return stat.Size(), &meta
+}
+
+// savePartial сохраняет валидатор ответа для последующего продолжения
+func savePartial(tmpPath, url string, resp *http.Response) error {
+	meta := partialMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if meta.validator() == "" {
+		// Без ETag/Last-Modified нельзя проверить, что файл на сервере не изменился
+		os.Remove(partialMetaPath(tmpPath))
+		return nil
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partialMetaPath(tmpPath), data, 0644)
+}
+
+// removePartial удаляет .tmp файл и его метаданные
+func removePartial(tmpPath string) {
+	os.Remove(tmpPath)
+	os.Remove(partialMetaPath(tmpPath))
+}
+
+// validator возвращает значение для If-Range. Слабый ETag для If-Range не годится,
+// в этом случае используется Last-Modified.
+func (m *partialMeta) validator() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// parseContentRangeStart извлекает начальный байт из "bytes 100-199/200"
+func parseContentRangeStart(value string) (int64, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "bytes ")
+	dash := strings.IndexByte(value, '-')
+	if dash <= 0 {
+		return 0, fmt.Errorf("неверный Content-Range: %q", value)
+	}
+	return strconv.ParseInt(value[:dash], 10, 64)
+}
@@ -0,0 +1,308 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"up-down/storage"
+)
+
+func TestParseContentRangeStart(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "bytes 100-199/200", want: 100},
+		{value: "bytes 0-0/1", want: 0},
+		{value: "  bytes 7-9/*  ", want: 7},
+		{value: "100-199/200", want: 100},
+		{value: "", wantErr: true},
+		{value: "bytes */200", wantErr: true},
+		{value: "bytes -5/10", wantErr: true},
+		{value: "bytes abc-1/2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseContentRangeStart(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseContentRangeStart(%q) = %d, ожидалась ошибка", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseContentRangeStart(%q) = %d, %v, ожидалось %d", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestPartialMetaValidator(t *testing.T) {
+	tests := []struct {
+		name string
+		meta partialMeta
+		want string
+	}{
+		{name: "сильный ETag", meta: partialMeta{ETag: `"v1"`, LastModified: "Mon, 01 Jan 2024 00:00:00 GMT"}, want: `"v1"`},
+		{name: "слабый ETag", meta: partialMeta{ETag: `W/"v1"`, LastModified: "Mon, 01 Jan 2024 00:00:00 GMT"}, want: "Mon, 01 Jan 2024 00:00:00 GMT"},
+		{name: "только слабый ETag", meta: partialMeta{ETag: `W/"v1"`}, want: ""},
+		{name: "без валидатора", meta: partialMeta{}, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.meta.validator(); got != tt.want {
+			t.Errorf("%s: validator() = %q, ожидалось %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPartialMeta(t *testing.T) {
+	const url = "https://example.com/file.pdf"
+
+	response := func(headers map[string]string) *http.Response {
+		resp := &http.Response{Header: http.Header{}}
+		for name, value := range headers {
+			resp.Header.Set(name, value)
+		}
+		return resp
+	}
+	writeTmp := func(t *testing.T, data string) string {
+		tmpPath := filepath.Join(t.TempDir(), "file.tmp")
+		if err := os.WriteFile(tmpPath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return tmpPath
+	}
+
+	t.Run("продолжение по ETag", func(t *testing.T) {
+		tmpPath := writeTmp(t, "0123456789")
+		if err := savePartial(tmpPath, url, response(map[string]string{"ETag": `"v1"`})); err != nil {
+			t.Fatal(err)
+		}
+
+		offset, meta := loadPartial(tmpPath, url)
+		if offset != 10 || meta == nil || meta.validator() != `"v1"` {
+			t.Fatalf("loadPartial = %d, %+v, ожидалось 10 и ETag \"v1\"", offset, meta)
+		}
+	})
+
+	t.Run("слабый ETag заменяется Last-Modified", func(t *testing.T) {
+		tmpPath := writeTmp(t, "0123456789")
+		lastModified := "Mon, 01 Jan 2024 00:00:00 GMT"
+		if err := savePartial(tmpPath, url, response(map[string]string{"ETag": `W/"v1"`, "Last-Modified": lastModified})); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, meta := loadPartial(tmpPath, url); meta == nil || meta.validator() != lastModified {
+			t.Fatalf("валидатор %+v, ожидался Last-Modified", meta)
+		}
+	})
+
+	t.Run("другой URL", func(t *testing.T) {
+		tmpPath := writeTmp(t, "0123456789")
+		if err := savePartial(tmpPath, url, response(map[string]string{"ETag": `"v1"`})); err != nil {
+			t.Fatal(err)
+		}
+
+		if offset, meta := loadPartial(tmpPath, url+"?v=2"); offset != 0 || meta != nil {
+			t.Errorf("loadPartial = %d, %+v, ожидалось скачивание заново", offset, meta)
+		}
+	})
+
+	t.Run("без валидатора метаданные удаляются", func(t *testing.T) {
+		tmpPath := writeTmp(t, "0123456789")
+		if err := savePartial(tmpPath, url, response(map[string]string{"ETag": `"v1"`})); err != nil {
+			t.Fatal(err)
+		}
+		if err := savePartial(tmpPath, url, response(map[string]string{"ETag": `W/"v2"`})); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(partialMetaPath(tmpPath)); !os.IsNotExist(err) {
+			t.Errorf("%s не удалён: %v", partialMetaPath(tmpPath), err)
+		}
+		if _, meta := loadPartial(tmpPath, url); meta != nil {
+			t.Errorf("loadPartial = %+v, ожидалось скачивание заново", meta)
+		}
+	})
+
+	t.Run("пустой временный файл", func(t *testing.T) {
+		tmpPath := writeTmp(t, "")
+		if err := savePartial(tmpPath, url, response(map[string]string{"ETag": `"v1"`})); err != nil {
+			t.Fatal(err)
+		}
+
+		if offset, meta := loadPartial(tmpPath, url); offset != 0 || meta != nil {
+			t.Errorf("loadPartial = %d, %+v, ожидалось скачивание заново", offset, meta)
+		}
+	})
+
+	t.Run("повреждённые метаданные", func(t *testing.T) {
+		tmpPath := writeTmp(t, "0123456789")
+		if err := os.WriteFile(partialMetaPath(tmpPath), []byte("{"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, meta := loadPartial(tmpPath, url); meta != nil {
+			t.Errorf("loadPartial = %+v, ожидалось скачивание заново", meta)
+		}
+	})
+
+	t.Run("removePartial", func(t *testing.T) {
+		tmpPath := writeTmp(t, "0123456789")
+		if err := savePartial(tmpPath, url, response(map[string]string{"ETag": `"v1"`})); err != nil {
+			t.Fatal(err)
+		}
+		removePartial(tmpPath)
+
+		for _, path := range []string{tmpPath, partialMetaPath(tmpPath)} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s не удалён: %v", path, err)
+			}
+		}
+	})
+}
+
+// TestDownloadFileResume продолжение недокачанного файла: сервер отвечает 206 на совпавший
+// валидатор и 200 с полным файлом, если файл изменился
+func TestDownloadFileResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	sum := sha256.Sum256(content)
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		etag       string // ETag в .tmp.meta
+		wantStatus int
+	}{
+		{name: "валидатор совпал", etag: `"v1"`, wantStatus: http.StatusPartialContent},
+		{name: "файл изменился", etag: `"v0"`, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status int
+			var gotRange string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotRange = r.Header.Get("Range")
+				w.Header().Set("ETag", `"v1"`)
+				rec := &statusRecorder{ResponseWriter: w}
+				http.ServeContent(rec, r, "file.bin", modified, bytes.NewReader(content))
+				status = rec.status
+			}))
+			defer server.Close()
+
+			baseDir := t.TempDir()
+			d := &Downloader{
+				BaseDir:    baseDir,
+				HTTPClient: server.Client(),
+				Storage:    storage.NewLocal(t.TempDir()),
+			}
+
+			// Недокачанная часть от предыдущей попытки
+			const destKey = "1/user_1/documents/document_1"
+			url := server.URL + "/file.bin"
+			tmpPath := filepath.Join(baseDir, filepath.FromSlash(destKey)) + ".tmp"
+			if err := os.MkdirAll(filepath.Dir(tmpPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(tmpPath, content[:100], 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := savePartial(tmpPath, url, &http.Response{Header: http.Header{"Etag": {tt.etag}}}); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := d.DownloadFile(context.Background(), url, destKey, nil)
+			if err != nil {
+				t.Fatalf("DownloadFile: %v", err)
+			}
+
+			if gotRange != "bytes=100-" {
+				t.Errorf("Range %q, ожидалось bytes=100-", gotRange)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("статус ответа %d, ожидался %d", status, tt.wantStatus)
+			}
+			if info.Size != int64(len(content)) || info.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("размер %d, sha256 %s, ожидалось %d, %x", info.Size, info.SHA256, len(content), sum)
+			}
+
+			data, err := os.ReadFile(info.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("содержимое файла не совпадает (%d байт из %d)", len(data), len(content))
+			}
+			for _, path := range []string{tmpPath, partialMetaPath(tmpPath)} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("%s не удалён после скачивания: %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// TestDownloadFileResumeWrongRange сервер вернул не тот диапазон: недокачанная часть удаляется,
+// а ошибка называет причину
+func TestDownloadFileResumeWrongRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Range", "bytes 0-9/1024")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	baseDir := t.TempDir()
+	d := &Downloader{
+		BaseDir:    baseDir,
+		HTTPClient: server.Client(),
+		Storage:    storage.NewLocal(t.TempDir()),
+	}
+
+	const destKey = "1/user_1/documents/document_1"
+	url := server.URL + "/file.bin"
+	tmpPath := filepath.Join(baseDir, filepath.FromSlash(destKey)) + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(tmpPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmpPath, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePartial(tmpPath, url, &http.Response{Header: http.Header{"Etag": {`"v1"`}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := d.DownloadFile(context.Background(), url, destKey, nil)
+	if err == nil {
+		t.Fatal("ожидалась ошибка")
+	}
+	if ErrorClass(err) != ErrorClassIO || !strings.Contains(err.Error(), "Content-Range start 0 != offset 100") {
+		t.Errorf("ошибка %q класса %s, ожидалась %s с причиной", err, ErrorClass(err), ErrorClassIO)
+	}
+	for _, path := range []string{tmpPath, partialMetaPath(tmpPath)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s не удалён: %v", path, err)
+		}
+	}
+}
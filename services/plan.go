@@ -0,0 +1,367 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"up-down/models"
+)
+
+// planIssueLimit сколько примеров ошибок сохраняется в отчёте плана
+const planIssueLimit = 200
+
+// PlanCategory итоги плана по одной категории файлов
+type PlanCategory struct {
+	Users      int64 `json:"users"`      // пользователей, у которых категория будет скачиваться
+	Files      int64 `json:"files"`      // файлов к скачиванию
+	Bytes      int64 `json:"bytes"`      // известный размер файлов (HEAD или Uploadcare API)
+	Missing    int64 `json:"missing"`    // файлов, удалённых или отсутствующих в группе
+	Downloaded int64 `json:"downloaded"` // пропущено: уже скачана ранее
+	Permanent  int64 `json:"permanent"`  // пропущено: постоянная ошибка в прошлых прогонах
+}
+
+// PlanIssue ссылка, которую не удалось разобрать или проверить
+type PlanIssue struct {
+	UserID   int64  `json:"user_id"`
+	Category string `json:"category"`
+	URL      string `json:"url"`
+	Class    string `json:"class"`
+	Error    string `json:"error"`
+}
+
+// PlanReport план задания: сколько пользователей, файлов и байт затронет запуск с такими фильтрами.
+// Строится по тому же потоку пользователей, что и скачивание, но ничего не пишет в хранилище и БД.
+type PlanReport struct {
+	Spec       JobSpec    `json:"spec"`
+	Head       bool       `json:"head"` // размеры получены запросами HEAD
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+
+	Users          int64 `json:"users"`            // пользователей с файлами по фильтрам
+	UsersToProcess int64 `json:"users_to_process"` // пользователей, у которых есть что скачать
+	SkippedNoGroup int64 `json:"skipped_no_group"` // пропущено: пустая колонка группы
+	SkippedDone    int64 `json:"skipped_done"`     // пропущено: всё скачано или постоянные ошибки
+
+	Files             int64            `json:"files"`              // файлов к скачиванию
+	Bytes             int64            `json:"bytes"`              // сумма размеров из Uploadcare API и Content-Length (с HEAD)
+	Missing           int64            `json:"missing"`            // файлов, удалённых или отсутствующих в группе (по Uploadcare API)
+	UnknownSize       int64            `json:"unknown_size"`       // файлов без Content-Length
+	InvalidUploadcare int64            `json:"invalid_uploadcare"` // значений, не прошедших ParseUploadcareURL
+	ResolveErrors     int64            `json:"resolve_errors"`     // значений, которые не разбирает ни один источник
+	HeadErrors        map[string]int64 `json:"head_errors"`        // ошибки HEAD по классам
+	Sources           map[string]int64 `json:"sources"`            // значений по источникам ссылок
+
+	Categories map[string]*PlanCategory `json:"categories"`
+	Issues     []PlanIssue              `json:"issues"`
+	Error      string                   `json:"error,omitempty"`
+
+	mutex sync.Mutex
+}
+
+func newPlanReport(spec JobSpec, head bool, categories []string) *PlanReport {
+	report := &PlanReport{
+		Spec:       spec,
+		Head:       head,
+		StartedAt:  time.Now(),
+		HeadErrors: make(map[string]int64),
+		Sources:    make(map[string]int64),
+		Categories: make(map[string]*PlanCategory, len(categories)),
+		Issues:     make([]PlanIssue, 0),
+	}
+	for _, name := range categories {
+		report.Categories[name] = &PlanCategory{}
+	}
+	return report
+}
+
+// update изменяет отчёт под его mutex (отчёт читается во время построения)
+func (r *PlanReport) update(fn func(r *PlanReport)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn(r)
+}
+
+// addIssue сохраняет пример ошибки, пока не набран лимит. Вызывается внутри update.
+func (r *PlanReport) addIssue(issue PlanIssue) {
+	if len(r.Issues) < planIssueLimit {
+		r.Issues = append(r.Issues, issue)
+	}
+}
+
+// snapshot копия отчёта для отдачи в API, пока план ещё строится
+func (r *PlanReport) snapshot() *PlanReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copied := &PlanReport{
+		Spec:              r.Spec,
+		Head:              r.Head,
+		StartedAt:         r.StartedAt,
+		FinishedAt:        r.FinishedAt,
+		Users:             r.Users,
+		UsersToProcess:    r.UsersToProcess,
+		SkippedNoGroup:    r.SkippedNoGroup,
+		SkippedDone:       r.SkippedDone,
+		Files:             r.Files,
+		Bytes:             r.Bytes,
+		Missing:           r.Missing,
+		UnknownSize:       r.UnknownSize,
+		InvalidUploadcare: r.InvalidUploadcare,
+		ResolveErrors:     r.ResolveErrors,
+		HeadErrors:        make(map[string]int64, len(r.HeadErrors)),
+		Sources:           make(map[string]int64, len(r.Sources)),
+		Categories:        make(map[string]*PlanCategory, len(r.Categories)),
+		Issues:            append([]PlanIssue(nil), r.Issues...),
+		Error:             r.Error,
+	}
+	for class, count := range r.HeadErrors {
+		copied.HeadErrors[class] = count
+	}
+	for name, count := range r.Sources {
+		copied.Sources[name] = count
+	}
+	for name, category := range r.Categories {
+		value := *category
+		copied.Categories[name] = &value
+	}
+	return copied
+}
+
+// StartPlan строит план задания в фоне (dry-run). head=true запрашивает размер каждого файла через HEAD.
+func (dm *DownloadManager) StartPlan(spec JobSpec, head bool) error {
+	if err := spec.Validate(dm.cfg.Source.CreatedColumn); err != nil {
+		return err
+	}
+
+	dm.planMutex.Lock()
+	defer dm.planMutex.Unlock()
+
+	if dm.planCancel != nil {
+		return fmt.Errorf("план уже строится")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	report := newPlanReport(spec, head, dm.categoryNames())
+	dm.plan = report
+	dm.planCancel = cancel
+
+	go func() {
+		defer cancel()
+		if err := dm.buildPlan(ctx, report); err != nil {
+			log.Printf("Ошибка построения плана: %v", err)
+		}
+
+		dm.planMutex.Lock()
+		dm.planCancel = nil
+		dm.planMutex.Unlock()
+	}()
+	return nil
+}
+
+// StopPlan прерывает построение плана; в отчёте остаются уже посчитанные итоги
+func (dm *DownloadManager) StopPlan() {
+	dm.planMutex.RLock()
+	cancel := dm.planCancel
+	dm.planMutex.RUnlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// LastPlan возвращает последний (или строящийся) план и признак того, что он ещё строится
+func (dm *DownloadManager) LastPlan() (*PlanReport, bool) {
+	dm.planMutex.RLock()
+	defer dm.planMutex.RUnlock()
+
+	if dm.plan == nil {
+		return nil, false
+	}
+	return dm.plan.snapshot(), dm.planCancel != nil
+}
+
+// Plan строит план задания синхронно
+func (dm *DownloadManager) Plan(ctx context.Context, spec JobSpec, head bool) (*PlanReport, error) {
+	if err := spec.Validate(dm.cfg.Source.CreatedColumn); err != nil {
+		return nil, err
+	}
+
+	report := newPlanReport(spec, head, dm.categoryNames())
+	err := dm.buildPlan(ctx, report)
+	return report.snapshot(), err
+}
+
+// buildPlan обходит пользователей по фильтрам пулом из WORKERS воркеров (параллельны только запросы HEAD)
+func (dm *DownloadManager) buildPlan(ctx context.Context, report *PlanReport) error {
+	log.Printf("📋 Построение плана: %s, HEAD: %v", report.Spec.String(), report.Head)
+
+	err := func() error {
+		filter, err := dm.resolveFilter(report.Spec)
+		if err != nil {
+			return err
+		}
+
+		workers := dm.cfg.Download.Workers
+		if workers < 1 {
+			workers = 1
+		}
+
+		usersChan := make(chan *models.User, dm.cfg.Download.BatchSize)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for user := range usersChan {
+					dm.planUser(ctx, report, user)
+				}
+			}()
+		}
+
+		streamErr := dm.streamUsers(ctx, filter, 0, report.Spec.OnlyMissing, nil, func(user *models.User) error {
+			select {
+			case usersChan <- user:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		close(usersChan)
+		wg.Wait()
+
+		if streamErr == nil {
+			streamErr = ctx.Err()
+		}
+		return streamErr
+	}()
+
+	report.update(func(r *PlanReport) {
+		now := time.Now()
+		r.FinishedAt = &now
+		if err != nil {
+			r.Error = err.Error()
+		}
+	})
+
+	summary := report.snapshot()
+	log.Printf("📋 План: пользователей %d (к обработке %d), файлов %d, %d байт, отсутствует %d, неверных ссылок %d, не Uploadcare %d",
+		summary.Users, summary.UsersToProcess, summary.Files, summary.Bytes, summary.Missing, summary.ResolveErrors, summary.InvalidUploadcare)
+	return err
+}
+
+// planUser учитывает одного пользователя в плане так же, как его обработал бы processUser
+func (dm *DownloadManager) planUser(ctx context.Context, report *PlanReport, user *models.User) {
+	report.update(func(r *PlanReport) { r.Users++ })
+
+	if !user.HasGroup() {
+		report.update(func(r *PlanReport) { r.SkippedNoGroup++ })
+		return
+	}
+
+	status, err := dm.userFileRepo.GetByUserID(user.ID)
+	if err != nil {
+		log.Printf("Ошибка чтения статуса пользователя %d: %v", user.ID, err)
+		status = make(map[string]bool)
+	}
+
+	pending, skipped := dm.pendingCategories(report.Spec, user, status)
+	report.update(func(r *PlanReport) {
+		for name, reason := range skipped {
+			switch reason {
+			case skipDownloaded:
+				r.Categories[name].Downloaded++
+			case skipPermanent:
+				r.Categories[name].Permanent++
+			}
+		}
+		if len(pending) == 0 {
+			r.SkippedDone++
+		} else {
+			r.UsersToProcess++
+		}
+	})
+
+	for _, category := range pending {
+		raw := strings.TrimSpace(user.Files[category.Name])
+
+		if _, _, _, err := ParseUploadcareURL(raw); err != nil {
+			report.update(func(r *PlanReport) { r.InvalidUploadcare++ })
+		}
+
+		// Группы Uploadcare и JSON списки раскрываются в отдельные файлы, как при скачивании
+		source, files, err := dm.downloader.Sources.ResolveFiles(ctx, raw)
+		if err != nil {
+			class := ErrorClass(err)
+			if class == ErrorClassUnknown {
+				class = ErrorClassBadURL
+			}
+			report.update(func(r *PlanReport) {
+				r.ResolveErrors++
+				r.addIssue(PlanIssue{UserID: user.ID, Category: category.Name, URL: raw, Class: class, Error: err.Error()})
+			})
+			continue
+		}
+
+		report.update(func(r *PlanReport) {
+			r.Sources[source.Name()]++
+			r.Categories[category.Name].Users++
+		})
+
+		for _, file := range files {
+			if ctx.Err() != nil {
+				return
+			}
+
+			// Удалённые файлы не скачиваются, размер из API не требует HEAD
+			if file.Missing || file.Size > 0 || !report.Head {
+				report.update(func(r *PlanReport) {
+					switch {
+					case file.Missing:
+						r.Missing++
+						r.Categories[category.Name].Missing++
+						r.addIssue(PlanIssue{UserID: user.ID, Category: category.Name, URL: file.URL, Class: ErrorClassMissing, Error: file.Reason})
+					default:
+						r.Files++
+						r.Categories[category.Name].Files++
+						r.Bytes += file.Size
+						r.Categories[category.Name].Bytes += file.Size
+					}
+				})
+				continue
+			}
+
+			fileURL := file.URL
+			report.update(func(r *PlanReport) {
+				r.Files++
+				r.Categories[category.Name].Files++
+			})
+
+			size, err := dm.downloader.HeadSize(ctx, fileURL)
+			report.update(func(r *PlanReport) {
+				switch {
+				case err != nil:
+					r.HeadErrors[ErrorClass(err)]++
+					r.addIssue(PlanIssue{UserID: user.ID, Category: category.Name, URL: fileURL, Class: ErrorClass(err), Error: err.Error()})
+				case size < 0:
+					r.UnknownSize++
+				default:
+					r.Bytes += size
+					r.Categories[category.Name].Bytes += size
+				}
+			})
+		}
+	}
+}
+
+// categoryNames имена категорий файлов из настроек
+func (dm *DownloadManager) categoryNames() []string {
+	categories := dm.layout.Categories()
+	names := make([]string, 0, len(categories))
+	for _, category := range categories {
+		names = append(names, category.Name)
+	}
+	return names
+}
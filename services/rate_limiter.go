@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"up-down/config"
+)
+
+// Параметры адаптации скорости
+const (
+	rateBackoffFactor  = 0.5  // во сколько раз снижается скорость при 429/503
+	rateRecoveryFactor = 1.25 // во сколько раз растёт скорость после серии успешных запросов
+)
+
+// HostRate состояние ограничения скорости одного хоста (для /api/download/progress)
+type HostRate struct {
+	Host         string     `json:"host"`
+	Rate         float64    `json:"rate"`  // текущая скорость, запросов в секунду
+	Burst        int        `json:"burst"` // размер пачки запросов без ожидания
+	Backoffs     int64      `json:"backoffs"`
+	Requests     int64      `json:"requests"`
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"` // пауза по Retry-After
+}
+
+// tokenBucket ограничитель скорости одного хоста: токены пополняются со скоростью rate, не больше burst
+type tokenBucket struct {
+	rate      float64
+	tokens    float64
+	updatedAt time.Time
+
+	successes    int // успешных запросов подряд с последнего изменения скорости
+	backoffs     int64
+	requests     int64
+	blockedUntil time.Time
+}
+
+// RateLimiter ограничивает скорость запросов к каждому хосту отдельно (token bucket).
+// Общий для всех воркеров: при 429/503 скорость хоста снижается, после серии успешных
+// запросов постепенно возвращается к настроенной.
+type RateLimiter struct {
+	rate     float64 // настроенная (максимальная) скорость
+	burst    int
+	minRate  float64
+	recovery int // успешных запросов подряд для повышения скорости
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(cfg *config.DownloadConfig) *RateLimiter {
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	minRate := cfg.RateMin
+	if minRate <= 0 || minRate > cfg.Rate {
+		minRate = cfg.Rate
+	}
+	recovery := cfg.RateRecovery
+	if recovery < 1 {
+		recovery = 1
+	}
+
+	return &RateLimiter{
+		rate:     cfg.Rate,
+		burst:    burst,
+		minRate:  minRate,
+		recovery: recovery,
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// limiterHost хост URL для ограничителя; пустая строка - без ограничения (file:// и неверные URL)
+func limiterHost(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return ""
+	}
+	return parsed.Host
+}
+
+// bucketLocked возвращает ограничитель хоста, создавая его с полной пачкой токенов. Вызывается под mutex.
+func (l *RateLimiter) bucketLocked(host string, now time.Time) *tokenBucket {
+	bucket, ok := l.buckets[host]
+	if !ok {
+		bucket = &tokenBucket{rate: l.rate, tokens: float64(l.burst), updatedAt: now}
+		l.buckets[host] = bucket
+	}
+	return bucket
+}
+
+// refill пополняет токены за прошедшее время
+func (b *tokenBucket) refill(now time.Time, burst int) {
+	if elapsed := now.Sub(b.updatedAt).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.updatedAt = now
+}
+
+// Wait ждёт разрешения на запрос к хосту URL. Возвращает время ожидания.
+func (l *RateLimiter) Wait(ctx context.Context, rawURL string) (time.Duration, error) {
+	host := limiterHost(rawURL)
+	if l == nil || l.rate <= 0 || host == "" {
+		return 0, nil
+	}
+
+	var waited time.Duration
+	for {
+		l.mutex.Lock()
+		now := time.Now()
+		bucket := l.bucketLocked(host, now)
+		bucket.refill(now, l.burst)
+
+		var wait time.Duration
+		switch {
+		case now.Before(bucket.blockedUntil):
+			wait = bucket.blockedUntil.Sub(now)
+		case bucket.tokens >= 1:
+			bucket.tokens--
+			bucket.requests++
+		default:
+			wait = time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+		}
+		l.mutex.Unlock()
+
+		if wait <= 0 {
+			return waited, nil
+		}
+
+		// После ожидания токен берётся заново: его мог забрать другой воркер
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return waited, ctx.Err()
+		case <-timer.C:
+			waited += wait
+		}
+	}
+}
+
+// Backoff снижает скорость хоста после ответа 429/503. Если сервер прислал Retry-After,
+// запросы к хосту приостанавливаются до этого времени для всех воркеров.
+func (l *RateLimiter) Backoff(rawURL string, retryAfter time.Duration) {
+	host := limiterHost(rawURL)
+	if l == nil || l.rate <= 0 || host == "" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	bucket := l.bucketLocked(host, now)
+	bucket.refill(now, l.burst)
+
+	bucket.rate *= rateBackoffFactor
+	if bucket.rate < l.minRate {
+		bucket.rate = l.minRate
+	}
+	bucket.tokens = 0
+	bucket.successes = 0
+	bucket.backoffs++
+	if retryAfter > 0 {
+		if until := now.Add(retryAfter); until.After(bucket.blockedUntil) {
+			bucket.blockedUntil = until
+		}
+	}
+}
+
+// Success учитывает успешный запрос: после серии успехов скорость хоста растёт до настроенной
+func (l *RateLimiter) Success(rawURL string) {
+	host := limiterHost(rawURL)
+	if l == nil || l.rate <= 0 || host == "" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket := l.bucketLocked(host, time.Now())
+	if bucket.rate >= l.rate {
+		return
+	}
+
+	bucket.successes++
+	if bucket.successes >= l.recovery {
+		bucket.rate *= rateRecoveryFactor
+		if bucket.rate > l.rate {
+			bucket.rate = l.rate
+		}
+		bucket.successes = 0
+	}
+}
+
+// Rates возвращает текущую скорость по каждому хосту
+func (l *RateLimiter) Rates() []HostRate {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	rates := make([]HostRate, 0, len(l.buckets))
+	for host, bucket := range l.buckets {
+		rate := HostRate{
+			Host:     host,
+			Rate:     bucket.rate,
+			Burst:    l.burst,
+			Backoffs: bucket.backoffs,
+			Requests: bucket.requests,
+		}
+		if now.Before(bucket.blockedUntil) {
+			until := bucket.blockedUntil
+			rate.BlockedUntil = &until
+		}
+		rates = append(rates, rate)
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Host < rates[j].Host })
+	return rates
+}
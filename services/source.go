@@ -0,0 +1,329 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"up-down/config"
+)
+
+// Source резолвер ссылок одного типа: превращает значение из колонки users
+// в список URL отдельных файлов
+type Source interface {
+	// Name имя источника для логов
+	Name() string
+	// Match проверяет, умеет ли источник обработать значение
+	Match(raw string) bool
+	// Resolve возвращает URL файлов в порядке их номеров
+	Resolve(ctx context.Context, raw string) ([]string, error)
+}
+
+// RemoteFile файл источника со сведениями, которые источник знает до скачивания
+type RemoteFile struct {
+	URL      string
+	UUID     string // UUID файла Uploadcare (если известен)
+	Name     string // исходное имя файла (если известно)
+	Size     int64  // размер в байтах (0 - неизвестен)
+	MimeType string
+	Missing  bool   // файл удалён или отсутствует в группе: скачивать нечего
+	Reason   string // причина отсутствия
+}
+
+// FileSource источник, который сообщает о файлах больше, чем URL (имена, размеры, удалённые файлы).
+// Необязательное расширение Source.
+type FileSource interface {
+	Source
+	ResolveFiles(ctx context.Context, raw string) ([]RemoteFile, error)
+}
+
+// SourceRegistry выбирает источник по формату ссылки.
+// Источники проверяются по порядку, побеждает первый подходящий.
+type SourceRegistry struct {
+	sources []Source
+}
+
+func NewSourceRegistry(sources ...Source) *SourceRegistry {
+	return &SourceRegistry{sources: sources}
+}
+
+// DefaultSourceRegistry реестр со всеми встроенными источниками.
+// file:// разрешён только при заданном DOWNLOAD_FILE_ROOT, ссылки Uploadcare распознаются только
+// на хостах UPLOADCARE_CDN_HOSTS, группы разбираются через REST API, если заданы ключи UPLOADCARE_*.
+func DefaultSourceRegistry(cfg *config.DownloadConfig, limiter *RateLimiter) *SourceRegistry {
+	fileRoot := cfg.FileRoot
+
+	hosts := newUploadcareHosts(cfg.Uploadcare.CDNHosts)
+
+	registry := NewSourceRegistry()
+	registry.Register(&jsonListSource{registry: registry})
+	if cfg.Uploadcare.PublicKey != "" {
+		registry.Register(newUploadcareAPISource(&cfg.Uploadcare, limiter))
+	}
+	registry.Register(&uploadcareGroupSource{hosts: hosts})
+	registry.Register(&uploadcareSingleSource{hosts: hosts})
+	registry.Register(&localFileSource{enabled: fileRoot != ""})
+	registry.Register(&httpSource{})
+	return registry
+}
+
+// Register добавляет источник в конец списка
+func (r *SourceRegistry) Register(source Source) {
+	r.sources = append(r.sources, source)
+}
+
+// Resolve находит источник для значения и возвращает URL файлов
+func (r *SourceRegistry) Resolve(ctx context.Context, raw string) (Source, []string, error) {
+	source, files, err := r.ResolveFiles(ctx, raw)
+	if err != nil {
+		return source, nil, err
+	}
+
+	urls := make([]string, 0, len(files))
+	for _, file := range files {
+		urls = append(urls, file.URL)
+	}
+	return source, urls, nil
+}
+
+// ResolveFiles находит источник для значения и возвращает файлы.
+// Для источников без FileSource известны только URL.
+func (r *SourceRegistry) ResolveFiles(ctx context.Context, raw string) (Source, []RemoteFile, error) {
+	raw = strings.TrimSpace(raw)
+	for _, source := range r.sources {
+		if !source.Match(raw) {
+			continue
+		}
+
+		if fileSource, ok := source.(FileSource); ok {
+			files, err := fileSource.ResolveFiles(ctx, raw)
+			return source, files, err
+		}
+
+		urls, err := source.Resolve(ctx, raw)
+		if err != nil {
+			return source, nil, err
+		}
+		files := make([]RemoteFile, 0, len(urls))
+		for _, url := range urls {
+			files = append(files, RemoteFile{URL: url})
+		}
+		return source, files, nil
+	}
+	return nil, nil, fmt.Errorf("неизвестный формат ссылки: %s", raw)
+}
+
+// uuidPattern UUID файла или группы Uploadcare
+const uuidPattern = `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`
+
+// defaultUploadcareHost CDN Uploadcare, если UPLOADCARE_CDN_HOSTS не задан
+const defaultUploadcareHost = "ucarecdn.com"
+
+// Группа - только uuid~N/ (с параметрами запроса). Одиночный файл может продолжаться после UUID:
+// имя файла (uuid/photo.jpg), операции CDN (uuid/-/resize/200x/); файл группы - uuid~N/nth/i/.
+var (
+	uploadcareGroupRe  = regexp.MustCompile(`^(https://([^/?#]+))/(` + uuidPattern + `)~(\d+)/?(?:[?#].*)?$`)
+	uploadcareSingleRe = regexp.MustCompile(`^(https://([^/?#]+))/(` + uuidPattern + `)(?:~\d+/nth/\d+)?(?:[/?#].*)?$`)
+)
+
+// uploadcareHosts хосты CDN Uploadcare (UPLOADCARE_CDN_HOSTS). Ссылки на другие хосты с UUID в пути
+// (presigned URL S3 и т.п.) не разбираются как Uploadcare и скачиваются как есть.
+type uploadcareHosts map[string]bool
+
+func newUploadcareHosts(hosts []string) uploadcareHosts {
+	set := make(uploadcareHosts, len(hosts))
+	for _, host := range hosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			set[host] = true
+		}
+	}
+	if len(set) == 0 {
+		set[defaultUploadcareHost] = true
+	}
+	return set
+}
+
+// match проверяет формат ссылки и её хост
+func (h uploadcareHosts) match(re *regexp.Regexp, raw string) bool {
+	matches := re.FindStringSubmatch(raw)
+	return matches != nil && h[strings.ToLower(matches[2])]
+}
+
+// ParseUploadcareURL парсит URL типа https://domain.com/uuid~count/ или https://domain.com/uuid/.
+// Файл группы (uuid~count/nth/i/) - один файл. Хост не проверяется.
+func ParseUploadcareURL(raw string) (baseURL string, uuid string, count int, err error) {
+	raw = strings.TrimSpace(raw)
+
+	if matches := uploadcareGroupRe.FindStringSubmatch(raw); matches != nil {
+		count, err = strconv.Atoi(matches[4])
+		if err != nil {
+			return "", "", 0, fmt.Errorf("ошибка парсинга количества файлов: %w", err)
+		}
+		return matches[1], matches[3], count, nil
+	}
+
+	if matches := uploadcareSingleRe.FindStringSubmatch(raw); matches != nil {
+		return matches[1], matches[3], 1, nil
+	}
+
+	return "", "", 0, fmt.Errorf("неверный формат URL: %s", raw)
+}
+
+// withQuery добавляет к URL файла параметры запроса исходной ссылки (токен доступа и т.п.)
+func withQuery(fileURL, raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.RawQuery == "" {
+		return fileURL
+	}
+	return fileURL + "?" + parsed.RawQuery
+}
+
+// uploadcareGroupSource группа файлов Uploadcare: https://ucarecdn.com/uuid~count/
+type uploadcareGroupSource struct {
+	hosts uploadcareHosts
+}
+
+func (s *uploadcareGroupSource) Name() string { return "uploadcare_group" }
+
+func (s *uploadcareGroupSource) Match(raw string) bool {
+	return s.hosts.match(uploadcareGroupRe, raw)
+}
+
+func (s *uploadcareGroupSource) Resolve(ctx context.Context, raw string) ([]string, error) {
+	baseURL, uuid, count, err := ParseUploadcareURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Файлы группы доступны по адресу nth/i/
+	urls := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		urls = append(urls, withQuery(fmt.Sprintf("%s/%s~%d/nth/%d/", baseURL, uuid, count, i), raw))
+	}
+	return urls, nil
+}
+
+// uploadcareSingleSource одиночный файл Uploadcare: https://ucarecdn.com/uuid/ или файл группы
+// https://ucarecdn.com/uuid~count/nth/i/. Ссылка скачивается как есть, с путём и параметрами.
+type uploadcareSingleSource struct {
+	hosts uploadcareHosts
+}
+
+func (s *uploadcareSingleSource) Name() string { return "uploadcare_single" }
+
+func (s *uploadcareSingleSource) Match(raw string) bool {
+	return s.hosts.match(uploadcareSingleRe, raw)
+}
+
+func (s *uploadcareSingleSource) Resolve(ctx context.Context, raw string) ([]string, error) {
+	if _, _, _, err := ParseUploadcareURL(raw); err != nil {
+		return nil, err
+	}
+	return []string{raw}, nil
+}
+
+// httpSource любая прямая HTTP(S) ссылка, в том числе presigned URL S3
+type httpSource struct{}
+
+func (s *httpSource) Name() string { return "http" }
+
+func (s *httpSource) Match(raw string) bool {
+	return strings.HasPrefix(raw, "https://") || strings.HasPrefix(raw, "http://")
+}
+
+func (s *httpSource) Resolve(ctx context.Context, raw string) ([]string, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("неверный формат URL: %s", raw)
+	}
+	return []string{raw}, nil
+}
+
+// localFileSource локальный файл: file:///path/to/file.
+// Путь отсчитывается от DOWNLOAD_FILE_ROOT.
+type localFileSource struct {
+	enabled bool
+}
+
+func (s *localFileSource) Name() string { return "file" }
+
+func (s *localFileSource) Match(raw string) bool {
+	return strings.HasPrefix(raw, "file://")
+}
+
+func (s *localFileSource) Resolve(ctx context.Context, raw string) ([]string, error) {
+	if !s.enabled {
+		return nil, fmt.Errorf("ссылки file:// отключены (не задан DOWNLOAD_FILE_ROOT): %s", raw)
+	}
+
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Path == "" {
+		return nil, fmt.Errorf("неверный формат URL: %s", raw)
+	}
+	return []string{raw}, nil
+}
+
+// jsonListSource JSON массив ссылок: ["https://...", "https://.../uuid~2/"].
+// Каждый элемент разбирается остальными источниками реестра, результат объединяется.
+type jsonListSource struct {
+	registry *SourceRegistry
+}
+
+func (s *jsonListSource) Name() string { return "json_list" }
+
+func (s *jsonListSource) Match(raw string) bool {
+	return strings.HasPrefix(raw, "[")
+}
+
+func (s *jsonListSource) Resolve(ctx context.Context, raw string) ([]string, error) {
+	files, err := s.ResolveFiles(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make([]string, 0, len(files))
+	for _, file := range files {
+		urls = append(urls, file.URL)
+	}
+	return urls, nil
+}
+
+func (s *jsonListSource) ResolveFiles(ctx context.Context, raw string) ([]RemoteFile, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &items); err != nil {
+		return nil, badListError(raw, fmt.Errorf("ошибка разбора JSON списка ссылок: %w", err))
+	}
+
+	files := make([]RemoteFile, 0, len(items))
+	for i, element := range items {
+		// Пропущенный элемент означал бы категорию, записанную скачанной без части файлов
+		var value interface{}
+		json.Unmarshal(element, &value)
+		item, ok := value.(string)
+		if !ok {
+			return nil, badListError(raw, fmt.Errorf("элемент %d JSON списка ссылок не строка: %s", i, element))
+		}
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if s.Match(item) {
+			return nil, badListError(raw, fmt.Errorf("элемент %d JSON списка ссылок - вложенный список: %s", i, item))
+		}
+
+		_, itemFiles, err := s.registry.ResolveFiles(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, itemFiles...)
+	}
+	return files, nil
+}
+
+// badListError неверный JSON список ссылок - постоянная ошибка bad_url
+func badListError(raw string, err error) *DownloadError {
+	return &DownloadError{URL: raw, Class: ErrorClassBadURL, Permanent: true, Err: err}
+}
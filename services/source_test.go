@@ -0,0 +1,150 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"up-down/config"
+)
+
+func TestSourceRegistryResolve(t *testing.T) {
+	const group = "https://ucarecdn.com/" + testGroupUUID
+	const single = "https://ucarecdn.com/" + testFileUUID1
+	groupURLs := []string{group + "~3/nth/0/", group + "~3/nth/1/", group + "~3/nth/2/"}
+
+	tests := []struct {
+		raw    string
+		source string
+		urls   []string
+	}{
+		// Форматы, которые разбирал прежний ParseUploadcareURL
+		{group + "~3/", "uploadcare_group", groupURLs},
+		{group + "~3", "uploadcare_group", groupURLs},
+		{"  " + group + "~3/\n", "uploadcare_group", groupURLs},
+		{"https://UCARECDN.com/" + testGroupUUID + "~1/", "uploadcare_group", []string{"https://UCARECDN.com/" + testGroupUUID + "~1/nth/0/"}},
+		{single + "/", "uploadcare_single", []string{single + "/"}},
+		{single, "uploadcare_single", []string{single}},
+
+		// Продолжение ссылки и параметры запроса сохраняются
+		{single + "/photo.jpg", "uploadcare_single", []string{single + "/photo.jpg"}},
+		{single + "/-/resize/200x/-/format/webp/", "uploadcare_single", []string{single + "/-/resize/200x/-/format/webp/"}},
+		{single + "/?token=abc", "uploadcare_single", []string{single + "/?token=abc"}},
+		{group + "~2/?token=abc", "uploadcare_group", []string{group + "~2/nth/0/?token=abc", group + "~2/nth/1/?token=abc"}},
+
+		// Файл группы - один файл, а не вся группа
+		{group + "~3/nth/1/", "uploadcare_single", []string{group + "~3/nth/1/"}},
+		{group + "~3/nth/1/-/preview/", "uploadcare_single", []string{group + "~3/nth/1/-/preview/"}},
+
+		// Не Uploadcare: другой хост, UUID не в первом сегменте пути или не UUID - ссылка как есть
+		{"https://cdn.example.com/" + testFileUUID1 + "/", "http", []string{"https://cdn.example.com/" + testFileUUID1 + "/"}},
+		{"https://cdn.example.com/" + testGroupUUID + "~2/", "http", []string{"https://cdn.example.com/" + testGroupUUID + "~2/"}},
+		{
+			"https://bucket.s3.amazonaws.com/" + testFileUUID1 + "?X-Amz-Signature=abc&X-Amz-Expires=300",
+			"http",
+			[]string{"https://bucket.s3.amazonaws.com/" + testFileUUID1 + "?X-Amz-Signature=abc&X-Amz-Expires=300"},
+		},
+		{"https://example.com/files/" + testFileUUID1 + "/", "http", []string{"https://example.com/files/" + testFileUUID1 + "/"}},
+		{"https://example.com/deadbeef/a.pdf", "http", []string{"https://example.com/deadbeef/a.pdf"}},
+		{"https://ucarecdn.com/" + testFileUUID1 + "x/", "http", []string{"https://ucarecdn.com/" + testFileUUID1 + "x/"}},
+		{group + "~3/-/preview/", "http", []string{group + "~3/-/preview/"}},
+
+		{`["` + single + `/", "` + group + `~2/", ""]`, "json_list", []string{single + "/", group + "~2/nth/0/", group + "~2/nth/1/"}},
+	}
+
+	cfg := &config.DownloadConfig{}
+	registry := DefaultSourceRegistry(cfg, NewRateLimiter(cfg))
+	for _, tt := range tests {
+		source, urls, err := registry.Resolve(context.Background(), tt.raw)
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", tt.raw, err)
+			continue
+		}
+		if source.Name() != tt.source {
+			t.Errorf("Resolve(%q): источник %s, ожидался %s", tt.raw, source.Name(), tt.source)
+		}
+		if strings.Join(urls, " ") != strings.Join(tt.urls, " ") {
+			t.Errorf("Resolve(%q) = %v, ожидалось %v", tt.raw, urls, tt.urls)
+		}
+	}
+}
+
+func TestParseUploadcareURL(t *testing.T) {
+	tests := []struct {
+		raw   string
+		base  string
+		uuid  string
+		count int
+	}{
+		{"https://ucarecdn.com/" + testGroupUUID + "~12/", "https://ucarecdn.com", testGroupUUID, 12},
+		{"https://ucarecdn.com/" + testGroupUUID + "~2/?token=abc", "https://ucarecdn.com", testGroupUUID, 2},
+		{"https://ucarecdn.com/" + testGroupUUID + "~2/nth/1/-/resize/100x/", "https://ucarecdn.com", testGroupUUID, 1},
+		{"https://files.example.com/" + testFileUUID1 + "/scan.pdf", "https://files.example.com", testFileUUID1, 1},
+	}
+
+	for _, tt := range tests {
+		base, uuid, count, err := ParseUploadcareURL(tt.raw)
+		if err != nil || base != tt.base || uuid != tt.uuid || count != tt.count {
+			t.Errorf("ParseUploadcareURL(%q) = %s, %s, %d, %v", tt.raw, base, uuid, count, err)
+		}
+	}
+
+	for _, raw := range []string{"", "http://ucarecdn.com/" + testFileUUID1 + "/", "https://ucarecdn.com/not-a-uuid/", "https://ucarecdn.com/"} {
+		if _, _, _, err := ParseUploadcareURL(raw); err == nil {
+			t.Errorf("ParseUploadcareURL(%q): ожидалась ошибка", raw)
+		}
+	}
+}
+
+func TestSourceRegistryCDNHosts(t *testing.T) {
+	cfg := &config.DownloadConfig{Uploadcare: config.UploadcareConfig{CDNHosts: []string{"files.example.com", " CDN.Example.org "}}}
+	registry := DefaultSourceRegistry(cfg, NewRateLimiter(cfg))
+
+	tests := []struct {
+		raw    string
+		source string
+	}{
+		{"https://files.example.com/" + testFileUUID1 + "/", "uploadcare_single"},
+		{"https://cdn.example.org/" + testGroupUUID + "~2/", "uploadcare_group"},
+		{"https://ucarecdn.com/" + testFileUUID1 + "/", "http"},
+	}
+
+	for _, tt := range tests {
+		source, _, err := registry.Resolve(context.Background(), tt.raw)
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", tt.raw, err)
+			continue
+		}
+		if source.Name() != tt.source {
+			t.Errorf("Resolve(%q): источник %s, ожидался %s", tt.raw, source.Name(), tt.source)
+		}
+	}
+}
+
+func TestJSONListErrors(t *testing.T) {
+	const single = "https://ucarecdn.com/" + testFileUUID1 + "/"
+
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{name: "неверный JSON", raw: `["` + single + `"`},
+		{name: "не массив строк", raw: `[{"url": "` + single + `"}]`},
+		{name: "число", raw: `["` + single + `", 42]`},
+		{name: "null", raw: `["` + single + `", null]`},
+		{name: "вложенный массив", raw: `["` + single + `", ["` + single + `"]]`},
+		{name: "вложенный список строкой", raw: `["` + single + `", "[\"` + single + `\"]"]`},
+	}
+
+	cfg := &config.DownloadConfig{}
+	registry := DefaultSourceRegistry(cfg, NewRateLimiter(cfg))
+	for _, tt := range tests {
+		_, files, err := registry.ResolveFiles(context.Background(), tt.raw)
+		if err == nil {
+			t.Errorf("%s: ожидалась ошибка, получено %d файлов", tt.name, len(files))
+			continue
+		}
+		if ErrorClass(err) != ErrorClassBadURL || !IsPermanent(err) {
+			t.Errorf("%s: ошибка %v класса %s, ожидалась постоянная %s", tt.name, err, ErrorClass(err), ErrorClassBadURL)
+		}
+	}
+}
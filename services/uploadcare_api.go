@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"up-down/config"
+)
+
+// uploadcareAPITimeout таймаут запроса информации о группе
+const uploadcareAPITimeout = 30 * time.Second
+
+// uploadcareGroupInfo ответ GET /groups/{uuid}~{count}/ REST API Uploadcare.
+// Элемент files равен null, если файл группы недоступен.
+type uploadcareGroupInfo struct {
+	ID         string                `json:"id"`
+	FilesCount int                   `json:"files_count"`
+	Files      []*uploadcareFileInfo `json:"files"`
+}
+
+type uploadcareFileInfo struct {
+	UUID             string     `json:"uuid"`
+	OriginalFilename string     `json:"original_filename"`
+	Size             int64      `json:"size"`
+	MimeType         string     `json:"mime_type"`
+	DatetimeRemoved  *time.Time `json:"datetime_removed"`
+}
+
+// uploadcareAPISource группа файлов Uploadcare, разобранная через REST API: настоящие UUID файлов,
+// исходные имена, размеры и MIME типы. Удалённые и отсутствующие файлы группы отмечаются до скачивания.
+// Если API недоступен, группа разбирается по ~N из ссылки, как в uploadcareGroupSource.
+type uploadcareAPISource struct {
+	cfg      *config.UploadcareConfig
+	client   *http.Client
+	limiter  *RateLimiter
+	hosts    uploadcareHosts
+	fallback *uploadcareGroupSource
+}
+
+func newUploadcareAPISource(cfg *config.UploadcareConfig, limiter *RateLimiter) *uploadcareAPISource {
+	hosts := newUploadcareHosts(cfg.CDNHosts)
+	return &uploadcareAPISource{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: uploadcareAPITimeout},
+		limiter:  limiter,
+		hosts:    hosts,
+		fallback: &uploadcareGroupSource{hosts: hosts},
+	}
+}
+
+func (s *uploadcareAPISource) Name() string { return "uploadcare_api" }
+
+func (s *uploadcareAPISource) Match(raw string) bool {
+	return s.hosts.match(uploadcareGroupRe, raw)
+}
+
+func (s *uploadcareAPISource) Resolve(ctx context.Context, raw string) ([]string, error) {
+	files, err := s.ResolveFiles(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make([]string, 0, len(files))
+	for _, file := range files {
+		urls = append(urls, file.URL)
+	}
+	return urls, nil
+}
+
+func (s *uploadcareAPISource) ResolveFiles(ctx context.Context, raw string) ([]RemoteFile, error) {
+	baseURL, uuid, count, err := ParseUploadcareURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.groupInfo(ctx, uuid, count)
+	if err != nil {
+		if IsPermanent(err) {
+			return nil, err
+		}
+		log.Printf("⚠️  Uploadcare API недоступен для группы %s (%v), файлы определяются по ссылке", uuid, err)
+
+		urls, err := s.fallback.Resolve(ctx, raw)
+		if err != nil {
+			return nil, err
+		}
+		files := make([]RemoteFile, 0, len(urls))
+		for _, url := range urls {
+			files = append(files, RemoteFile{URL: url})
+		}
+		return files, nil
+	}
+
+	// Число файлов из ссылки - сколько их ожидает пользователь; недостающие отмечаются отсутствующими
+	total := count
+	if len(info.Files) > total {
+		total = len(info.Files)
+	}
+
+	files := make([]RemoteFile, 0, total)
+	for i := 0; i < total; i++ {
+		var file *uploadcareFileInfo
+		if i < len(info.Files) {
+			file = info.Files[i]
+		}
+
+		switch {
+		case file == nil || file.UUID == "":
+			files = append(files, RemoteFile{
+				URL:     withQuery(fmt.Sprintf("%s/%s~%d/nth/%d/", baseURL, uuid, count, i), raw),
+				Missing: true,
+				Reason:  fmt.Sprintf("файл %d отсутствует в группе %s", i, uuid),
+			})
+		case file.DatetimeRemoved != nil:
+			files = append(files, RemoteFile{
+				URL:     withQuery(fmt.Sprintf("%s/%s/", baseURL, file.UUID), raw),
+				UUID:    file.UUID,
+				Name:    file.OriginalFilename,
+				Missing: true,
+				Reason:  fmt.Sprintf("файл %s удалён %s", file.UUID, file.DatetimeRemoved.Format(time.RFC3339)),
+			})
+		default:
+			files = append(files, RemoteFile{
+				URL:      withQuery(fmt.Sprintf("%s/%s/", baseURL, file.UUID), raw),
+				UUID:     file.UUID,
+				Name:     file.OriginalFilename,
+				Size:     file.Size,
+				MimeType: file.MimeType,
+			})
+		}
+	}
+	return files, nil
+}
+
+// groupInfo запрашивает информацию о группе. Группа, которой нет (404), - постоянная ошибка.
+func (s *uploadcareAPISource) groupInfo(ctx context.Context, uuid string, count int) (*uploadcareGroupInfo, error) {
+	apiURL := fmt.Sprintf("%s/groups/%s~%d/", s.cfg.APIURL, uuid, count)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, &DownloadError{URL: apiURL, Class: ErrorClassBadURL, Permanent: true, Err: err}
+	}
+	req.Header.Set("Accept", "application/vnd.uploadcare-v0.7+json")
+	req.Header.Set("Authorization", fmt.Sprintf("Uploadcare.Simple %s:%s", s.cfg.PublicKey, s.cfg.SecretKey))
+
+	// Запросы к API ограничиваются тем же ограничителем, что и скачивание
+	if _, err := s.limiter.Wait(ctx, apiURL); err != nil {
+		return nil, requestError(apiURL, err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, requestError(apiURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		s.limiter.Backoff(apiURL, parseRetryAfter(resp.Header.Get("Retry-After")))
+		return nil, httpError(apiURL, resp)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, httpError(apiURL, resp)
+	case resp.StatusCode != http.StatusOK:
+		// Неверные ключи и прочие ответы API не означают, что группы нет
+		de := httpError(apiURL, resp)
+		de.Permanent = false
+		return nil, de
+	}
+	s.limiter.Success(apiURL)
+
+	var info uploadcareGroupInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("ошибка разбора ответа Uploadcare API: %w", err)
+	}
+	return &info, nil
+}
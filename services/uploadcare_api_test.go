@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"up-down/config"
+	"up-down/models"
+)
+
+const (
+	testGroupUUID = "0b7d5f0e-4a3b-4c1e-9d2f-8a6b5c4d3e2f"
+	testFileUUID1 = "11111111-2222-4333-8444-555555555555"
+	testFileUUID2 = "22222222-3333-4444-8555-666666666666"
+	testFileUUID3 = "33333333-4444-4555-8666-777777777777"
+)
+
+// fakeUploadcareAPI заглушка GET /groups/{uuid}~{count}/: ответы по пути запроса
+func fakeUploadcareAPI(t *testing.T, responses map[string]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Uploadcare.Simple public:secret" {
+			t.Errorf("неверный Authorization: %q", auth)
+		}
+
+		body, ok := responses[r.URL.Path]
+		switch {
+		case !ok:
+			http.Error(w, `{"detail":"Not found."}`, http.StatusNotFound)
+		case strings.HasPrefix(body, "status:"):
+			http.Error(w, body, http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/vnd.uploadcare-v0.7+json")
+			w.Write([]byte(body))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestAPISource(apiURL string) *uploadcareAPISource {
+	return newUploadcareAPISource(
+		&config.UploadcareConfig{APIURL: apiURL, PublicKey: "public", SecretKey: "secret"},
+		NewRateLimiter(&config.DownloadConfig{}),
+	)
+}
+
+func TestUploadcareAPIResolveFiles(t *testing.T) {
+	server := fakeUploadcareAPI(t, map[string]string{
+		"/groups/" + testGroupUUID + "~4/": `{
+			"id": "` + testGroupUUID + `~4",
+			"files_count": 4,
+			"files": [
+				{"uuid": "` + testFileUUID1 + `", "original_filename": "../../etc/Паспорт РФ.pdf", "size": 1024, "mime_type": "application/pdf"},
+				null,
+				{"uuid": "` + testFileUUID2 + `", "original_filename": "scan.jpg", "size": 2048, "mime_type": "image/jpeg",
+				 "datetime_removed": "2024-03-01T10:00:00Z"},
+				{"uuid": "` + testFileUUID3 + `", "original_filename": "..\\..\\windows\\photo.png", "size": 4096, "mime_type": "image/png"}
+			]
+		}`,
+	})
+	source := newTestAPISource(server.URL)
+
+	raw := "https://ucarecdn.com/" + testGroupUUID + "~4/"
+	if !source.Match(raw) {
+		t.Fatalf("источник не подходит для %s", raw)
+	}
+	files, err := source.ResolveFiles(context.Background(), raw)
+	if err != nil {
+		t.Fatalf("ResolveFiles: %v", err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("файлов %d, ожидалось 4: %+v", len(files), files)
+	}
+
+	want := []RemoteFile{
+		{URL: "https://ucarecdn.com/" + testFileUUID1 + "/", UUID: testFileUUID1, Name: "../../etc/Паспорт РФ.pdf", Size: 1024, MimeType: "application/pdf"},
+		{URL: "https://ucarecdn.com/" + testGroupUUID + "~4/nth/1/", Missing: true},
+		{URL: "https://ucarecdn.com/" + testFileUUID2 + "/", UUID: testFileUUID2, Name: "scan.jpg", Missing: true},
+		{URL: "https://ucarecdn.com/" + testFileUUID3 + "/", UUID: testFileUUID3, Name: `..\..\windows\photo.png`, Size: 4096, MimeType: "image/png"},
+	}
+	for i, file := range files {
+		if file.Missing && file.Reason == "" {
+			t.Errorf("файл %d: нет причины отсутствия", i)
+		}
+		file.Reason = ""
+		if file != want[i] {
+			t.Errorf("файл %d = %+v, ожидалось %+v", i, file, want[i])
+		}
+	}
+
+	// Исходные имена попадают в ключ очищенными и не выходят из директории категории
+	layout, err := NewLayout(&config.Config{
+		Download: config.DownloadConfig{FileNameTemplate: "{n}_{original}"},
+		Source: config.SourceConfig{
+			GroupColumn: "citizenship_id",
+			Categories:  []config.FileCategory{{Name: "document", Column: "document", Dir: "documents", Prefix: "document"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &models.User{ID: 7, Group: sql.NullString{String: "1", Valid: true}}
+
+	keys := map[int]string{
+		0: "1/user_7/documents/1_Паспорт_РФ",
+		3: "1/user_7/documents/4_photo",
+	}
+	for i, wantKey := range keys {
+		if key := layout.FileKey(user, "document", i+1, files[i].Name); key != wantKey {
+			t.Errorf("ключ файла %d (%q) = %s, ожидалось %s", i, files[i].Name, key, wantKey)
+		}
+	}
+}
+
+func TestUploadcareAPIGroupNotFound(t *testing.T) {
+	server := fakeUploadcareAPI(t, nil)
+	source := newTestAPISource(server.URL)
+
+	_, err := source.ResolveFiles(context.Background(), "https://ucarecdn.com/"+testGroupUUID+"~2/")
+	if err == nil {
+		t.Fatal("ожидалась ошибка для отсутствующей группы")
+	}
+	if !IsPermanent(err) || ErrorClass(err) != ErrorClassHTTP404 {
+		t.Errorf("ошибка %v: постоянная %v, класс %s, ожидалась постоянная %s", err, IsPermanent(err), ErrorClass(err), ErrorClassHTTP404)
+	}
+}
+
+func TestUploadcareAPIFallback(t *testing.T) {
+	raw := "https://ucarecdn.com/" + testGroupUUID + "~2/"
+	wantURLs := []string{
+		"https://ucarecdn.com/" + testGroupUUID + "~2/nth/0/",
+		"https://ucarecdn.com/" + testGroupUUID + "~2/nth/1/",
+	}
+
+	t.Run("ошибка API", func(t *testing.T) {
+		server := fakeUploadcareAPI(t, map[string]string{"/groups/" + testGroupUUID + "~2/": "status:500"})
+		files, err := newTestAPISource(server.URL).ResolveFiles(context.Background(), raw)
+		if err != nil {
+			t.Fatalf("ResolveFiles: %v", err)
+		}
+		if len(files) != len(wantURLs) {
+			t.Fatalf("файлов %d, ожидалось %d", len(files), len(wantURLs))
+		}
+		for i, file := range files {
+			if file.URL != wantURLs[i] || file.Missing {
+				t.Errorf("файл %d = %+v, ожидался %s", i, file, wantURLs[i])
+			}
+		}
+	})
+
+	t.Run("API не настроен", func(t *testing.T) {
+		cfg := &config.DownloadConfig{}
+		source, urls, err := DefaultSourceRegistry(cfg, NewRateLimiter(cfg)).Resolve(context.Background(), raw)
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		if source.Name() != "uploadcare_group" {
+			t.Errorf("источник %s, ожидался uploadcare_group", source.Name())
+		}
+		if strings.Join(urls, " ") != strings.Join(wantURLs, " ") {
+			t.Errorf("URL %v, ожидалось %v", urls, wantURLs)
+		}
+	})
+
+	t.Run("API настроен", func(t *testing.T) {
+		cfg := &config.DownloadConfig{Uploadcare: config.UploadcareConfig{APIURL: "http://127.0.0.1:0", PublicKey: "public"}}
+		source, _, _ := DefaultSourceRegistry(cfg, NewRateLimiter(cfg)).ResolveFiles(context.Background(), "https://ucarecdn.com/"+testFileUUID1+"/")
+		if source == nil || source.Name() != "uploadcare_single" {
+			t.Errorf("одиночный файл должен разбираться без API, источник %v", source)
+		}
+	})
+}
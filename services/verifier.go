@@ -0,0 +1,495 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"up-down/config"
+	"up-down/models"
+	"up-down/repositories"
+	"up-down/storage"
+)
+
+// Виды несоответствий между диском и базой данных
+const (
+	IssueMissingDir     = "missing_dir"       // в user_file_statuses есть запись, а директории нет
+	IssueMissingFiles   = "missing_files"     // категория отмечена скачанной, но файлов нет
+	IssueUntrackedFiles = "untracked_files"   // файлы на диске есть, а в user_file_statuses категория не отмечена
+	IssueEmptyDir       = "empty_dir"         // пустая директория пользователя
+	IssueOrphanTmp      = "orphan_tmp"        // недокачанный .tmp файл
+	IssueMoved          = "moved"             // путь пользователя по раскладке изменился (citizenship_id, ФИО и т.п.)
+	IssueUnknownUser    = "unknown_user"      // директория есть, а пользователя в users нет
+	IssueChecksum       = "checksum_mismatch" // файл не совпадает с manifest.json
+)
+
+// verifyBatchSize размер пачки id при запросе пользователей из users
+const verifyBatchSize = 1000
+
+// VerifyIssue одно найденное несоответствие
+type VerifyIssue struct {
+	Type   string `json:"type"`
+	UserID int64  `json:"user_id,omitempty"`
+	Path   string `json:"path"`
+	Detail string `json:"detail,omitempty"`
+	Fixed  bool   `json:"fixed"`
+}
+
+// VerifyReport результат сверки диска и базы данных
+type VerifyReport struct {
+	Fix          bool           `json:"fix"`
+	StartedAt    time.Time      `json:"started_at"`
+	FinishedAt   *time.Time     `json:"finished_at"`
+	CheckedDirs  int            `json:"checked_dirs"`
+	CheckedUsers int            `json:"checked_users"`
+	Counts       map[string]int `json:"counts"`
+	Issues       []VerifyIssue  `json:"issues"`
+	Error        string         `json:"error,omitempty"`
+}
+
+func (r *VerifyReport) add(issue VerifyIssue) {
+	r.Counts[issue.Type]++
+	r.Issues = append(r.Issues, issue)
+}
+
+// userLocation директория пользователя, найденная в хранилище
+type userLocation struct {
+	path       string          // префикс в хранилище по раскладке DIR_LAYOUT
+	categories map[string]bool // категории, в поддиректориях которых есть файлы
+}
+
+// Verifier сверяет директории пользователей в хранилище (по раскладке DIR_LAYOUT) с user_file_statuses и users
+type Verifier struct {
+	cfg          *config.Config
+	userRepo     *repositories.UserRepository
+	userFileRepo *repositories.UserFileRepository
+	store        storage.Storage
+	layout       *Layout
+
+	mutex   sync.RWMutex
+	running bool
+	report  *VerifyReport
+}
+
+func NewVerifier(cfg *config.Config, userRepo *repositories.UserRepository, userFileRepo *repositories.UserFileRepository, store storage.Storage, layout *Layout) *Verifier {
+	return &Verifier{
+		cfg:          cfg,
+		userRepo:     userRepo,
+		userFileRepo: userFileRepo,
+		store:        store,
+		layout:       layout,
+	}
+}
+
+// Start запускает сверку в фоне (для веб-интерфейса)
+func (v *Verifier) Start(fix bool) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.running {
+		return fmt.Errorf("проверка уже запущена")
+	}
+	v.running = true
+
+	go func() {
+		report, err := v.Run(context.Background(), fix)
+		if err != nil {
+			log.Printf("Ошибка проверки файлов: %v", err)
+		}
+
+		v.mutex.Lock()
+		v.running = false
+		v.report = report
+		v.mutex.Unlock()
+	}()
+	return nil
+}
+
+// LastReport возвращает последний отчёт и признак того, что проверка выполняется
+func (v *Verifier) LastReport() (*VerifyReport, bool) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	return v.report, v.running
+}
+
+// Run выполняет сверку. Если fix=true, исправляет найденные несоответствия.
+func (v *Verifier) Run(ctx context.Context, fix bool) (*VerifyReport, error) {
+	report := &VerifyReport{
+		Fix:       fix,
+		StartedAt: time.Now(),
+		Counts:    make(map[string]int),
+		Issues:    make([]VerifyIssue, 0),
+	}
+	defer func() {
+		now := time.Now()
+		report.FinishedAt = &now
+	}()
+
+	fail := func(err error) (*VerifyReport, error) {
+		report.Error = err.Error()
+		return report, err
+	}
+
+	// 1. Обходим хранилище по директориям верхнего уровня раскладки и временные файлы на диске
+	locations, err := v.scanStorage(ctx, report)
+	if err != nil {
+		return fail(err)
+	}
+	if err := v.scanStaging(ctx, report, locations); err != nil {
+		return fail(err)
+	}
+
+	// 2. Сверяем пользователей, найденных в хранилище, пачками
+	ids := make([]int64, 0, len(locations))
+	for id := range locations {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for start := 0; start < len(ids); start += verifyBatchSize {
+		end := min(start+verifyBatchSize, len(ids))
+		if err := v.checkBatch(ctx, report, ids[start:end], locations); err != nil {
+			return fail(err)
+		}
+	}
+
+	// 3. Пользователи из user_file_statuses, директорий которых в хранилище нет
+	afterID := int64(0)
+	for {
+		batch, err := v.userFileRepo.GetUserIDsAfter(afterID, verifyBatchSize)
+		if err != nil {
+			return fail(fmt.Errorf("ошибка чтения user_file_statuses: %w", err))
+		}
+		if len(batch) == 0 {
+			break
+		}
+		afterID = batch[len(batch)-1]
+
+		missing := make([]int64, 0, len(batch))
+		for _, id := range batch {
+			if _, ok := locations[id]; !ok {
+				missing = append(missing, id)
+			}
+		}
+		if err := v.checkBatch(ctx, report, missing, locations); err != nil {
+			return fail(err)
+		}
+	}
+
+	return report, nil
+}
+
+// checkBatch загружает статусы и записи users пачки пользователей и сверяет каждого
+func (v *Verifier) checkBatch(ctx context.Context, report *VerifyReport, ids []int64, locations map[int64][]userLocation) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	statuses, err := v.userFileRepo.GetByUserIDs(ids)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения user_file_statuses: %w", err)
+	}
+	users, err := v.userRepo.GetByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.CheckedUsers++
+		v.checkUser(ctx, report, id, locations[id], statuses[id], users[id])
+	}
+	return nil
+}
+
+// scanStorage обходит директории пользователей в хранилище по одной директории верхнего уровня
+// ({citizenship_id} в раскладке по умолчанию), попутно находя расхождения с manifest.json.
+// В памяти остаются только найденные директории пользователей, а не список всех объектов.
+func (v *Verifier) scanStorage(ctx context.Context, report *VerifyReport) (map[int64][]userLocation, error) {
+	dirs, err := storage.ListDirs(ctx, v.store, "")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения хранилища: %w", err)
+	}
+
+	locations := make(map[int64][]userLocation)
+	for _, dir := range dirs {
+		// Служебные директории (.objects, .index) не принадлежат пользователям
+		if strings.HasPrefix(dir, ".") {
+			continue
+		}
+		if err := v.scanPrefix(ctx, report, dir+"/", locations); err != nil {
+			return nil, err
+		}
+	}
+	return locations, nil
+}
+
+// scanPrefix обходит объекты одной директории верхнего уровня и добавляет найденных пользователей в locations
+func (v *Verifier) scanPrefix(ctx context.Context, report *VerifyReport, prefix string, locations map[int64][]userLocation) error {
+	objects, err := v.store.List(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения хранилища %s: %w", prefix, err)
+	}
+
+	byKey := make(map[string]*userLocation)
+	userIDs := make(map[string]int64)
+	hasManifest := make(map[string]bool)
+	order := make([]string, 0)
+
+	for _, obj := range objects {
+		// Временные файлы проверяются при обходе DOWNLOAD_DIR
+		if isTempFile(obj.Key) {
+			continue
+		}
+
+		userID, userKey, ok := v.layout.ParseUserKey(obj.Key)
+		if !ok || obj.Key == userKey {
+			continue
+		}
+		rel := strings.TrimPrefix(obj.Key, userKey+"/")
+
+		location, ok := byKey[userKey]
+		if !ok {
+			location = &userLocation{
+				path:       userKey,
+				categories: make(map[string]bool),
+			}
+			byKey[userKey] = location
+			userIDs[userKey] = userID
+			order = append(order, userKey)
+		}
+
+		if rel == ManifestFileName {
+			hasManifest[userKey] = true
+		}
+		for _, category := range v.layout.Categories() {
+			if strings.HasPrefix(rel, category.Dir+"/") {
+				location.categories[category.Name] = true
+			}
+		}
+	}
+
+	for _, userKey := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.CheckedDirs++
+		userID := userIDs[userKey]
+
+		if hasManifest[userKey] {
+			mismatches, err := VerifyManifest(ctx, v.store, userKey)
+			if err != nil {
+				log.Printf("Ошибка проверки манифеста %s: %v", userKey, err)
+			}
+			for _, mismatch := range mismatches {
+				report.add(VerifyIssue{
+					Type:   IssueChecksum,
+					UserID: userID,
+					Path:   v.store.Location(path.Join(userKey, mismatch.Path)),
+					Detail: mismatch.Problem,
+				})
+			}
+		}
+
+		locations[userID] = append(locations[userID], *byKey[userKey])
+	}
+
+	return nil
+}
+
+// scanStaging обходит DOWNLOAD_DIR, где лежат временные файлы скачивания:
+// находит недокачанные .tmp файлы и пустые директории пользователей
+func (v *Verifier) scanStaging(ctx context.Context, report *VerifyReport, locations map[int64][]userLocation) error {
+	baseDir := v.cfg.Download.Dir
+	depth := v.layout.Depth()
+
+	err := filepath.WalkDir(baseDir, func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == baseDir {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.IsDir() || p == baseDir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(baseDir, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if strings.Count(rel, "/")+1 < depth {
+			return nil
+		}
+
+		// Директория на глубине раскладки: либо директория пользователя, либо посторонняя
+		userID, userKey, ok := v.layout.ParseUserKey(rel)
+		if !ok || userKey != rel {
+			return filepath.SkipDir
+		}
+
+		if v.scanUserDir(report, userID, p) > 0 {
+			return filepath.SkipDir
+		}
+
+		// Директория без файлов, и в хранилище по этому пути у пользователя ничего нет
+		for _, location := range locations[userID] {
+			if location.path == userKey {
+				return filepath.SkipDir
+			}
+		}
+
+		issue := VerifyIssue{Type: IssueEmptyDir, UserID: userID, Path: p}
+		if report.Fix {
+			issue.Fixed = os.RemoveAll(p) == nil
+		}
+		report.add(issue)
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка чтения %s: %w", baseDir, err)
+	}
+	return nil
+}
+
+// scanUserDir находит временные файлы в директории пользователя. Возвращает количество остальных файлов.
+func (v *Verifier) scanUserDir(report *VerifyReport, userID int64, userPath string) int {
+	fileCount := 0
+	err := filepath.WalkDir(userPath, func(p string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		if isTempFile(p) {
+			issue := VerifyIssue{Type: IssueOrphanTmp, UserID: userID, Path: p}
+			if report.Fix {
+				issue.Fixed = os.Remove(p) == nil
+			}
+			report.add(issue)
+			return nil
+		}
+
+		fileCount++
+		return nil
+	})
+	if err != nil {
+		log.Printf("Ошибка обхода %s: %v", userPath, err)
+	}
+	return fileCount
+}
+
+// checkUser сверяет директории пользователя на диске, его статус в user_file_statuses и запись в users
+func (v *Verifier) checkUser(ctx context.Context, report *VerifyReport, userID int64, locations []userLocation, recorded map[string]bool, user *models.User) {
+	if user == nil {
+		for _, location := range locations {
+			report.add(VerifyIssue{
+				Type:   IssueUnknownUser,
+				UserID: userID,
+				Path:   v.store.Location(location.path),
+				Detail: "пользователь не найден в users",
+			})
+		}
+		return
+	}
+
+	// Директории по устаревшему пути (сменился citizenship_id, ФИО и т.п.) переносим на актуальное место
+	expectedKey := v.layout.UserKey(user)
+	onDisk := make(map[string]bool)
+	for _, location := range locations {
+		if location.path != expectedKey {
+			issue := VerifyIssue{
+				Type:   IssueMoved,
+				UserID: userID,
+				Path:   v.store.Location(location.path),
+				Detail: fmt.Sprintf("%s -> %s", location.path, expectedKey),
+			}
+			if report.Fix && user.HasGroup() {
+				err := storage.Move(ctx, v.store, location.path+"/", expectedKey+"/")
+				if err != nil {
+					log.Printf("Ошибка переноса %s: %v", location.path, err)
+				}
+				issue.Fixed = err == nil
+			}
+			report.add(issue)
+			if !issue.Fixed {
+				continue
+			}
+		}
+		for category, ok := range location.categories {
+			if ok {
+				onDisk[category] = true
+			}
+		}
+	}
+
+	if recorded != nil && len(locations) == 0 {
+		cleared := make(map[string]bool)
+		for category, downloaded := range recorded {
+			if downloaded {
+				cleared[category] = false
+			}
+		}
+		if len(cleared) > 0 {
+			issue := VerifyIssue{Type: IssueMissingDir, UserID: userID, Path: v.store.Location(expectedKey)}
+			if report.Fix {
+				issue.Fixed = v.userFileRepo.Upsert(userID, cleared) == nil
+			}
+			report.add(issue)
+		}
+		return
+	}
+
+	issues := make([]VerifyIssue, 0)
+	actual := map[string]bool{}
+	for _, fileCategory := range v.layout.Categories() {
+		category := fileCategory.Name
+		actual[category] = recorded[category]
+
+		switch {
+		case recorded[category] && !onDisk[category]:
+			issues = append(issues, VerifyIssue{
+				Type:   IssueMissingFiles,
+				UserID: userID,
+				Path:   v.store.Location(v.layout.CategoryKey(user, category)),
+				Detail: category,
+			})
+			actual[category] = false
+		case !recorded[category] && onDisk[category] && user.HasFiles(category):
+			issues = append(issues, VerifyIssue{
+				Type:   IssueUntrackedFiles,
+				UserID: userID,
+				Path:   v.store.Location(v.layout.CategoryKey(user, category)),
+				Detail: category,
+			})
+			actual[category] = true
+		}
+	}
+
+	fixed := false
+	if len(issues) > 0 && report.Fix {
+		if err := v.userFileRepo.Upsert(userID, actual); err != nil {
+			log.Printf("Ошибка исправления статуса пользователя %d: %v", userID, err)
+		} else {
+			fixed = true
+		}
+	}
+	for _, issue := range issues {
+		issue.Fixed = fixed
+		report.add(issue)
+	}
+}
@@ -3,6 +3,7 @@ let perPage = 20;
 let totalPages = 1;
 let selectedUsers = new Set();
 let sortOrder = 'DESC'; // По умолчанию DESC
+let pageCursors = {}; // Курсоры keyset-пагинации: номер страницы -> id последней строки предыдущей
 
 // Загрузка данных при загрузке страницы
 document.addEventListener('DOMContentLoaded', function() {
@@ -15,6 +16,7 @@ document.addEventListener('DOMContentLoaded', function() {
 // Переключение сортировки
 function toggleSort() {
     sortOrder = sortOrder === 'DESC' ? 'ASC' : 'DESC';
+    pageCursors = {}; // Курсоры зависят от направления сортировки
     updateSortIcon();
     loadUsers(1); // Загружаем первую страницу с новой сортировкой
 }
@@ -39,7 +41,13 @@ async function loadUsers(page) {
     document.getElementById('error-message').style.display = 'none';
 
     try {
-        const response = await fetch(`/api/users?page=${page}&per_page=${perPage}&sort_order=${sortOrder}`);
+        // Если курсор для страницы известен, запрашиваем её по keyset вместо OFFSET
+        let url = `/api/users?page=${page}&per_page=${perPage}&sort_order=${sortOrder}`;
+        if (pageCursors[page]) {
+            url += `&cursor=${pageCursors[page]}`;
+        }
+
+        const response = await fetch(url);
         if (!response.ok) {
             throw new Error('Ошибка загрузки данных');
         }
@@ -60,6 +68,11 @@ async function loadUsers(page) {
 
         totalPages = data.total_pages;
 
+        // Запоминаем курсор следующей страницы
+        if (data.next_cursor) {
+            pageCursors[page + 1] = data.next_cursor;
+        }
+
         // Рендерим таблицу
         renderTable(data.data);
 
@@ -77,6 +90,13 @@ async function loadUsers(page) {
     }
 }
 
+// Ошибки ограничений загрузки (DOWNLOAD_MAX_FILE_SIZE, DOWNLOAD_MAX_USER_SIZE, DOWNLOAD_ALLOWED_CONTENT_TYPES)
+const limitErrorClasses = {
+    too_large: 'Слишком большой файл',
+    user_quota: 'Лимит пользователя',
+    content_type: 'Недопустимый тип',
+};
+
 // Рендеринг таблицы
 function renderTable(users) {
     const tbody = document.getElementById('users-table-body');
@@ -98,54 +118,49 @@ function renderTable(users) {
         const userIdCell = document.createElement('td');
         userIdCell.textContent = user.user_id;
 
-        // Citizenship ID
+        // Группа (citizenship_id)
         const citizenshipCell = document.createElement('td');
         const citizenshipBadge = document.createElement('span');
         citizenshipBadge.className = 'badge bg-primary badge-custom';
-        citizenshipBadge.textContent = user.citizenship_id || 'N/A';
+        citizenshipBadge.textContent = user.group || 'N/A';
         citizenshipCell.appendChild(citizenshipBadge);
 
-        // Document Files
-        const docFilesCell = document.createElement('td');
-        if (user.document_files && user.document_files.trim() !== '') {
-            const link = document.createElement('a');
-            link.href = user.document_files;
-            link.target = '_blank';
-            link.className = 'file-link';
-            link.title = user.document_files;
-            link.innerHTML = '<i class="bi bi-link-45deg"></i> Ссылка';
-            docFilesCell.appendChild(link);
-        } else {
-            docFilesCell.innerHTML = '<span class="text-muted">-</span>';
-        }
+        // Ссылки и статус по каждой категории
+        const categoryCells = [];
+        categories.forEach(category => {
+            const files = (user.files || {})[category];
+            const filesCell = document.createElement('td');
+            if (files && files.trim() !== '') {
+                const link = document.createElement('a');
+                link.href = files;
+                link.target = '_blank';
+                link.className = 'file-link';
+                link.title = files;
+                link.innerHTML = '<i class="bi bi-link-45deg"></i> Ссылка';
+                filesCell.appendChild(link);
+            } else {
+                filesCell.innerHTML = '<span class="text-muted">-</span>';
+            }
 
-        // Status Document
-        const docStatusCell = document.createElement('td');
-        const docBadge = document.createElement('span');
-        docBadge.className = user.document ? 'badge bg-success badge-custom' : 'badge bg-secondary badge-custom';
-        docBadge.innerHTML = user.document ? '<i class="bi bi-check-circle"></i> True' : '<i class="bi bi-x-circle"></i> False';
-        docStatusCell.appendChild(docBadge);
-
-        // Address Files
-        const addrFilesCell = document.createElement('td');
-        if (user.address_files && user.address_files.trim() !== '') {
-            const link = document.createElement('a');
-            link.href = user.address_files;
-            link.target = '_blank';
-            link.className = 'file-link';
-            link.title = user.address_files;
-            link.innerHTML = '<i class="bi bi-link-45deg"></i> Ссылка';
-            addrFilesCell.appendChild(link);
-        } else {
-            addrFilesCell.innerHTML = '<span class="text-muted">-</span>';
-        }
+            const downloaded = (user.status || {})[category];
+            const statusCell = document.createElement('td');
+            const badge = document.createElement('span');
+            badge.className = downloaded ? 'badge bg-success badge-custom' : 'badge bg-secondary badge-custom';
+            badge.innerHTML = downloaded ? '<i class="bi bi-check-circle"></i> True' : '<i class="bi bi-x-circle"></i> False';
+            statusCell.appendChild(badge);
+
+            // Причина последней неудачи: нарушение ограничений выделяется отдельно
+            const failure = (user.errors || {})[category];
+            if (!downloaded && failure) {
+                const errorBadge = document.createElement('span');
+                errorBadge.className = 'badge badge-custom ms-1 ' + (limitErrorClasses[failure.class] ? 'bg-danger' : 'bg-warning text-dark');
+                errorBadge.textContent = limitErrorClasses[failure.class] || failure.class;
+                errorBadge.title = failure.error;
+                statusCell.appendChild(errorBadge);
+            }
 
-        // Status Address
-        const addrStatusCell = document.createElement('td');
-        const addrBadge = document.createElement('span');
-        addrBadge.className = user.address ? 'badge bg-success badge-custom' : 'badge bg-secondary badge-custom';
-        addrBadge.innerHTML = user.address ? '<i class="bi bi-check-circle"></i> True' : '<i class="bi bi-x-circle"></i> False';
-        addrStatusCell.appendChild(addrBadge);
+            categoryCells.push(filesCell, statusCell);
+        });
 
         // Действия
         const actionsCell = document.createElement('td');
@@ -159,10 +174,7 @@ function renderTable(users) {
         row.appendChild(checkboxCell);
         row.appendChild(userIdCell);
         row.appendChild(citizenshipCell);
-        row.appendChild(docFilesCell);
-        row.appendChild(docStatusCell);
-        row.appendChild(addrFilesCell);
-        row.appendChild(addrStatusCell);
+        categoryCells.forEach(cell => row.appendChild(cell));
         row.appendChild(actionsCell);
 
         tbody.appendChild(row);
@@ -283,12 +295,14 @@ async function downloadUserFiles(userId) {
             let message = `✓ Файлы пользователя ${userId} успешно скачаны!\n\n`;
             message += `Путь: ${data.path}\n`;
             message += `Скачано файлов: ${data.files_downloaded}\n`;
-            if (data.document_success) {
-                message += `✓ Document файлы скачаны\n`;
-            }
-            if (data.address_success) {
-                message += `✓ Address файлы скачаны\n`;
-            }
+            Object.entries(data.categories || {}).forEach(([category, downloaded]) => {
+                if (downloaded) {
+                    message += `✓ ${category} файлы скачаны\n`;
+                }
+            });
+            (data.errors || []).forEach(error => {
+                message += `✗ ${error}\n`;
+            });
             alert(message);
 
             // Перезагружаем таблицу и статистику для обновления статусов
@@ -394,9 +408,11 @@ async function startDownload() {
 
         // Показываем панель прогресса
         document.getElementById('download-progress-container').style.display = 'block';
+        document.getElementById('resume-job-container').style.setProperty('display', 'none', 'important');
 
-        // Отключаем кнопку запуска и включаем кнопку остановки
+        // Отключаем кнопку запуска и включаем кнопки паузы и остановки
         document.getElementById('start-download-btn').disabled = true;
+        document.getElementById('pause-download-btn').disabled = false;
         document.getElementById('stop-download-btn').disabled = false;
 
         // Запускаем обновление прогресса
@@ -429,9 +445,12 @@ async function stopDownload() {
             progressInterval = null;
         }
 
-        // Включаем кнопку запуска и отключаем кнопку остановки
+        // Включаем кнопку запуска и отключаем кнопки паузы и остановки
         document.getElementById('start-download-btn').disabled = false;
+        document.getElementById('pause-download-btn').disabled = true;
         document.getElementById('stop-download-btn').disabled = true;
+        updatePauseButton(false);
+        loadResumableJob();
 
         alert('Скачивание остановлено!');
     } catch (error) {
@@ -440,6 +459,88 @@ async function stopDownload() {
     }
 }
 
+// Поставить на паузу или продолжить скачивание
+async function togglePause() {
+    const paused = document.getElementById('download-status').textContent === 'paused';
+    const endpoint = paused ? '/api/download/resume' : '/api/download/pause';
+
+    try {
+        const response = await fetch(endpoint, {
+            method: 'POST'
+        });
+
+        if (!response.ok) {
+            const data = await response.json();
+            throw new Error(data.error || 'Ошибка переключения паузы');
+        }
+
+        const data = await response.json();
+        updatePauseButton(data.status === 'paused');
+        updateProgress();
+    } catch (error) {
+        console.error('Ошибка:', error);
+        alert('Ошибка: ' + error.message);
+    }
+}
+
+// Обновить вид кнопки паузы
+function updatePauseButton(paused) {
+    const button = document.getElementById('pause-download-btn');
+    if (paused) {
+        button.className = 'btn btn-primary btn-lg w-100';
+        button.innerHTML = '<i class="bi bi-play-fill"></i> Продолжить';
+    } else {
+        button.className = 'btn btn-warning btn-lg w-100';
+        button.innerHTML = '<i class="bi bi-pause-fill"></i> Пауза';
+    }
+}
+
+// Текущая скорость запросов по хостам: "ucarecdn.com 2.00/с, cdn.example.com 0.50/с (пауза)"
+function formatRates(rates) {
+    if (!rates || rates.length === 0) {
+        return '-';
+    }
+    return rates.map(r => {
+        let text = `${r.host} ${r.rate.toFixed(2)}/с`;
+        if (r.blocked_until) {
+            text += ' (пауза)';
+        }
+        return text;
+    }).join(', ');
+}
+
+// Ограничение пропускной способности: "2.0MB/с (окно 09:00-18:00=2MB)"
+function formatBandwidth(bandwidth) {
+    if (!bandwidth) {
+        return '-';
+    }
+    let text = bandwidth.limit > 0 ? `${bandwidth.label}/с` : bandwidth.label;
+    if (bandwidth.window) {
+        text += ` (окно ${bandwidth.window})`;
+    }
+    return text;
+}
+
+// Размер в байтах: "3.4MB"
+function formatBytes(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let value = bytes || 0;
+    let unit = 0;
+    while (value >= 1024 && unit < units.length - 1) {
+        value /= 1024;
+        unit++;
+    }
+    return unit === 0 ? `${value}B` : `${value.toFixed(1)}${units[unit]}`;
+}
+
+// Дедупликация: "12 файлов, 3.4MB"
+function formatDedup(files, bytes) {
+    if (!files) {
+        return '-';
+    }
+    return `${files} файлов, ${formatBytes(bytes)}`;
+}
+
 // Обновить прогресс
 async function updateProgress() {
     try {
@@ -454,6 +555,7 @@ async function updateProgress() {
         const statusBadge = document.getElementById('download-status');
         statusBadge.textContent = data.status;
         statusBadge.className = 'badge ' + getStatusClass(data.status);
+        updatePauseButton(data.status === 'paused');
 
         // Обновляем прогресс-бар
         const progressPercent = data.progress_percent || 0;
@@ -467,6 +569,12 @@ async function updateProgress() {
         document.getElementById('progress-successful').textContent = data.successful_users;
         document.getElementById('progress-files').textContent = data.successful_files;
         document.getElementById('progress-duration').textContent = formatDuration(data.duration_seconds);
+        document.getElementById('progress-rates').textContent = formatRates(data.rate_limits);
+        document.getElementById('progress-bandwidth').textContent = formatBandwidth(data.bandwidth);
+        document.getElementById('progress-dedup').textContent = formatDedup(data.dedup_files, data.dedup_bytes);
+        if (data.paused_by_schedule) {
+            statusBadge.textContent = 'paused (расписание)';
+        }
 
         // Если скачивание завершено или остановлено
         if (data.status === 'completed' || data.status === 'idle' || data.status === 'failed') {
@@ -476,7 +584,9 @@ async function updateProgress() {
             }
 
             document.getElementById('start-download-btn').disabled = false;
+            document.getElementById('pause-download-btn').disabled = true;
             document.getElementById('stop-download-btn').disabled = true;
+            updatePauseButton(false);
 
             // Перезагружаем список пользователей и статистику
             if (data.status === 'completed') {
@@ -537,21 +647,93 @@ async function loadDownloadStats() {
         document.getElementById('stats-downloaded').textContent = data.fully_downloaded || 0;
         document.getElementById('stats-partial').textContent = data.partially_downloaded || 0;
         document.getElementById('stats-remaining').textContent = data.remaining || 0;
+
+        const duplicates = data.duplicates || {};
+        let duplicatesText = formatDedup(duplicates.files, duplicates.bytes);
+        if (duplicates.files) {
+            duplicatesText += data.dedup ? ' (сэкономлено)' : ' (можно сэкономить с DOWNLOAD_DEDUP)';
+        }
+        document.getElementById('stats-duplicates').textContent = duplicatesText;
     } catch (error) {
         console.error('Ошибка загрузки статистики:', error);
     }
 }
 
+// === Задания скачивания ===
+
+let resumableJobId = null;
+
+// Проверить, есть ли задание, которое можно продолжить
+async function loadResumableJob() {
+    const container = document.getElementById('resume-job-container');
+    try {
+        const response = await fetch('/api/download/jobs?limit=1');
+        if (!response.ok) {
+            throw new Error('Ошибка загрузки заданий');
+        }
+
+        const jobs = await response.json();
+        if (jobs.length > 0 && jobs[0].resumable) {
+            const job = jobs[0].job;
+            resumableJobId = job.id;
+            document.getElementById('resume-job-text').textContent =
+                `Задание #${job.id} (${job.status}) остановлено на user_id ${job.last_user_id}, обработано ${job.processed_users} из ${job.total_users}`;
+            container.style.setProperty('display', 'flex', 'important');
+        } else {
+            resumableJobId = null;
+            container.style.setProperty('display', 'none', 'important');
+        }
+    } catch (error) {
+        console.error('Ошибка загрузки заданий:', error);
+    }
+}
+
+// Продолжить задание с контрольной точки
+async function resumeJob() {
+    if (!resumableJobId) {
+        return;
+    }
+
+    try {
+        const response = await fetch(`/api/download/jobs/resume?job_id=${resumableJobId}`, {
+            method: 'POST'
+        });
+
+        if (!response.ok) {
+            const data = await response.json();
+            throw new Error(data.error || 'Ошибка продолжения задания');
+        }
+
+        document.getElementById('resume-job-container').style.setProperty('display', 'none', 'important');
+        document.getElementById('download-progress-container').style.display = 'block';
+        document.getElementById('start-download-btn').disabled = true;
+        document.getElementById('pause-download-btn').disabled = false;
+        document.getElementById('stop-download-btn').disabled = false;
+
+        if (progressInterval) {
+            clearInterval(progressInterval);
+        }
+        progressInterval = setInterval(updateProgress, 1000);
+    } catch (error) {
+        console.error('Ошибка:', error);
+        alert('Ошибка: ' + error.message);
+    }
+}
+
 // Проверяем статус при загрузке страницы
 document.addEventListener('DOMContentLoaded', function() {
+    loadResumableJob();
+
     // Проверяем текущий статус скачивания
     fetch('/api/download/progress')
         .then(response => response.json())
         .then(data => {
-            if (data.status === 'running') {
+            if (data.status === 'running' || data.status === 'paused') {
                 document.getElementById('download-progress-container').style.display = 'block';
                 document.getElementById('start-download-btn').disabled = true;
+                document.getElementById('pause-download-btn').disabled = false;
                 document.getElementById('stop-download-btn').disabled = false;
+                updatePauseButton(data.status === 'paused');
 
                 // Запускаем обновление прогресса
                 progressInterval = setInterval(updateProgress, 1000);
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local хранилище в директории на диске (DOWNLOAD_DIR)
+type Local struct {
+	Root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{Root: root}
+}
+
+// Path возвращает путь к объекту на диске
+func (l *Local) Path(key string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(key))
+}
+
+// Location для локального хранилища - путь на диске
+func (l *Local) Location(key string) string {
+	return l.Path(key)
+}
+
+// resolve проверяет ключ и возвращает путь на диске
+func (l *Local) resolve(key string) (string, error) {
+	cleaned := path.Clean(key)
+	if cleaned == "." || cleaned == ".." || path.IsAbs(cleaned) || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("недопустимый ключ: %s", key)
+	}
+	return l.Path(cleaned), nil
+}
+
+func (l *Local) Put(ctx context.Context, obj Object, body io.Reader) error {
+	dest, err := l.resolve(obj.Key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("ошибка создания директории: %w", err)
+	}
+
+	// Пишем через временный файл, чтобы не оставить обрезанный объект
+	tmpPath := dest + ".part"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("ошибка создания файла %s: %w", tmpPath, err)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("ошибка записи файла %s: %w", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ошибка записи файла %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ошибка переименования файла: %w", err)
+	}
+	return nil
+}
+
+// PutFile переименовывает локальный файл на место объекта
+func (l *Local) PutFile(ctx context.Context, obj Object, localPath string) error {
+	dest, err := l.resolve(obj.Key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("ошибка создания директории: %w", err)
+	}
+	if err := os.Rename(localPath, dest); err != nil {
+		return fmt.Errorf("ошибка переименования файла: %w", err)
+	}
+	return nil
+}
+
+// Link создаёт жёсткую ссылку toKey на файл fromKey: данные на диске хранятся один раз
+func (l *Local) Link(ctx context.Context, fromKey, toKey string) error {
+	src, err := l.resolve(fromKey)
+	if err != nil {
+		return err
+	}
+	dest, err := l.resolve(toKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("ошибка создания директории: %w", err)
+	}
+
+	// Ссылка создаётся рядом и переименовывается, чтобы заменить существующий файл атомарно
+	tmpPath := dest + ".link"
+	os.Remove(tmpPath)
+	if err := os.Link(src, tmpPath); err != nil {
+		return fmt.Errorf("ошибка создания ссылки на %s: %w", src, err)
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ошибка переименования файла: %w", err)
+	}
+	return nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*Object, error) {
+	p, err := l.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && info.IsDir() {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Object{
+		Key:         key,
+		Size:        info.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(p)),
+		ModTime:     info.ModTime(),
+	}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.resolve(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]Object, error) {
+	// Обходим только директорию, в которой может лежать префикс
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+	if dir == "." {
+		dir = ""
+	}
+
+	objects := make([]Object, 0)
+	err := filepath.WalkDir(l.Path(dir), func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, Object{
+			Key:         key,
+			Size:        info.Size(),
+			ContentType: mime.TypeByExtension(filepath.Ext(p)),
+			ModTime:     info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *Local) ListDirs(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(l.Path(prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	return dirs, nil
+}
+
+// Move переименовывает директорию fromPrefix в toPrefix, если на новом месте её ещё нет
+func (l *Local) Move(ctx context.Context, fromPrefix, toPrefix string) error {
+	from, err := l.resolve(strings.TrimSuffix(fromPrefix, "/"))
+	if err != nil {
+		return err
+	}
+	to, err := l.resolve(strings.TrimSuffix(toPrefix, "/"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("директория %s уже существует", to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"up-down/config"
+)
+
+// ErrNotExist объект не найден в хранилище
+var ErrNotExist = errors.New("объект не найден")
+
+// ErrLinkUnsupported хранилище не умеет ссылаться на один объект под несколькими ключами
+var ErrLinkUnsupported = errors.New("хранилище не поддерживает ссылки на объекты")
+
+// Object сведения об объекте хранилища.
+// Key - путь относительно корня хранилища через "/": {citizenship_id}/user_{id}/documents/document_1.pdf
+type Object struct {
+	Key         string
+	Size        int64
+	ContentType string
+	SHA256      string // может быть пустым, если хранилище его не знает
+	ModTime     time.Time
+}
+
+// Storage хранилище скачанных файлов
+type Storage interface {
+	// Put записывает объект целиком. obj.Size - размер body, если известен (иначе -1).
+	Put(ctx context.Context, obj Object, body io.Reader) error
+	// Get открывает объект на чтение
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Stat возвращает сведения об объекте или ErrNotExist
+	Stat(ctx context.Context, key string) (*Object, error)
+	// Delete удаляет объект (отсутствие объекта ошибкой не считается)
+	Delete(ctx context.Context, key string) error
+	// List возвращает объекты, ключи которых начинаются с prefix
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Location человекочитаемое расположение объекта для логов и журнала
+	Location(key string) string
+}
+
+// filePutter хранилище, которое умеет забрать локальный файл без копирования
+type filePutter interface {
+	PutFile(ctx context.Context, obj Object, localPath string) error
+}
+
+// linker хранилище, которое умеет делать один объект доступным под другим ключом без копирования (hardlink)
+type linker interface {
+	Link(ctx context.Context, fromKey, toKey string) error
+}
+
+// dirLister хранилище, которое умеет перечислять поддиректории (общие префиксы ключей) одного уровня
+type dirLister interface {
+	ListDirs(ctx context.Context, prefix string) ([]string, error)
+}
+
+// mover хранилище, которое умеет переносить объекты без копирования
+type mover interface {
+	Move(ctx context.Context, fromPrefix, toPrefix string) error
+}
+
+// New создаёт хранилище по настройкам STORAGE_TYPE
+func New(cfg *config.Config) (Storage, error) {
+	switch cfg.Storage.Type {
+	case "", "local":
+		return NewLocal(cfg.Download.Dir), nil
+	case "s3":
+		return NewS3(&cfg.Storage)
+	default:
+		return nil, fmt.Errorf("неизвестный тип хранилища: %s", cfg.Storage.Type)
+	}
+}
+
+// PutFile переносит локальный файл в хранилище. После успешной записи файла на диске не остаётся.
+func PutFile(ctx context.Context, s Storage, obj Object, localPath string) error {
+	if fp, ok := s.(filePutter); ok {
+		return fp.PutFile(ctx, obj, localPath)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if obj.Size < 0 {
+		if stat, err := f.Stat(); err == nil {
+			obj.Size = stat.Size()
+		}
+	}
+
+	if err := s.Put(ctx, obj, f); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(localPath)
+}
+
+// PutBytes записывает небольшой объект из памяти (info.json, manifest.json)
+func PutBytes(ctx context.Context, s Storage, key, contentType string, data []byte) error {
+	return s.Put(ctx, Object{Key: key, Size: int64(len(data)), ContentType: contentType}, bytes.NewReader(data))
+}
+
+// ReadAll читает объект целиком
+func ReadAll(ctx context.Context, s Storage, key string) ([]byte, error) {
+	body, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// CanLink сообщает, поддерживает ли хранилище ссылки на объекты
+func CanLink(s Storage) bool {
+	_, ok := s.(linker)
+	return ok
+}
+
+// Link делает объект fromKey доступным под ключом toKey без копирования данных.
+// Существующий объект toKey заменяется.
+func Link(ctx context.Context, s Storage, fromKey, toKey string) error {
+	if l, ok := s.(linker); ok {
+		return l.Link(ctx, fromKey, toKey)
+	}
+	return ErrLinkUnsupported
+}
+
+// ListDirs возвращает имена поддиректорий prefix (prefix пустой или оканчивается на "/") без завершающего "/".
+// Позволяет обходить большое хранилище по частям, не перечисляя все объекты сразу.
+func ListDirs(ctx context.Context, s Storage, prefix string) ([]string, error) {
+	if l, ok := s.(dirLister); ok {
+		return l.ListDirs(ctx, prefix)
+	}
+
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	dirs := make([]string, 0)
+	for _, obj := range objects {
+		dir, _, ok := strings.Cut(strings.TrimPrefix(obj.Key, prefix), "/")
+		if ok && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// Move переносит все объекты с префиксом fromPrefix под префикс toPrefix
+func Move(ctx context.Context, s Storage, fromPrefix, toPrefix string) error {
+	if m, ok := s.(mover); ok {
+		return m.Move(ctx, fromPrefix, toPrefix)
+	}
+
+	existing, err := s.List(ctx, toPrefix)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("объекты с префиксом %s уже существуют", toPrefix)
+	}
+
+	objects, err := s.List(ctx, fromPrefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := copyObject(ctx, s, obj, toPrefix+strings.TrimPrefix(obj.Key, fromPrefix)); err != nil {
+			return fmt.Errorf("ошибка переноса %s: %w", obj.Key, err)
+		}
+		if err := s.Delete(ctx, obj.Key); err != nil {
+			return fmt.Errorf("ошибка удаления %s: %w", obj.Key, err)
+		}
+	}
+	return nil
+}
+
+// copyObject копирует объект под новым ключом вместе с его метаданными
+func copyObject(ctx context.Context, s Storage, obj Object, newKey string) error {
+	if stat, err := s.Stat(ctx, obj.Key); err == nil {
+		obj = *stat
+	}
+
+	body, err := s.Get(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	obj.Key = newKey
+	return s.Put(ctx, obj, body)
+}